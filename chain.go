@@ -0,0 +1,141 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "io/ioutil"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/state"
+
+    "github.com/containernetworking/cni/pkg/types"
+    "github.com/containernetworking/cni/pkg/types/current"
+    "github.com/containernetworking/cni/pkg/version"
+)
+
+// 0.4.0 results have the same layout as 0.3.1 ones
+const specVersion040 = "0.4.0"
+
+var supportedVersions = version.PluginSupports("0.1.0", "0.2.0", "0.3.0", "0.3.1", specVersion040)
+
+// prevResult returns the result of the former plugins of the chain, nil
+// when unicni comes first.
+func prevResult(conf *CNINetConf) (*current.Result, error) {
+    if conf.RawPrevResult == nil {
+        return nil, nil
+    }
+    raw, err := json.Marshal(conf.RawPrevResult)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read prevResult: %v", err)
+    }
+
+    resultVersion := conf.CNIVersion
+    if v, ok := conf.RawPrevResult["cniVersion"].(string); ok && v != "" {
+        resultVersion = v
+    }
+    if resultVersion == specVersion040 {
+        resultVersion = current.ImplementedSpecVersion
+    }
+
+    res, err := version.NewResult(resultVersion, raw)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+    }
+    if r, ok := res.(*current.Result); ok {
+        // the version it claims may be 0.4.0
+        r.CNIVersion = current.ImplementedSpecVersion
+        return r, nil
+    }
+    return current.NewResultFromResult(res)
+}
+
+// mergeResult appends what unicni set up to the result of the chain,
+// the interface indexes of its addresses move past the former ones.
+func mergeResult(prev *current.Result, own *current.Result) *current.Result {
+    if prev == nil {
+        return own
+    }
+
+    offset := len(prev.Interfaces)
+    prev.Interfaces = append(prev.Interfaces, own.Interfaces...)
+    for _, ipc := range own.IPs {
+        if ipc.Interface != nil {
+            ipc.Interface = current.Int(*ipc.Interface + offset)
+        }
+        prev.IPs = append(prev.IPs, ipc)
+    }
+    prev.Routes = append(prev.Routes, own.Routes...)
+
+    prev.DNS.Nameservers = appendMissing(prev.DNS.Nameservers, own.DNS.Nameservers)
+    prev.DNS.Search = appendMissing(prev.DNS.Search, own.DNS.Search)
+    prev.DNS.Options = appendMissing(prev.DNS.Options, own.DNS.Options)
+    if prev.DNS.Domain == "" {
+        prev.DNS.Domain = own.DNS.Domain
+    }
+    return prev
+}
+
+func appendMissing(list []string, more []string) []string {
+    for _, s := range more {
+        found := false
+        for _, l := range list {
+            if l == s {
+                found = true
+                break
+            }
+        }
+        if !found {
+            list = append(list, s)
+        }
+    }
+    return list
+}
+
+// formatResult renders the result the way the runtime expects it.
+func formatResult(result *current.Result, cniVersion string) ([]byte, error) {
+    var res types.Result = result
+    if cniVersion == specVersion040 {
+        result.CNIVersion = cniVersion
+    } else {
+        var err error
+        if res, err = result.GetAsVersion(cniVersion); err != nil {
+            return nil, err
+        }
+    }
+    return json.MarshalIndent(res, "", "    ")
+}
+
+// cmdCheck verifies, for CHECK of 0.4.0, that the ports the ADD of the
+// container set up are still in its netns, up and with their addresses.
+func cmdCheck() error {
+    stdinData, err := ioutil.ReadAll(os.Stdin)
+    if err != nil {
+        return err
+    }
+    conf := CNINetConf{}
+    if err = json.Unmarshal(stdinData, &conf); err != nil {
+        return fmt.Errorf("failed to load netconf: %v", err)
+    }
+    if conf.CNIVersion != specVersion040 {
+        return &types.Error{Code: types.ErrIncompatibleCNIVersion, Msg: fmt.Sprintf("CHECK is not supported by %s", conf.CNIVersion)}
+    }
+
+    st, err := state.Load(os.Getenv("CNI_CONTAINERID"))
+    if os.IsNotExist(err) {
+        // a pod without annotation, unicni set nothing up
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to load state: %v", err)
+    }
+    if st.NetInfo == nil {
+        return nil
+    }
+    ports := expectedPorts(st.NetInfo)
+    inspectPorts(st, ports)
+    if drift := kernelDrift(ports); len(drift) != 0 {
+        return fmt.Errorf("%s", strings.Join(drift, "; "))
+    }
+    return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "net"
+
+    "github.com/union-cni/pkg/ip"
+    "github.com/union-cni/pkg/ipam"
+    "github.com/union-cni/pkg/netinfo"
+    "github.com/union-cni/pkg/state"
+
+    "github.com/containernetworking/cni/pkg/types/current"
+)
+
+// ChannelIPAMConf gives system channels their addresses from node-local
+// pools. Keys are "<credential>/<group>/<channel type>", the subnet of the
+// netconf wins over the one of the annotation.
+type ChannelIPAMConf struct {
+    Subnets map[string]string                   `json:"subnets"`
+    Reservations map[string]map[string]string   `json:"reservations"`
+}
+
+func poolName(cred string, group string, chanType string) string {
+    return fmt.Sprintf("%s-%s-%s", cred, group, chanType)
+}
+
+// channelPool returns nil when the channel has no subnet.
+func channelPool(conf *ChannelIPAMConf, netInfo *netinfo.NetworkInfo, chanType string) (*ipam.Pool, error) {
+    cred := netInfo.GetCred()
+    group := netInfo.GetGroup()
+    chanInfo := netInfo.GetChannelInfo(chanType)
+    key := fmt.Sprintf("%s/%s/%s", cred, group, chanType)
+
+    subnet := chanInfo.Subnet
+    reservations := chanInfo.Reservations
+    if conf != nil {
+        if s, ok := conf.Subnets[key]; ok {
+            subnet = s
+        }
+        if r, ok := conf.Reservations[key]; ok {
+            reservations = r
+        }
+    }
+    if subnet == "" {
+        return nil, nil
+    }
+
+    _, ipnet, err := net.ParseCIDR(subnet)
+    if err != nil {
+        return nil, fmt.Errorf("invalid subnet %q of %s: %v", subnet, key, err)
+    }
+    pool := &ipam.Pool{
+        Name: poolName(cred, group, chanType),
+        Subnet: ipnet,
+        Reserved: make(map[string]net.IP),
+    }
+    for devID, s := range reservations {
+        ip := net.ParseIP(s)
+        if ip == nil {
+            return nil, fmt.Errorf("invalid reservation %q of %s in %s", s, devID, key)
+        }
+        pool.Reserved[devID] = ip
+    }
+    return pool, nil
+}
+
+// addChannelAddr allocates the address of a channel, assigns it in the pod
+// and reports it on the last interface of the result.
+func addChannelAddr(pool *ipam.Pool, devID string, chanName string, st *state.State, nspath string, result *current.Result) error {
+    addr, err := ipam.Allocate(pool, devID, st.ContainerID)
+    if err != nil {
+        return err
+    }
+    st.AddLease(state.LeaseState{
+        Pool: pool.Name,
+        ContainerPort: chanName,
+        Address: addr.String(),
+    })
+
+    if err = ip.AddrAddInNS(chanName, addr.String(), nspath); err != nil {
+        return err
+    }
+
+    version := "4"
+    if addr.IP.To4() == nil {
+        version = "6"
+    }
+    result.IPs = append(result.IPs, &current.IPConfig{
+        Version: version,
+        Interface: current.Int(len(result.Interfaces) - 1),
+        Address: *addr,
+    })
+    return nil
+}
+
+// releaseChannelAddrs gives back the addresses of the container, those
+// recorded in the state as well as any the channels may still hold.
+func releaseChannelAddrs(netInfo *netinfo.NetworkInfo, st *state.State, containerID string) {
+    pools := make(map[string]bool)
+    if st != nil {
+        for _, l := range st.Leases {
+            pools[l.Pool] = true
+        }
+    }
+    if netInfo != nil {
+        for chanType := range netInfo.GetSystemChannels() {
+            pools[poolName(netInfo.GetCred(), netInfo.GetGroup(), chanType)] = true
+        }
+    }
+
+    for pool := range pools {
+        if err := ipam.Release(pool, containerID); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to release address in %s: %v\r\n", pool, err)
+        }
+    }
+}
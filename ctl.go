@@ -0,0 +1,618 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "flag"
+    "sort"
+    "errors"
+    "reflect"
+    "strings"
+    "io/ioutil"
+    "text/tabwriter"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/client"
+    "github.com/union-cni/pkg/link"
+    "github.com/union-cni/pkg/netinfo"
+    "github.com/union-cni/pkg/state"
+
+    "github.com/containernetworking/cni/pkg/skel"
+    "github.com/containernetworking/cni/pkg/types/current"
+)
+
+const ctlUsage = `usage: unictl [flags] <command>
+
+commands:
+  list                  pods of the node with their ports
+  show bridge <name>    members, FDB and VLANs of a bridge
+  show pod <ns>/<name>  ports of a pod against its annotation
+  diff                  drift of every pod of the node, exits 1 on drift
+  plan [-f netinfo.json | <ns>/<name>] [-conf netconf] [-netns path]
+                        steps ADD would take for a network_info, doing none
+  gc [-dry-run] [-window 10s]
+                        remove the links and states of containers that are gone
+  port add <ns>/<name> -name ext3 [-type macvlan] [-host-port eno2] [-ip cidr] [-f port.yaml]
+                        set a new external port up in a running pod
+  port del <ns>/<name> -name ext3
+                        remove an external port from a running pod
+  link down|up <ns>/<name> <port> [-carrier]
+                        set a port admin down or up, or its carrier off or on
+  link flap <ns>/<name> <port> [-carrier] [-down 5s] [-every 30s] [-count n] [-random]
+                        flap a port until interrupted, and leave it up
+  ipsec rekey [-conf netconf] [-every 1m]
+                        roll the IPsec keys of the overlay over, once or on
+                        a period, without ADD or the node daemon
+  metrics [serve [-listen :9631]]
+                        counters of every port and host peer of the node,
+                        in the Prometheus text format, printed or served
+  topology up|down -f lab.yaml [-conf netconf] [-cni-path dir]
+                        set a lab of simulated devices up or down, each in
+                        a netns of its name
+
+flags:
+`
+
+var (
+    errDrift = errors.New("drift found")
+    errPlan = errors.New("ports can't be set up")
+)
+
+// ctlPort is one port of a pod, as recorded and as the kernel has it.
+type ctlPort struct {
+    Name string                 `json:"name"`
+    Kind string                 `json:"kind"`
+    Bridge string               `json:"bridge,omitempty"`
+    Addrs []string              `json:"addrs,omitempty"`
+    Pod *link.PortInfo          `json:"pod"`
+    HostPeer *link.PortInfo     `json:"host_peer"`
+    Error string                `json:"error,omitempty"`
+}
+
+// ctlPod is one sandbox of the node.
+type ctlPod struct {
+    Pod string                  `json:"pod"`
+    ContainerID string          `json:"container_id"`
+    Netns string                `json:"netns"`
+    NetInfo *netinfo.NetworkInfo `json:"network_info"`
+    Annotation *netinfo.NetworkInfo `json:"annotation,omitempty"`
+    Ports []*ctlPort            `json:"ports"`
+    Drift []string              `json:"drift"`
+}
+
+// expectedPorts lists the ports netInfo asks for, channels first. Bridge
+// is left empty for the ports that have none.
+func expectedPorts(netInfo *netinfo.NetworkInfo) []*ctlPort {
+    var ports []*ctlPort
+    var chanTypes []string
+    for chanType := range netInfo.GetSystemChannels() {
+        chanTypes = append(chanTypes, chanType)
+    }
+    sort.Strings(chanTypes)
+    for _, chanType := range chanTypes {
+        chanInfo := netInfo.GetChannelInfo(chanType)
+        ports = append(ports, &ctlPort{
+            Name: netInfo.GetSystemChannels()[chanType],
+            Kind: "channel:" + chanType,
+            Bridge: netInfo.BridgeName(chanType),
+            Addrs: addrStrings(chanInfo.IPs),
+        })
+    }
+    for i := range netInfo.ExternalPort {
+        ext := &netInfo.ExternalPort[i]
+        port := &ctlPort{
+            Name: ext.ContainerPort,
+            Kind: ext.Type,
+            Addrs: addrStrings(portAddrs(ext)),
+        }
+        switch ext.Type {
+            case "macvlan", "macvtap", "device", link.TunnelGre:
+            case link.TunnelGretap, link.TunnelVxlan:
+                if ext.Tunnel == nil || !ext.Tunnel.InPod {
+                    port.Bridge = netInfo.PortBridgeName(ext.ContainerPort)
+                }
+            default:
+                if port.Kind == "" {
+                    port.Kind = "bridge"
+                }
+                port.Bridge = netInfo.PortBridgeName(ext.ContainerPort)
+        }
+        ports = append(ports, port)
+    }
+    return ports
+}
+
+// inspectPorts fills in what the kernel has for the ports of st.
+func inspectPorts(st *state.State, ports []*ctlPort) {
+    for _, port := range ports {
+        for _, l := range st.Leases {
+            if l.ContainerPort == port.Name {
+                port.Addrs = append(port.Addrs, l.Address)
+            }
+        }
+        pod, err := link.PodPort(port.Name, st.Netns)
+        if err != nil {
+            port.Error = err.Error()
+            continue
+        }
+        port.Pod = pod
+        if pod.PeerIndex != 0 {
+            port.HostPeer, _ = link.HostPort(pod.PeerIndex)
+        }
+    }
+}
+
+func contains(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// portDrift compares the ports of the annotation with the recorded ones.
+func portDrift(recorded *netinfo.NetworkInfo, annotation *netinfo.NetworkInfo) []string {
+    var drift []string
+    if recorded.GetCred() != annotation.GetCred() || recorded.GetGroup() != annotation.GetGroup() || recorded.GetDeviceID() != annotation.GetDeviceID() {
+        drift = append(drift, "credential, group or deviceid changed in the annotation")
+    }
+    for chanType, chanName := range annotation.GetSystemChannels() {
+        name, ok := recorded.GetSystemChannels()[chanType]
+        switch {
+            case !ok:
+                drift = append(drift, fmt.Sprintf("channel %s not set up", chanType))
+            case name != chanName || !reflect.DeepEqual(recorded.GetChannelInfo(chanType), annotation.GetChannelInfo(chanType)):
+                drift = append(drift, fmt.Sprintf("channel %s changed in the annotation", chanType))
+        }
+    }
+    for chanType := range recorded.GetSystemChannels() {
+        if _, ok := annotation.GetSystemChannels()[chanType]; !ok {
+            drift = append(drift, fmt.Sprintf("channel %s removed from the annotation", chanType))
+        }
+    }
+    for i := range annotation.ExternalPort {
+        ext := &annotation.ExternalPort[i]
+        old := findPort(recorded, ext.ContainerPort)
+        switch {
+            case old == nil:
+                drift = append(drift, fmt.Sprintf("port %s not set up", ext.ContainerPort))
+            case !reflect.DeepEqual(old, ext):
+                drift = append(drift, fmt.Sprintf("port %s changed in the annotation", ext.ContainerPort))
+        }
+    }
+    for i := range recorded.ExternalPort {
+        if findPort(annotation, recorded.ExternalPort[i].ContainerPort) == nil {
+            drift = append(drift, fmt.Sprintf("port %s removed from the annotation", recorded.ExternalPort[i].ContainerPort))
+        }
+    }
+    if !reflect.DeepEqual(recorded.DefaultRoute, annotation.DefaultRoute) {
+        drift = append(drift, "default route changed in the annotation")
+    }
+    return drift
+}
+
+// kernelDrift compares the recorded ports with the links of the node.
+func kernelDrift(ports []*ctlPort) []string {
+    var drift []string
+    for _, port := range ports {
+        if port.Error != "" {
+            drift = append(drift, fmt.Sprintf("port %s missing: %s", port.Name, port.Error))
+            continue
+        }
+        if !port.Pod.Up {
+            drift = append(drift, fmt.Sprintf("port %s is down", port.Name))
+        }
+        for _, addr := range port.Addrs {
+            if !contains(port.Pod.Addrs, addr) {
+                drift = append(drift, fmt.Sprintf("port %s lacks address %s", port.Name, addr))
+            }
+        }
+        if port.Bridge == "" {
+            continue
+        }
+        switch {
+            case port.HostPeer == nil:
+                drift = append(drift, fmt.Sprintf("port %s has no host peer", port.Name))
+            case port.HostPeer.Master != port.Bridge:
+                drift = append(drift, fmt.Sprintf("host peer %s of %s is on bridge %q, not %s", port.HostPeer.Name, port.Name, port.HostPeer.Master, port.Bridge))
+            case !port.HostPeer.Up:
+                drift = append(drift, fmt.Sprintf("host peer %s of %s is down", port.HostPeer.Name, port.Name))
+        }
+    }
+    return drift
+}
+
+type ctl struct {
+    conf *CNINetConf
+    output string
+    cli *client.Client
+    // of the node daemon, which does port changes when it runs
+    socket string
+}
+
+// annotation reads the current network_info of a pod.
+func (c *ctl) annotation(podKey string) (*netinfo.NetworkInfo, error) {
+    if c.cli == nil {
+        cli, err := c.conf.kubeClient()
+        if err != nil {
+            return nil, err
+        }
+        c.cli = cli
+    }
+    parts := strings.SplitN(podKey, "/", 2)
+    if len(parts) != 2 {
+        return nil, fmt.Errorf("bad pod %q, want <namespace>/<name>", podKey)
+    }
+    pod, err := c.cli.GetPod(parts[0], parts[1])
+    if err != nil {
+        return nil, err
+    }
+    return netinfo.FromPod(pod)
+}
+
+// inspect describes st, against the annotation unless recordedOnly.
+func (c *ctl) inspect(st *state.State, recordedOnly bool) *ctlPod {
+    p := &ctlPod{
+        Pod: st.Pod,
+        ContainerID: st.ContainerID,
+        Netns: st.Netns,
+        NetInfo: st.NetInfo,
+        Drift: []string{},
+    }
+    if st.NetInfo == nil {
+        p.Drift = append(p.Drift, "no network_info recorded")
+        return p
+    }
+    p.Ports = expectedPorts(st.NetInfo)
+    inspectPorts(st, p.Ports)
+    if recordedOnly {
+        return p
+    }
+    annotation, err := c.annotation(st.Pod)
+    if err != nil {
+        p.Drift = append(p.Drift, fmt.Sprintf("annotation: %v", err))
+    } else {
+        p.Annotation = annotation
+        p.Drift = append(p.Drift, portDrift(st.NetInfo, withHotPlugged(st, annotation))...)
+    }
+    p.Drift = append(p.Drift, kernelDrift(p.Ports)...)
+    return p
+}
+
+func (c *ctl) print(v interface{}, table func(w *tabwriter.Writer)) error {
+    if c.output == "json" {
+        raw, err := json.MarshalIndent(v, "", "    ")
+        if err != nil {
+            return err
+        }
+        fmt.Println(string(raw))
+        return nil
+    }
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    table(w)
+    return w.Flush()
+}
+
+func peerName(port *ctlPort) string {
+    if port.HostPeer == nil {
+        return "-"
+    }
+    return port.HostPeer.Name
+}
+
+func portState(port *ctlPort) string {
+    switch {
+        case port.Error != "":
+            return "missing"
+        case !port.Pod.Up:
+            return "down"
+    }
+    return "up"
+}
+
+func dash(s string) string {
+    if s == "" {
+        return "-"
+    }
+    return s
+}
+
+func (c *ctl) list() error {
+    states, err := state.List()
+    if err != nil {
+        return err
+    }
+    pods := []*ctlPod{}
+    for _, st := range states {
+        pods = append(pods, c.inspect(st, true))
+    }
+    return c.print(pods, func(w *tabwriter.Writer) {
+        fmt.Fprintln(w, "POD\tCONTAINER\tPORT\tKIND\tHOST PEER\tBRIDGE\tSTATE")
+        for _, p := range pods {
+            cid := p.ContainerID
+            if len(cid) > 12 {
+                cid = cid[:12]
+            }
+            if len(p.Ports) == 0 {
+                fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t-\n", dash(p.Pod), cid)
+            }
+            for _, port := range p.Ports {
+                fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", dash(p.Pod), cid, port.Name, port.Kind, peerName(port), dash(port.Bridge), portState(port))
+            }
+        }
+    })
+}
+
+func (c *ctl) showBridge(name string) error {
+    br, err := link.InspectBridge(name)
+    if err != nil {
+        return err
+    }
+    return c.print(br, func(w *tabwriter.Writer) {
+        fmt.Fprintf(w, "bridge %s, index %d, %s, up %v\n\n", br.Name, br.Index, br.Mac, br.Up)
+        fmt.Fprintln(w, "MEMBER\tTYPE\tMAC\tUP\tALIAS")
+        for _, m := range br.Members {
+            fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n", m.Name, m.Type, m.Mac, m.Up, dash(m.Alias))
+        }
+        fmt.Fprintln(w, "\nFDB PORT\tMAC\tSTATIC")
+        for _, f := range br.Fdb {
+            fmt.Fprintf(w, "%s\t%s\t%v\n", f.Port, f.Mac, f.Static)
+        }
+        fmt.Fprintln(w, "\nVLAN PORT\tVID\tPVID\tUNTAGGED")
+        for _, v := range br.Vlans {
+            fmt.Fprintf(w, "%s\t%d\t%v\t%v\n", v.Port, v.Vid, v.Pvid, v.Untagged)
+        }
+    })
+}
+
+func printDrift(w *tabwriter.Writer, drift []string) {
+    if len(drift) == 0 {
+        fmt.Fprintln(w, "no drift")
+    }
+    for _, d := range drift {
+        fmt.Fprintf(w, "drift: %s\n", d)
+    }
+}
+
+func (c *ctl) showPod(podKey string) error {
+    states, err := state.List()
+    if err != nil {
+        return err
+    }
+    pods := []*ctlPod{}
+    for _, st := range states {
+        // a device of a lab has no pod to compare with
+        if st.Pod == podKey && st.Lab == "" {
+            pods = append(pods, c.inspect(st, false))
+        }
+    }
+    if len(pods) == 0 {
+        return fmt.Errorf("no sandbox of %s on this node", podKey)
+    }
+    err = c.print(pods, func(w *tabwriter.Writer) {
+        for _, p := range pods {
+            fmt.Fprintf(w, "pod %s, container %s, netns %s\n\n", p.Pod, p.ContainerID, p.Netns)
+            fmt.Fprintln(w, "PORT\tKIND\tMAC\tADDRESSES\tHOST PEER\tBRIDGE\tSTATE")
+            for _, port := range p.Ports {
+                mac, addrs := "-", "-"
+                if port.Pod != nil {
+                    mac = dash(port.Pod.Mac)
+                    addrs = dash(strings.Join(port.Pod.Addrs, ","))
+                }
+                bridge := "-"
+                if port.HostPeer != nil {
+                    bridge = dash(port.HostPeer.Master)
+                }
+                fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", port.Name, port.Kind, mac, addrs, peerName(port), bridge, portState(port))
+            }
+            fmt.Fprintln(w)
+            printDrift(w, p.Drift)
+            fmt.Fprintln(w)
+        }
+    })
+    if err == nil && hasDrift(pods) {
+        return errDrift
+    }
+    return err
+}
+
+func hasDrift(pods []*ctlPod) bool {
+    for _, p := range pods {
+        if len(p.Drift) != 0 {
+            return true
+        }
+    }
+    return false
+}
+
+func (c *ctl) diff() error {
+    states, err := state.List()
+    if err != nil {
+        return err
+    }
+    pods := []*ctlPod{}
+    for _, st := range states {
+        if st.Lab == "" {
+            pods = append(pods, c.inspect(st, false))
+        }
+    }
+    err = c.print(pods, func(w *tabwriter.Writer) {
+        fmt.Fprintln(w, "POD\tCONTAINER\tDRIFT")
+        for _, p := range pods {
+            cid := p.ContainerID
+            if len(cid) > 12 {
+                cid = cid[:12]
+            }
+            for _, d := range p.Drift {
+                fmt.Fprintf(w, "%s\t%s\t%s\n", dash(p.Pod), cid, d)
+            }
+        }
+    })
+    if err == nil && hasDrift(pods) {
+        return errDrift
+    }
+    return err
+}
+
+// loadNetConf reads the unicni netconf of a file, or its entry of a
+// conflist.
+func loadNetConf(path string) (*CNINetConf, error) {
+    conf := &CNINetConf{}
+    if path == "" {
+        return conf, nil
+    }
+    raw, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var list struct {
+        Name string                     `json:"name"`
+        CNIVersion string               `json:"cniVersion"`
+        Plugins []json.RawMessage       `json:"plugins"`
+    }
+    if err = json.Unmarshal(raw, &list); err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+    }
+    if list.Plugins == nil {
+        return conf, json.Unmarshal(raw, conf)
+    }
+    for _, plugin := range list.Plugins {
+        if err = json.Unmarshal(plugin, conf); err == nil && conf.Type == "unicni" {
+            conf.Name, conf.CNIVersion = list.Name, list.CNIVersion
+            return conf, nil
+        }
+        conf = &CNINetConf{}
+    }
+    return nil, fmt.Errorf("no unicni plugin in %s", path)
+}
+
+func (c *ctl) plan(argv []string) error {
+    fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+    file := fs.String("f", "", "network_info file, rather than the annotation of a pod")
+    confPath := fs.String("conf", "", "unicni netconf or conflist")
+    netns := fs.String("netns", "NETNS", "netns of the pod")
+    if err := fs.Parse(argv); err != nil {
+        return err
+    }
+
+    var netInfo *netinfo.NetworkInfo
+    var err error
+    switch {
+        case *file != "" && fs.NArg() == 0:
+            var raw []byte
+            if raw, err = ioutil.ReadFile(*file); err == nil {
+                netInfo, err = netinfo.Parse(string(raw))
+            }
+        case *file == "" && fs.NArg() == 1:
+            netInfo, err = c.annotation(fs.Arg(0))
+        default:
+            return fmt.Errorf("plan takes either -f or a pod")
+    }
+    if err != nil {
+        return err
+    }
+
+    conf, err := loadNetConf(*confPath)
+    if err != nil {
+        return err
+    }
+    span, err := newSpanConfig(conf)
+    if err != nil {
+        return err
+    }
+    opts := &addOptions{
+        span: span,
+        ipam: conf.ChannelIPAM,
+        delegate: newDelegate(conf, &skel.CmdArgs{Netns: *netns}),
+    }
+    np := planNetwork(netInfo, opts, state.New("", *netns), *netns, &current.Result{})
+    err = c.print(np, func(w *tabwriter.Writer) {
+        fmt.Fprintln(w, "STEP\tPORT\tACTION")
+        np.print(w)
+    })
+    if err != nil {
+        return err
+    }
+    for _, p := range append(np.Channels, np.Ports...) {
+        if p.Err != nil {
+            return errPlan
+        }
+    }
+    return nil
+}
+
+func (c *ctl) gc(argv []string) error {
+    fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+    opts := &gcOptions{alive: netnsAlive}
+    fs.BoolVar(&opts.dryRun, "dry-run", false, "only list what would be removed")
+    fs.DurationVar(&opts.window, "window", defaultGCWindow, "age under which nothing is removed")
+    if err := fs.Parse(argv); err != nil {
+        return err
+    }
+    opts.settle = opts.window
+    items, err := collectGarbage(opts)
+    perr := c.print(items, func(w *tabwriter.Writer) {
+        if opts.dryRun {
+            fmt.Fprintln(w, "WOULD REMOVE\tNAME\tPOD\tREASON")
+        } else {
+            fmt.Fprintln(w, "REMOVED\tNAME\tPOD\tREASON")
+        }
+        for _, item := range items {
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", item.Kind, item.Name, dash(item.Pod), item.Reason)
+        }
+    })
+    if err != nil {
+        return err
+    }
+    return perr
+}
+
+// runCtl is unictl, the unicni binary run under that name or as
+// "unicni ctl".
+func runCtl(argv []string) error {
+    fs := flag.NewFlagSet("unictl", flag.ContinueOnError)
+    fs.Usage = func() {
+        fmt.Fprint(os.Stderr, ctlUsage)
+        fs.PrintDefaults()
+    }
+    c := &ctl{}
+    fs.StringVar(&c.output, "o", "table", "output format, table or json")
+    fs.StringVar(&c.socket, "socket", defaultSocket, "unix socket of the node daemon")
+    kubeConf := kubeFlags(fs)
+    if err := fs.Parse(argv); err != nil {
+        return err
+    }
+    c.conf = kubeConf()
+    if c.output != "table" && c.output != "json" {
+        return fmt.Errorf("unknown output format %q", c.output)
+    }
+
+    args := fs.Args()
+    switch {
+        case len(args) == 1 && args[0] == "list":
+            return c.list()
+        case len(args) == 1 && args[0] == "diff":
+            return c.diff()
+        case len(args) >= 1 && args[0] == "plan":
+            return c.plan(args[1:])
+        case len(args) >= 1 && args[0] == "gc":
+            return c.gc(args[1:])
+        case len(args) >= 1 && args[0] == "port":
+            return c.port(args[1:])
+        case len(args) >= 1 && args[0] == "link":
+            return c.linkCmd(args[1:])
+        case len(args) >= 1 && args[0] == "ipsec":
+            return c.ipsecCmd(args[1:])
+        case len(args) >= 1 && args[0] == "metrics":
+            return c.metrics(args[1:])
+        case len(args) >= 1 && args[0] == "topology":
+            return c.topology(args[1:])
+        case len(args) == 3 && args[0] == "show" && args[1] == "bridge":
+            return c.showBridge(args[2])
+        case len(args) == 3 && args[0] == "show" && args[1] == "pod":
+            return c.showPod(args[2])
+    }
+    fs.Usage()
+    return flag.ErrHelp
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "sort"
+    "testing"
+
+    "github.com/union-cni/pkg/netinfo"
+    "github.com/union-cni/pkg/state"
+)
+
+// router is what unictl found recorded for a device.
+func router() *netinfo.NetworkInfo {
+    return &netinfo.NetworkInfo{
+        Crediential: "cred",
+        Group: "g1",
+        DeviceID: "r1",
+        SystemChan: map[string]string{"mgmt": "eth1", "data": "eth3"},
+        ChannelConfig: map[string]*netinfo.ChannelInfo{"mgmt": {Subnet: "10.0.0.0/24"}},
+        ExternalPort: []netinfo.ExternalInfo{
+            {HostPort: "eno1", ContainerPort: "eth2", Type: "macvlan"},
+            {HostPort: "eno2", ContainerPort: "eth5", Type: "macvlan"},
+        },
+    }
+}
+
+// driftAfter is the drift of the router once edit changed its annotation.
+func driftAfter(edit func(annotation *netinfo.NetworkInfo)) []string {
+    annotation := router()
+    edit(annotation)
+    drift := portDrift(router(), annotation)
+    // channels come in map order
+    sort.Strings(drift)
+    return drift
+}
+
+func expectDrift(t *testing.T, got []string, want ...string) {
+    sort.Strings(want)
+    if len(got) != len(want) {
+        t.Fatalf("got %q, want %q", got, want)
+    }
+    for i := range want {
+        if got[i] != want[i] {
+            t.Fatalf("got %q, want %q", got, want)
+        }
+    }
+}
+
+func TestPortDriftUnchanged(t *testing.T) {
+    expectDrift(t, driftAfter(func(*netinfo.NetworkInfo) {}))
+}
+
+func TestPortDriftIdentity(t *testing.T) {
+    // the pod has to be recreated, the ports are not looked at
+    expectDrift(t, driftAfter(func(a *netinfo.NetworkInfo) { a.DeviceID = "r2" }),
+                "credential, group or deviceid changed in the annotation")
+}
+
+func TestPortDriftChannels(t *testing.T) {
+    expectDrift(t, driftAfter(func(a *netinfo.NetworkInfo) {
+        a.SystemChan["ctrl"] = "eth4"
+        a.SystemChan["data"] = "eth9"
+        a.ChannelConfig["mgmt"] = &netinfo.ChannelInfo{Subnet: "10.1.0.0/24"}
+    }), "channel ctrl not set up", "channel data changed in the annotation", "channel mgmt changed in the annotation")
+
+    expectDrift(t, driftAfter(func(a *netinfo.NetworkInfo) { delete(a.SystemChan, "data") }),
+                "channel data removed from the annotation")
+}
+
+func TestPortDriftExternalPorts(t *testing.T) {
+    expectDrift(t, driftAfter(func(a *netinfo.NetworkInfo) {
+        a.ExternalPort[0].Mode = "passthru"
+        a.ExternalPort[1] = netinfo.ExternalInfo{HostPort: "eno3", ContainerPort: "eth6", Type: "macvlan"}
+    }), "port eth2 changed in the annotation", "port eth6 not set up", "port eth5 removed from the annotation")
+}
+
+func TestPortDriftDefaultRoute(t *testing.T) {
+    expectDrift(t, driftAfter(func(a *netinfo.NetworkInfo) {
+        a.DefaultRoute = &netinfo.DefaultRouteInfo{Port: "eth2", Gateways: []string{"192.168.1.1"}}
+    }), "default route changed in the annotation")
+}
+
+func TestPortDriftHotPlugged(t *testing.T) {
+    // eth5 was plugged by unictl, the annotation never listed it
+    st := &state.State{NetInfo: router(), HotPlugged: []string{"eth5"}}
+    annotation := router()
+    annotation.ExternalPort = annotation.ExternalPort[:1]
+    expectDrift(t, portDrift(st.NetInfo, withHotPlugged(st, annotation)))
+    if len(annotation.ExternalPort) != 1 {
+        t.Fatal("the annotation was changed")
+    }
+
+    // listed as it was plugged, it is the annotation's port now
+    expectDrift(t, portDrift(st.NetInfo, withHotPlugged(st, router())))
+    // listed otherwise, it drifts like the others
+    annotation = router()
+    annotation.ExternalPort[1].Mode = "passthru"
+    expectDrift(t, portDrift(st.NetInfo, withHotPlugged(st, annotation)), "port eth5 changed in the annotation")
+
+    st.HotPlugged = nil
+    annotation.ExternalPort = annotation.ExternalPort[:1]
+    expectDrift(t, portDrift(st.NetInfo, withHotPlugged(st, annotation)), "port eth5 removed from the annotation")
+}
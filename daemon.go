@@ -0,0 +1,411 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "net"
+    "sync"
+    "time"
+    "bytes"
+    "flag"
+    "context"
+    "net/url"
+    "net/http"
+    "path/filepath"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/netinfo"
+    "github.com/union-cni/pkg/podcache"
+    "github.com/union-cni/pkg/state"
+
+    "github.com/containernetworking/cni/pkg/skel"
+    "github.com/containernetworking/cni/pkg/types"
+    "k8s.io/api/core/v1"
+)
+
+const (
+    defaultSocket = "/run/unicni/unicni.sock"
+    // generic plugin error code, as skel uses
+    errCodeGeneric = 100
+    forwardTimeout = 3 * time.Minute
+    rekeyCheck = time.Minute
+)
+
+var errDaemonDown = fmt.Errorf("unicni daemon is not running")
+
+// DaemonConf hands the CNI requests to the unicni daemon of the node
+// through Socket. unicni works alone when the daemon isn't there.
+type DaemonConf struct {
+    Socket string       `json:"socket"`
+}
+
+// podCache is only set in the daemon, ADD and DEL read the pods from it
+// rather than from the API server.
+var podCache *podcache.Cache
+
+type cniRequest struct {
+    Command string      `json:"command"`
+    ContainerID string  `json:"container_id"`
+    Netns string        `json:"netns"`
+    IfName string       `json:"ifname"`
+    Args string         `json:"args"`
+    Path string         `json:"path"`
+    StdinData []byte    `json:"stdin"`
+}
+
+type cniResponse struct {
+    Result json.RawMessage  `json:"result,omitempty"`
+    Error *types.Error      `json:"error,omitempty"`
+}
+
+func daemonSocket(stdinData []byte) string {
+    var conf struct {
+        Daemon *DaemonConf  `json:"daemon"`
+    }
+    if err := json.Unmarshal(stdinData, &conf); err != nil || conf.Daemon == nil {
+        return ""
+    }
+    if conf.Daemon.Socket == "" {
+        return defaultSocket
+    }
+    return conf.Daemon.Socket
+}
+
+func unixClient(socket string, timeout time.Duration) *http.Client {
+    return &http.Client{
+        Timeout: timeout,
+        Transport: &http.Transport{
+            DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+                var d net.Dialer
+                return d.DialContext(ctx, "unix", socket)
+            },
+        },
+    }
+}
+
+func dialFailed(err error) bool {
+    if uerr, ok := err.(*url.Error); ok {
+        err = uerr.Err
+    }
+    operr, ok := err.(*net.OpError)
+    return ok && operr.Op == "dial"
+}
+
+// forward runs the command in the daemon, errDaemonDown tells the
+// caller to do it itself.
+func forward(socket string, command string, args *skel.CmdArgs) ([]byte, error) {
+    req, err := json.Marshal(&cniRequest{
+        Command: command,
+        ContainerID: args.ContainerID,
+        Netns: args.Netns,
+        IfName: args.IfName,
+        Args: args.Args,
+        Path: args.Path,
+        StdinData: args.StdinData,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    if _, err = os.Stat(socket); err != nil {
+        return nil, errDaemonDown
+    }
+    resp, err := unixClient(socket, forwardTimeout).Post("http://unicni/cni", "application/json", bytes.NewReader(req))
+    if err != nil {
+        if dialFailed(err) {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] daemon at %s: %v\r\n", socket, err)
+            return nil, errDaemonDown
+        }
+        // the daemon may be running it still, never do it twice
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    cniResp := &cniResponse{}
+    if err = json.NewDecoder(resp.Body).Decode(cniResp); err != nil {
+        return nil, fmt.Errorf("bad answer from the daemon: %v", err)
+    }
+    if cniResp.Error != nil {
+        return nil, cniResp.Error
+    }
+    return cniResp.Result, nil
+}
+
+// lookupNetInfo reads the annotation from the pod cache in the daemon,
+// from the API server otherwise or when the cache doesn't know the pod.
+func lookupNetInfo(conf *CNINetConf, k8sArgs *K8SArgs) (*netinfo.NetworkInfo, error) {
+    if podCache != nil {
+        if pod := podCache.Get(string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME)); pod != nil {
+            return netinfo.FromPod(pod)
+        }
+    }
+    cli, err := conf.kubeClient()
+    if err != nil {
+        return nil, err
+    }
+    pod, err := cli.GetPod(string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to get pod: %v\r\n", err)
+        return nil, err
+    }
+    return netinfo.FromPod(pod)
+}
+
+type daemon struct {
+    // one request at a time, like the plugin runs did with the pool locks
+    mu sync.Mutex
+    // the last netconf with an overlay, whose peers and keys are kept up
+    // to date without waiting for ADD
+    spanConf *CNINetConf
+    // links held down or flapping through /link
+    links *linkHolds
+    // fault scenarios through /faults
+    faults *faults
+}
+
+func (d *daemon) run(req *cniRequest) ([]byte, error) {
+    if req.Command == "GC" {
+        // takes the lock itself, only to remove the leaked links
+        return nil, doGC(req.StdinData, &d.mu)
+    }
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    args := &skel.CmdArgs{
+        ContainerID: req.ContainerID,
+        Netns: req.Netns,
+        IfName: req.IfName,
+        Args: req.Args,
+        Path: req.Path,
+        StdinData: req.StdinData,
+    }
+    switch req.Command {
+        case "ADD":
+            conf := &CNINetConf{}
+            if json.Unmarshal(req.StdinData, conf) == nil && conf.Overlay != nil {
+                d.spanConf = conf
+            }
+            return doAdd(args)
+        case "DEL":
+            return nil, doDel(args)
+    }
+    return nil, fmt.Errorf("unknown command %q", req.Command)
+}
+
+func (d *daemon) serveCNI(w http.ResponseWriter, r *http.Request) {
+    req := &cniRequest{}
+    resp := &cniResponse{}
+    err := json.NewDecoder(r.Body).Decode(req)
+    if err == nil {
+        resp.Result, err = d.run(req)
+    }
+    if err != nil {
+        if e, ok := err.(*types.Error); ok {
+            resp.Error = e
+        } else {
+            resp.Error = &types.Error{Code: errCodeGeneric, Msg: err.Error()}
+        }
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(resp)
+}
+
+func (d *daemon) onUpdate(old *v1.Pod, pod *v1.Pod) {
+    if netinfo.Changed(old, pod) {
+        go d.reconcilePod(pod.Namespace, pod.Name)
+    }
+}
+
+// reconcilePod brings the running sandboxes of the pod to its current
+// annotation.
+func (d *daemon) reconcilePod(namespace string, name string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    // the latest version, updates may have piled up meanwhile
+    pod := podCache.Get(namespace, name)
+    if pod == nil {
+        return
+    }
+    states, err := state.List()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to list states: %v\r\n", err)
+        return
+    }
+    for _, st := range states {
+        if st.Pod != namespace + "/" + name || st.NetInfo == nil || st.Lab != "" {
+            continue
+        }
+        conf := &CNINetConf{}
+        if err = json.Unmarshal(st.NetConf, conf); err != nil {
+            continue
+        }
+        rec := newEventRecorder(conf, &K8SArgs{
+            K8S_POD_NAMESPACE: types.UnmarshallableString(namespace),
+            K8S_POD_NAME: types.UnmarshallableString(name),
+        })
+        netInfo, err := netinfo.FromPod(pod)
+        if err != nil {
+            rec.warn("annotation network_info", failure(reasonInvalidNetworkInfo, err))
+            continue
+        }
+        created, err := reconcile(st, netInfo, rec)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to reconcile %s/%s: %v\r\n", namespace, name, err)
+        }
+        // a port created again comes without the faults set on it
+        d.faults.reapply(st.Pod, created)
+    }
+}
+
+// refreshSpan rolls the IPsec keys over on time, even when no pod comes,
+// and gives the bridges spanned already the peers of the nodes that
+// joined. The netconf is the one of the pods already there until an ADD
+// brings one.
+func (d *daemon) refreshSpan(stop <-chan struct{}) {
+    d.mu.Lock()
+    if d.spanConf == nil {
+        d.spanConf = stateConf(func(conf *CNINetConf) bool { return conf.Overlay != nil })
+    }
+    d.mu.Unlock()
+    ticker := time.NewTicker(rekeyCheck)
+    defer ticker.Stop()
+    for {
+        select {
+            case <-stop:
+                return
+            case <-ticker.C:
+        }
+        d.mu.Lock()
+        if conf := d.spanConf; conf != nil {
+            if err := refreshOverlay(conf); err != nil {
+                fmt.Fprintf(os.Stderr, "[UNION CNI] failed to refresh the overlay: %v\r\n", err)
+            }
+        }
+        d.mu.Unlock()
+    }
+}
+
+// gc collects the garbage of the node every interval.
+func (d *daemon) gc(stop <-chan struct{}, interval time.Duration, window time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+            case <-stop:
+                return
+            case <-ticker.C:
+        }
+        items, err := collectGarbage(&gcOptions{alive: netnsAlive, window: window, settle: window, lock: &d.mu})
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] gc: %v\r\n", err)
+        }
+        logGarbage(items)
+    }
+}
+
+func nodeName() string {
+    if name := os.Getenv("NODE_NAME"); name != "" {
+        return name
+    }
+    name, _ := os.Hostname()
+    return name
+}
+
+// kubeFlags adds the API server flags to fs, the returned function gives
+// the netconf they make once fs is parsed.
+func kubeFlags(fs *flag.FlagSet) func() *CNINetConf {
+    conf := &CNINetConf{KubeAuth: &KubeAuthConf{}}
+    fs.StringVar(&conf.KubeMaster, "kubemaster", defaultHost, "insecure API server address, when -server is not set")
+    fs.StringVar(&conf.KubeAuth.Server, "server", "", "API server URL")
+    fs.StringVar(&conf.KubeAuth.TokenFile, "token-file", "", "bearer token of unicni")
+    fs.StringVar(&conf.KubeAuth.CAFile, "ca-file", "", "CA of the API server")
+    fs.StringVar(&conf.KubeAuth.CertFile, "cert-file", "", "client certificate")
+    fs.StringVar(&conf.KubeAuth.KeyFile, "key-file", "", "client key")
+    return func() *CNINetConf {
+        if conf.KubeAuth.Server == "" {
+            conf.KubeAuth = nil
+        }
+        return conf
+    }
+}
+
+// runDaemon serves the CNI requests of the node on a unix socket, with
+// the pods of the node cached from a watch.
+func runDaemon(argv []string) error {
+    fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+    socket := fs.String("socket", defaultSocket, "unix socket to serve")
+    node := fs.String("node", nodeName(), "name of this node")
+    gcInterval := fs.Duration("gc-interval", defaultGCInterval, "how often to collect leaked links and states, 0 turns it off")
+    gcWindow := fs.Duration("gc-window", defaultGCWindow, "age under which nothing is collected")
+    faultDir := fs.String("fault-dir", defaultFaultDir, "where the fault scenarios are kept")
+    apiListen := fs.String("api-listen", defaultAPIListen, "loopback address of the link and fault API, empty turns it off")
+    metricsListen := fs.String("metrics-listen", "", "address to serve /metrics on besides the API, for Prometheus")
+    kubeConf := kubeFlags(fs)
+    if err := fs.Parse(argv); err != nil {
+        return err
+    }
+    conf := kubeConf()
+
+    cli, err := conf.kubeClient()
+    if err != nil {
+        return err
+    }
+    stop := make(chan struct{})
+    defer close(stop)
+    d := &daemon{
+        links: &linkHolds{holds: make(map[int]*linkHold)},
+        faults: newFaults(*faultDir),
+    }
+    d.faults.restore()
+    podCache = podcache.New(cli, *node)
+    podCache.OnUpdate(d.onUpdate)
+    go podCache.Run(stop)
+
+    go d.refreshSpan(stop)
+    if *gcInterval > 0 {
+        go d.gc(stop, *gcInterval, *gcWindow)
+    }
+
+    if err = os.MkdirAll(filepath.Dir(*socket), 0700); err != nil {
+        return err
+    }
+    os.Remove(*socket)
+    l, err := net.Listen("unix", *socket)
+    if err != nil {
+        return err
+    }
+    defer os.Remove(*socket)
+
+    // the CNI requests only come through the socket
+    api := http.NewServeMux()
+    api.HandleFunc("/link", d.links.serveLink)
+    api.HandleFunc("/faults", d.faults.serveFaults)
+    api.HandleFunc("/metrics", serveMetrics)
+    mux := http.NewServeMux()
+    mux.HandleFunc("/cni", d.serveCNI)
+    mux.HandleFunc("/ports", d.servePorts)
+    mux.Handle("/", api)
+    if *apiListen != "" {
+        tl, err := listenLoopback(*apiListen)
+        if err != nil {
+            return err
+        }
+        go func() {
+            if err := http.Serve(tl, api); err != nil {
+                fmt.Fprintf(os.Stderr, "[UNION CNI] api at %s: %v\r\n", *apiListen, err)
+            }
+        }()
+    }
+    if *metricsListen != "" {
+        metrics := http.NewServeMux()
+        metrics.HandleFunc("/metrics", serveMetrics)
+        go func() {
+            if err := http.ListenAndServe(*metricsListen, metrics); err != nil {
+                fmt.Fprintf(os.Stderr, "[UNION CNI] metrics at %s: %v\r\n", *metricsListen, err)
+            }
+        }()
+    }
+    fmt.Fprintf(os.Stderr, "[UNION CNI] daemon of %s serving %s\r\n", *node, *socket)
+    return http.Serve(l, mux)
+}
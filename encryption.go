@@ -0,0 +1,211 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "flag"
+    "time"
+    "strings"
+    "syscall"
+    "io/ioutil"
+    "os/signal"
+    "encoding/hex"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/ipsec"
+    "github.com/union-cni/pkg/state"
+)
+
+const (
+    defaultSecretKey = "key"
+    defaultRekeyInterval = 3600
+    // the nonce of the outbound IPsec states of a node, on its Node
+    ipsecNonceAnnotation = "unicni/ipsec-nonce"
+)
+
+// EncryptionConf protects the overlay traffic between nodes with IPsec.
+// The master key comes from KeyFile or from the Secret "<namespace>/<name>",
+// raw or hex encoded, and must be the same on every node.
+type EncryptionConf struct {
+    KeyFile string          `json:"key_file"`
+    Secret string           `json:"secret"`
+    SecretKey string        `json:"secret_key"`
+    RekeyInterval int       `json:"rekey_interval"`
+}
+
+func decodeKey(raw []byte) []byte {
+    trimmed := strings.TrimSpace(string(raw))
+    if key, err := hex.DecodeString(trimmed); err == nil {
+        return key
+    }
+    return []byte(trimmed)
+}
+
+func loadKey(conf *CNINetConf) ([]byte, error) {
+    enc := conf.Encryption
+    if enc.KeyFile != "" {
+        raw, err := ioutil.ReadFile(enc.KeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read ipsec key: %v", err)
+        }
+        return decodeKey(raw), nil
+    }
+
+    parts := strings.SplitN(enc.Secret, "/", 2)
+    if len(parts) != 2 {
+        return nil, fmt.Errorf("encryption needs key_file or secret <namespace>/<name>")
+    }
+    cli, err := conf.kubeClient()
+    if err != nil {
+        return nil, err
+    }
+    secret, err := cli.GetSecret(parts[0], parts[1])
+    if err != nil {
+        return nil, err
+    }
+
+    secretKey := enc.SecretKey
+    if secretKey == "" {
+        secretKey = defaultSecretKey
+    }
+    raw, ok := secret.Data[secretKey]
+    if !ok {
+        return nil, fmt.Errorf("secret %s has no %q", enc.Secret, secretKey)
+    }
+    return decodeKey(raw), nil
+}
+
+// applyEncryption installs the IPsec of the current epoch towards every
+// overlay peer. It runs when a bridge is spanned for the first time and on
+// a timer in the node daemon or unictl ipsec rekey, which is what rolls
+// the keys over.
+func applyEncryption(conf *CNINetConf, span *spanConfig) error {
+    if conf.Encryption == nil {
+        return nil
+    }
+    if span == nil || span.overlay == nil {
+        return fmt.Errorf("encryption needs the overlay")
+    }
+    if span.overlay.Local == nil {
+        return fmt.Errorf("encryption needs the overlay local address")
+    }
+
+    key, err := loadKey(conf)
+    if err != nil {
+        return err
+    }
+    span.loadPeers()
+
+    interval := conf.Encryption.RekeyInterval
+    if interval <= 0 {
+        interval = defaultRekeyInterval
+    }
+
+    unlock, err := ipsec.Lock()
+    if err != nil {
+        return err
+    }
+    defer unlock()
+    nonce, fresh, err := ipsec.Nonce(span.overlay.Local)
+    if err != nil {
+        return err
+    }
+    if fresh {
+        // the peers derive the keys of this node from it
+        cli, err := conf.kubeClient()
+        if err == nil {
+            err = cli.SetNodeAnnotation(nodeName(), ipsecNonceAnnotation, hex.EncodeToString(nonce))
+        }
+        if err != nil {
+            return fmt.Errorf("failed to publish ipsec nonce: %v", err)
+        }
+        fmt.Fprintf(os.Stderr, "[UNION CNI] new ipsec nonce published on node %s\r\n", nodeName())
+    }
+
+    return ipsec.Apply(&ipsec.Config{
+        Local: span.overlay.Local,
+        Peers: span.overlay.Peers,
+        Port: span.overlay.DstPort,
+        Key: key,
+        RekeyInterval: time.Duration(interval) * time.Second,
+        Nonce: nonce,
+        PeerNonces: span.peerNonces,
+    })
+}
+
+// stateConf finds a netconf matching among the states of the node, for
+// the work that must go on without ADD.
+func stateConf(match func(conf *CNINetConf) bool) *CNINetConf {
+    states, err := state.List()
+    if err != nil {
+        return nil
+    }
+    for _, st := range states {
+        conf := &CNINetConf{}
+        if len(st.NetConf) != 0 && json.Unmarshal(st.NetConf, conf) == nil && match(conf) {
+            return conf
+        }
+    }
+    return nil
+}
+
+// rekeyConf finds a netconf with encryption among the states of the node,
+// for a rekey that did not see any ADD.
+func rekeyConf() *CNINetConf {
+    return stateConf(func(conf *CNINetConf) bool { return conf.Encryption != nil })
+}
+
+// rekey runs applyEncryption for conf every interval, or once when it is
+// 0.
+func rekey(conf *CNINetConf, interval time.Duration, stop <-chan struct{}) error {
+    for {
+        span, err := newSpanConfig(conf)
+        if err == nil {
+            err = applyEncryption(conf, span)
+        }
+        if interval == 0 {
+            return err
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to rekey: %v\r\n", err)
+        }
+        if !sleepOrStop(interval, stop) {
+            return nil
+        }
+    }
+}
+
+// ipsecCmd rolls the keys over from the command line, once or every
+// -every, so that they do without ADD or the node daemon.
+func (c *ctl) ipsecCmd(argv []string) error {
+    if len(argv) == 0 || argv[0] != "rekey" {
+        return fmt.Errorf("ipsec takes rekey")
+    }
+    fs := flag.NewFlagSet("ipsec rekey", flag.ContinueOnError)
+    confPath := fs.String("conf", "", "unicni netconf or conflist, the one of the pods of the node when empty")
+    every := fs.Duration("every", 0, "rekey on this period until interrupted, 0 for once")
+    if err := fs.Parse(argv[1:]); err != nil {
+        return err
+    }
+    conf := rekeyConf()
+    if *confPath != "" {
+        var err error
+        if conf, err = loadNetConf(*confPath); err != nil {
+            return err
+        }
+    }
+    if conf == nil || conf.Encryption == nil {
+        return fmt.Errorf("no netconf with encryption, give one with -conf")
+    }
+
+    stop := make(chan struct{})
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+    defer signal.Stop(sig)
+    go func() {
+        if _, ok := <-sig; ok {
+            close(stop)
+        }
+    }()
+    return rekey(conf, *every, stop)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "time"
+    "strconv"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+
+    "k8s.io/api/core/v1"
+)
+
+const (
+    defaultEventDir = "/var/lib/unicni/events"
+    defaultEventInterval = 60
+
+    reasonBridgeCreateFailed = "BridgeCreateFailed"
+    reasonInvalidNetworkInfo = "InvalidNetworkInfo"
+    reasonMacvlanParentMissing = "MacvlanParentMissing"
+    reasonNetworkSetupFailed = "NetworkSetupFailed"
+)
+
+// EventConf turns on the Events posted on the pod when its network
+// can't be set up. One reason is posted at most once per Interval
+// seconds for a pod, the others are counted.
+type EventConf struct {
+    Interval int     `json:"interval"`
+}
+
+// setupError is a failure that has its own event reason.
+type setupError struct {
+    reason string
+    err error
+}
+
+func (e *setupError) Error() string {
+    return e.err.Error()
+}
+
+func failure(reason string, err error) error {
+    if err == nil {
+        return nil
+    }
+    return &setupError{reason: reason, err: err}
+}
+
+type eventRecorder struct {
+    conf *CNINetConf
+    namespace string
+    pod string
+}
+
+// newEventRecorder returns nil when events are off, which records nothing.
+func newEventRecorder(conf *CNINetConf, k8sArgs *K8SArgs) *eventRecorder {
+    if conf.Events == nil {
+        return nil
+    }
+    return &eventRecorder{
+        conf: conf,
+        namespace: string(k8sArgs.K8S_POD_NAMESPACE),
+        pod: string(k8sArgs.K8S_POD_NAME),
+    }
+}
+
+// allow tells whether the reason may be posted now, and how many were
+// held back since the last one. Each plugin run is a new process, so the
+// last post time is kept on disk.
+func (rec *eventRecorder) allow(reason string) (bool, int) {
+    interval := 0
+    if rec.conf.Events != nil {
+        interval = rec.conf.Events.Interval
+    }
+    if interval <= 0 {
+        interval = defaultEventInterval
+    }
+    if err := os.MkdirAll(defaultEventDir, 0700); err != nil {
+        return true, 0
+    }
+    path := filepath.Join(defaultEventDir, fmt.Sprintf("%s_%s_%s", rec.namespace, rec.pod, reason))
+
+    held := 0
+    if info, err := os.Stat(path); err == nil {
+        raw, _ := ioutil.ReadFile(path)
+        held, _ = strconv.Atoi(strings.TrimSpace(string(raw)))
+        if time.Since(info.ModTime()) < time.Duration(interval) * time.Second {
+            // keep the time of the last post
+            ioutil.WriteFile(path, []byte(strconv.Itoa(held + 1)), 0600)
+            os.Chtimes(path, info.ModTime(), info.ModTime())
+            return false, 0
+        }
+    }
+    ioutil.WriteFile(path, []byte("0"), 0600)
+    return true, held
+}
+
+// warn posts err about subject as a Warning event of the pod. Failing
+// to post is only logged, it must not hide the original error.
+func (rec *eventRecorder) warn(subject string, err error) {
+    if rec == nil || err == nil {
+        return
+    }
+    reason := reasonNetworkSetupFailed
+    if se, ok := err.(*setupError); ok {
+        reason = se.reason
+    }
+
+    ok, held := rec.allow(reason)
+    if !ok {
+        return
+    }
+    message := fmt.Sprintf("%s: %v", subject, err)
+    if held > 0 {
+        message = fmt.Sprintf("%s (%d more since the last event)", message, held)
+    }
+
+    cli, err := rec.conf.kubeClient()
+    if err == nil {
+        var pod *v1.Pod
+        if pod, err = cli.GetPod(rec.namespace, rec.pod); err == nil {
+            err = cli.CreatePodEvent(pod, v1.EventTypeWarning, reason, message)
+        }
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to post event %s: %v\r\n", reason, err)
+    }
+}
+
+// normal posts a Normal event, these tell what changed and are never
+// held back.
+func (rec *eventRecorder) normal(reason string, message string) {
+    if rec == nil {
+        return
+    }
+    cli, err := rec.conf.kubeClient()
+    if err == nil {
+        var pod *v1.Pod
+        if pod, err = cli.GetPod(rec.namespace, rec.pod); err == nil {
+            err = cli.CreatePodEvent(pod, v1.EventTypeNormal, reason, message)
+        }
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to post event %s: %v\r\n", reason, err)
+    }
+}
+
+// cleanEvents forgets the rate limits of the pod.
+func cleanEvents(namespace string, pod string) {
+    paths, _ := filepath.Glob(filepath.Join(defaultEventDir, fmt.Sprintf("%s_%s_*", namespace, pod)))
+    for _, path := range paths {
+        os.Remove(path)
+    }
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "net"
+    "sort"
+    "sync"
+    "time"
+    "strconv"
+    "strings"
+    "net/http"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/link"
+)
+
+const (
+    defaultFaultDir = "/var/lib/unicni/faults"
+    defaultAPIListen = "127.0.0.1:9630"
+
+    faultImpairment = "impairment"
+    faultDrop = "drop"
+    faultDown = "down"
+)
+
+// netemFault impairs a port, times are durations and the rest in %.
+type netemFault struct {
+    Delay string           `json:"delay,omitempty"`
+    Jitter string          `json:"jitter,omitempty"`
+    Loss float32           `json:"loss,omitempty"`
+    Duplicate float32      `json:"duplicate,omitempty"`
+    Corrupt float32        `json:"corrupt,omitempty"`
+    Reorder float32        `json:"reorder,omitempty"`
+}
+
+// dropFault drops the IPv4 packets it matches, all packets when empty.
+type dropFault struct {
+    Protocol string         `json:"protocol,omitempty"`
+    Src string              `json:"src,omitempty"`
+    Dst string              `json:"dst,omitempty"`
+    Sport uint16            `json:"sport,omitempty"`
+    Dport uint16            `json:"dport,omitempty"`
+}
+
+// faultLink is a link a fault was set on. It is recorded so that the
+// fault can be reverted even when the pod changed since.
+type faultLink struct {
+    Kind string             `json:"kind"`
+    Name string             `json:"name"`
+    Netns string            `json:"netns,omitempty"`
+}
+
+// fault is a scenario of faults on a port of a pod, reverted after TTL.
+type fault struct {
+    ID int                  `json:"id"`
+    Pod string              `json:"pod"`
+    Port string             `json:"port"`
+    // egress from the pod, the default, ingress to it, or both
+    Direction string        `json:"direction,omitempty"`
+    Netem *netemFault       `json:"netem,omitempty"`
+    // bandwidth cap, as 10mbit or 1mbps
+    Rate string             `json:"rate,omitempty"`
+    Drop []dropFault        `json:"drop,omitempty"`
+    // admin or carrier
+    LinkDown string         `json:"link_down,omitempty"`
+    TTL string              `json:"ttl"`
+    Expires time.Time       `json:"expires"`
+    Links []faultLink       `json:"links"`
+    timer *time.Timer
+}
+
+// parseRate reads a rate the way tc does, in bytes per second.
+func parseRate(s string) (uint64, error) {
+    s = strings.ToLower(strings.TrimSpace(s))
+    units := []struct {
+        suffix string
+        bytes float64
+    }{
+        {"gbit", 1e9 / 8}, {"mbit", 1e6 / 8}, {"kbit", 1e3 / 8}, {"bit", 1.0 / 8},
+        {"gbps", 1e9}, {"mbps", 1e6}, {"kbps", 1e3}, {"bps", 1},
+    }
+    for _, u := range units {
+        if strings.HasSuffix(s, u.suffix) {
+            v, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+            if err != nil || v * u.bytes < 1 {
+                break
+            }
+            return uint64(v * u.bytes), nil
+        }
+    }
+    return 0, fmt.Errorf("bad rate %q", s)
+}
+
+func parseProtocol(s string) (uint8, error) {
+    switch strings.ToLower(s) {
+        case "":
+            return 0, nil
+        case "icmp":
+            return 1, nil
+        case "tcp":
+            return 6, nil
+        case "udp":
+            return 17, nil
+    }
+    n, err := strconv.ParseUint(s, 10, 8)
+    if err != nil {
+        return 0, fmt.Errorf("bad protocol %q", s)
+    }
+    return uint8(n), nil
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+    if s == "" {
+        return nil, nil
+    }
+    if !strings.Contains(s, "/") {
+        s += "/32"
+    }
+    _, ipnet, err := net.ParseCIDR(s)
+    if err != nil || ipnet.IP.To4() == nil {
+        return nil, fmt.Errorf("bad IPv4 address %q", s)
+    }
+    return ipnet, nil
+}
+
+func (d *dropFault) rule() (link.DropRule, error) {
+    var r link.DropRule
+    var err error
+    if r.Protocol, err = parseProtocol(d.Protocol); err != nil {
+        return r, err
+    }
+    if r.Src, err = parseCIDR(d.Src); err != nil {
+        return r, err
+    }
+    if r.Dst, err = parseCIDR(d.Dst); err != nil {
+        return r, err
+    }
+    r.Sport, r.Dport = d.Sport, d.Dport
+    return r, nil
+}
+
+func (n *netemFault) impairment() (*link.Impairment, error) {
+    imp := &link.Impairment{Loss: n.Loss, Duplicate: n.Duplicate, Corrupt: n.Corrupt, Reorder: n.Reorder}
+    var err error
+    if n.Delay != "" {
+        if imp.Delay, err = time.ParseDuration(n.Delay); err != nil {
+            return nil, fmt.Errorf("bad delay %q", n.Delay)
+        }
+    }
+    if n.Jitter != "" {
+        if imp.Jitter, err = time.ParseDuration(n.Jitter); err != nil {
+            return nil, fmt.Errorf("bad jitter %q", n.Jitter)
+        }
+    }
+    for _, p := range []float32{n.Loss, n.Duplicate, n.Corrupt, n.Reorder} {
+        if p < 0 || p > 100 {
+            return nil, fmt.Errorf("bad percentage %v", p)
+        }
+    }
+    if imp.Reorder != 0 && imp.Delay == 0 {
+        return nil, fmt.Errorf("reorder takes a delay")
+    }
+    return imp, nil
+}
+
+// revertLinks takes the faults off links, last set first. A link gone
+// with its pod has nothing left to revert.
+func revertLinks(id int, links []faultLink) {
+    for i := len(links) - 1; i >= 0; i-- {
+        l := links[i]
+        var err error
+        switch l.Kind {
+            case faultImpairment:
+                err = link.ClearImpairment(l.Name, l.Netns)
+            case faultDrop:
+                err = link.ClearDropRules(l.Name, l.Netns)
+            case faultDown:
+                err = link.SetLinkUp(l.Name, l.Netns, true)
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] fault %d: failed to revert %s of %s: %v\r\n", id, l.Kind, l.Name, err)
+            continue
+        }
+        fmt.Fprintf(os.Stderr, "[UNION CNI] fault %d: %s of %s reverted\r\n", id, l.Kind, l.Name)
+    }
+}
+
+// apply sets the faults of f, and records the links it set them on. It
+// reverts what it did when one fails.
+func (f *fault) apply() error {
+    switch f.LinkDown {
+        case "", "admin", "carrier":
+        default:
+            return fmt.Errorf("bad link_down %q, want admin or carrier", f.LinkDown)
+    }
+    egress, ingress := true, false
+    switch f.Direction {
+        case "", "egress":
+        case "ingress":
+            egress, ingress = false, true
+        case "both":
+            ingress = true
+        default:
+            return fmt.Errorf("bad direction %q", f.Direction)
+    }
+
+    var imp *link.Impairment
+    var err error
+    if f.Netem != nil {
+        if imp, err = f.Netem.impairment(); err != nil {
+            return err
+        }
+    }
+    if f.Rate != "" {
+        if imp == nil {
+            imp = &link.Impairment{}
+        }
+        if imp.Rate, err = parseRate(f.Rate); err != nil {
+            return err
+        }
+    }
+    var rules []link.DropRule
+    for i := range f.Drop {
+        r, err := f.Drop[i].rule()
+        if err != nil {
+            return err
+        }
+        rules = append(rules, r)
+    }
+    if imp == nil && len(f.Drop) == 0 && f.LinkDown == "" {
+        return fmt.Errorf("no fault given")
+    }
+
+    // the port sends what leaves the pod, its peer what comes in
+    port := &linkTarget{Pod: f.Pod, Port: f.Port}
+    if err = port.resolve(); err != nil {
+        return err
+    }
+    var peer *linkTarget
+    if (ingress && imp != nil) || f.LinkDown == "carrier" {
+        peer = &linkTarget{Pod: f.Pod, Port: f.Port, Carrier: true}
+        if err = peer.resolve(); err != nil {
+            return err
+        }
+    }
+
+    f.Links = nil
+    set := func(kind string, t *linkTarget, do func() error) error {
+        if err := do(); err != nil {
+            revertLinks(f.ID, f.Links)
+            f.Links = nil
+            return err
+        }
+        f.Links = append(f.Links, faultLink{Kind: kind, Name: t.name, Netns: t.netns})
+        fmt.Fprintf(os.Stderr, "[UNION CNI] fault %d: %s of %s set on %s\r\n", f.ID, kind, t, t.name)
+        return nil
+    }
+    if imp != nil && egress {
+        if err = set(faultImpairment, port, func() error { return link.SetImpairment(port.name, port.netns, imp) }); err != nil {
+            return err
+        }
+    }
+    if imp != nil && ingress {
+        if err = set(faultImpairment, peer, func() error { return link.SetImpairment(peer.name, peer.netns, imp) }); err != nil {
+            return err
+        }
+    }
+    if len(rules) != 0 {
+        var out, in []link.DropRule
+        if egress {
+            out = rules
+        }
+        if ingress {
+            in = rules
+        }
+        if err = set(faultDrop, port, func() error { return link.AddDropRules(port.name, port.netns, out, in) }); err != nil {
+            return err
+        }
+    }
+    switch f.LinkDown {
+        case "":
+        case "admin":
+            err = set(faultDown, port, func() error { return port.set(false) })
+        case "carrier":
+            err = set(faultDown, peer, func() error { return peer.set(false) })
+    }
+    return err
+}
+
+// snapshot copies f for the API, reapply sets its links anew meanwhile.
+func (f *fault) snapshot() *fault {
+    c := *f
+    c.Links = append([]faultLink(nil), f.Links...)
+    c.timer = nil
+    return &c
+}
+
+// faults are the fault scenarios the daemon keeps, one file each in dir
+// so that a restart still reverts them on time.
+type faults struct {
+    mu sync.Mutex
+    dir string
+    next int
+    active map[int]*fault
+}
+
+func newFaults(dir string) *faults {
+    return &faults{dir: dir, active: make(map[int]*fault)}
+}
+
+func (fs *faults) path(id int) string {
+    return filepath.Join(fs.dir, fmt.Sprintf("%d.json", id))
+}
+
+func (fs *faults) save(f *fault) error {
+    if err := os.MkdirAll(fs.dir, 0700); err != nil {
+        return err
+    }
+    raw, err := json.Marshal(f)
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(fs.path(f.ID), raw, 0600)
+}
+
+// arm reverts f once it expires, fs.mu is held.
+func (fs *faults) arm(f *fault) {
+    fs.active[f.ID] = f
+    f.timer = time.AfterFunc(time.Until(f.Expires), func() {
+        fs.clear(f.ID)
+    })
+}
+
+// restore picks up the faults of the daemon before: the expired ones are
+// reverted, the others reverted when they expire.
+func (fs *faults) restore() {
+    paths, err := filepath.Glob(filepath.Join(fs.dir, "*.json"))
+    if err != nil {
+        return
+    }
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    for _, path := range paths {
+        f := &fault{}
+        raw, err := ioutil.ReadFile(path)
+        if err == nil {
+            err = json.Unmarshal(raw, f)
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to load fault %s: %v\r\n", path, err)
+            continue
+        }
+        if f.ID > fs.next {
+            fs.next = f.ID
+        }
+        if time.Now().After(f.Expires) {
+            revertLinks(f.ID, f.Links)
+            os.Remove(path)
+            continue
+        }
+        fs.arm(f)
+    }
+}
+
+// add sets f, it returns a snapshot of it as set.
+func (fs *faults) add(f *fault) (*fault, error) {
+    ttl, err := time.ParseDuration(f.TTL)
+    if err != nil || ttl <= 0 {
+        return nil, fmt.Errorf("bad ttl %q", f.TTL)
+    }
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    for _, old := range fs.active {
+        if old.Pod == f.Pod && old.Port == f.Port {
+            return nil, fmt.Errorf("port %s of %s has fault %d already", f.Port, f.Pod, old.ID)
+        }
+    }
+    fs.next++
+    f.ID = fs.next
+    if err = f.apply(); err != nil {
+        return nil, err
+    }
+    f.Expires = time.Now().Add(ttl)
+    if err = fs.save(f); err != nil {
+        // a fault the daemon may forget is not set
+        revertLinks(f.ID, f.Links)
+        return nil, err
+    }
+    fs.arm(f)
+    return f.snapshot(), nil
+}
+
+// reapply sets the faults of the ports of pod again, after reconcile
+// created them anew. The links of the old ones are gone with them. A
+// fault that can't be set any more is dropped.
+func (fs *faults) reapply(pod string, ports []string) {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    for id, f := range fs.active {
+        if f.Pod != pod || !contains(ports, f.Port) {
+            continue
+        }
+        err := f.apply()
+        if err == nil {
+            err = fs.save(f)
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] fault %d: failed to set again on %s of %s: %v\r\n", id, f.Port, pod, err)
+            f.timer.Stop()
+            revertLinks(f.ID, f.Links)
+            delete(fs.active, id)
+            os.Remove(fs.path(id))
+            continue
+        }
+        fmt.Fprintf(os.Stderr, "[UNION CNI] fault %d: set again on %s of %s\r\n", id, f.Port, pod)
+    }
+}
+
+// clear reverts the fault id, it returns nil when there is none.
+func (fs *faults) clear(id int) *fault {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    f := fs.active[id]
+    if f == nil {
+        return nil
+    }
+    f.timer.Stop()
+    revertLinks(f.ID, f.Links)
+    delete(fs.active, id)
+    os.Remove(fs.path(id))
+    return f
+}
+
+func (fs *faults) list() []*fault {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    list := []*fault{}
+    for _, f := range fs.active {
+        list = append(list, f.snapshot())
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+    return list
+}
+
+// serveFaults lists the faults with GET, sets one with POST, and clears
+// one with DELETE ?id=, or all of them without id.
+func (fs *faults) serveFaults(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+        case http.MethodGet:
+            writeJSON(w, http.StatusOK, fs.list())
+        case http.MethodPost:
+            f := &fault{}
+            if err := json.NewDecoder(r.Body).Decode(f); err != nil {
+                writeError(w, http.StatusBadRequest, err)
+                return
+            }
+            f, err := fs.add(f)
+            if err != nil {
+                writeError(w, http.StatusBadRequest, err)
+                return
+            }
+            writeJSON(w, http.StatusCreated, f)
+        case http.MethodDelete:
+            if r.URL.Query().Get("id") == "" {
+                cleared := []*fault{}
+                for _, f := range fs.list() {
+                    if f = fs.clear(f.ID); f != nil {
+                        cleared = append(cleared, f)
+                    }
+                }
+                writeJSON(w, http.StatusOK, cleared)
+                return
+            }
+            id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+            f := fs.clear(id)
+            if f == nil {
+                writeError(w, http.StatusNotFound, fmt.Errorf("no fault %q", r.URL.Query().Get("id")))
+                return
+            }
+            writeJSON(w, http.StatusOK, f)
+        default:
+            writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+    }
+}
+
+// listenLoopback listens on addr, which has to stay on the node.
+func listenLoopback(addr string) (net.Listener, error) {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil, err
+    }
+    if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+        return nil, fmt.Errorf("%s is not a loopback address", addr)
+    }
+    return net.Listen("tcp", addr)
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+    // as tc reads them: bit are bits a second, bps bytes a second
+    rates := map[string]uint64{
+        "8bit": 1,
+        "10kbit": 1250,
+        "1.5mbit": 187500,
+        "1gbit": 125000000,
+        "100bps": 100,
+        "2kbps": 2000,
+        "1mbps": 1000000,
+        "1gbps": 1000000000,
+        " 10Mbit ": 1250000,
+    }
+    for s, want := range rates {
+        if got, err := parseRate(s); err != nil || got != want {
+            t.Errorf("parseRate(%q) = %d, %v, want %d", s, got, err, want)
+        }
+    }
+
+    // less than a byte a second, no number or no unit known
+    for _, s := range []string{"4bit", "0mbit", "-1mbit", "10", "mbit", "10mb", ""} {
+        if got, err := parseRate(s); err == nil {
+            t.Errorf("parseRate(%q) = %d, want an error", s, got)
+        }
+    }
+}
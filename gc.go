@@ -0,0 +1,245 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "time"
+    "strings"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/link"
+    "github.com/union-cni/pkg/netinfo"
+    "github.com/union-cni/pkg/state"
+
+    "github.com/containernetworking/cni/pkg/skel"
+)
+
+const (
+    defaultGCWindow = 10 * time.Second
+    defaultGCInterval = 5 * time.Minute
+    gcState = "state"
+)
+
+// gcItem is something the garbage collector removed, or would remove.
+type gcItem struct {
+    Kind string      `json:"kind"`
+    Name string      `json:"name"`
+    Pod string       `json:"pod,omitempty"`
+    Reason string    `json:"reason"`
+}
+
+type gcOptions struct {
+    // tells whether the container of a state is still there
+    alive func(st *state.State) bool
+    // nothing younger than window is touched, an ADD may be working on it
+    window time.Duration
+    // links still leaked after settle are removed, with no settle only
+    // those found under lock are
+    settle time.Duration
+    dryRun bool
+    // held while removing, the daemon keeps its ADDs out this way
+    lock sync.Locker
+}
+
+// netnsAlive takes a container as gone once its netns is.
+func netnsAlive(st *state.State) bool {
+    if st.Netns == "" {
+        return false
+    }
+    _, err := os.Stat(st.Netns)
+    return err == nil
+}
+
+// bridgeNames lists the host bridges netInfo asks for.
+func bridgeNames(netInfo *netinfo.NetworkInfo) []string {
+    if netInfo == nil {
+        return nil
+    }
+    var names []string
+    for chanType := range netInfo.GetSystemChannels() {
+        names = append(names, netInfo.BridgeName(chanType))
+    }
+    for _, ext := range netInfo.GetExternalPorts() {
+        names = append(names, netInfo.PortBridgeName(ext.ContainerPort))
+    }
+    return names
+}
+
+// releaseState undoes what the ADD of st set up, as DEL would have.
+func releaseState(st *state.State) {
+    conf := &CNINetConf{}
+    if len(st.NetConf) != 0 {
+        if err := json.Unmarshal(st.NetConf, conf); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to load netconf of %s: %v\r\n", st.ContainerID, err)
+        }
+    }
+    args := &skel.CmdArgs{
+        ContainerID: st.ContainerID,
+        Netns: st.Netns,
+        Args: st.CNIArgs,
+        Path: st.CNIPath,
+        StdinData: st.NetConf,
+    }
+    if st.NetInfo != nil {
+        span, _ := newSpanConfig(conf)
+        deleteNetwork(st.NetInfo, st, st.Netns, span)
+    }
+    releaseChannelAddrs(st.NetInfo, st, st.ContainerID)
+    releaseDelegated(newDelegate(conf, args), st.NetInfo, st)
+    if parts := strings.SplitN(st.Pod, "/", 2); len(parts) == 2 && conf.Events != nil {
+        cleanEvents(parts[0], parts[1])
+    }
+    state.Remove(st.ContainerID)
+}
+
+func sameOrphan(orphans []link.Orphan, o link.Orphan) bool {
+    for _, old := range orphans {
+        if old == o {
+            return true
+        }
+    }
+    return false
+}
+
+// collectGarbage releases the states of the containers that are gone,
+// then removes the host links unicni left behind. An ADD may be making
+// links no state owns yet, so a link is only removed when it is still an
+// orphan after settle, or when it is found under the lock.
+func collectGarbage(opts *gcOptions) ([]gcItem, error) {
+    lock := func() {
+        if opts.lock != nil {
+            opts.lock.Lock()
+        }
+    }
+    unlock := func() {
+        if opts.lock != nil {
+            opts.lock.Unlock()
+        }
+    }
+
+    states, err := state.List()
+    if err != nil {
+        return nil, err
+    }
+    owned := make(map[string]bool)
+    inUse := make(map[string]bool)
+    var stale []*state.State
+    for _, st := range states {
+        names := bridgeNames(st.NetInfo)
+        for _, name := range names {
+            owned[name] = true
+        }
+        saved, err := state.Modified(st.ContainerID)
+        if opts.alive(st) || err != nil || time.Since(saved) < opts.window {
+            for _, name := range names {
+                inUse[name] = true
+            }
+            continue
+        }
+        stale = append(stale, st)
+    }
+
+    items := []gcItem{}
+    lock()
+    for _, st := range stale {
+        if !opts.dryRun {
+            releaseState(st)
+        }
+        items = append(items, gcItem{Kind: gcState, Name: st.ContainerID, Pod: st.Pod, Reason: "container is gone"})
+    }
+    unlock()
+
+    isOwned := func(name string) bool { return owned[name] }
+    isInUse := func(name string) bool { return inUse[name] }
+    var orphans []link.Orphan
+    if opts.dryRun || opts.settle > 0 || opts.lock == nil {
+        if orphans, err = link.FindOrphans(isOwned, isInUse); err != nil {
+            return items, err
+        }
+    }
+    if opts.dryRun {
+        for _, o := range orphans {
+            items = append(items, gcItem{Kind: o.Kind, Name: o.Name, Reason: o.Reason})
+        }
+        return items, nil
+    }
+    if opts.settle == 0 && opts.lock == nil {
+        // nothing keeps the ADDs out
+        for _, o := range orphans {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] gc left %s %s to the daemon or unictl gc\r\n", o.Kind, o.Name)
+        }
+        return items, nil
+    }
+    if opts.settle > 0 {
+        if len(orphans) == 0 {
+            return items, nil
+        }
+        time.Sleep(opts.settle)
+    }
+    lock()
+    defer unlock()
+    again, err := link.FindOrphans(isOwned, isInUse)
+    if err != nil {
+        return items, err
+    }
+    for _, o := range again {
+        if opts.settle > 0 && !sameOrphan(orphans, o) {
+            continue
+        }
+        if err = link.RemoveOrphan(o); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to remove %s %s: %v\r\n", o.Kind, o.Name, err)
+            continue
+        }
+        items = append(items, gcItem{Kind: o.Kind, Name: o.Name, Reason: o.Reason})
+    }
+    return items, nil
+}
+
+// gcConf is the netconf of the GC verb of CNI 1.1, it lists the
+// attachments the runtime still uses.
+type gcConf struct {
+    CNINetConf
+    ValidAttachments []struct {
+        ContainerID string      `json:"containerID"`
+        IfName string           `json:"ifname"`
+    }                           `json:"cni.dev/valid-attachments"`
+}
+
+// doGC drops the states of the network no valid attachment has, and the
+// links left behind. It answers the runtime right away: stale states are
+// told by their age, and links are only removed under the daemon lock.
+func doGC(stdinData []byte, lock sync.Locker) error {
+    conf := &gcConf{}
+    if err := json.Unmarshal(stdinData, conf); err != nil {
+        return fmt.Errorf("failed to load netconf: %v", err)
+    }
+    valid := make(map[string]bool)
+    for _, a := range conf.ValidAttachments {
+        valid[a.ContainerID] = true
+    }
+    items, err := collectGarbage(&gcOptions{
+        alive: func(st *state.State) bool {
+            // the runtime never knew the devices of a lab
+            if st.Lab != "" {
+                return true
+            }
+            stConf := &CNINetConf{}
+            // a state of another network is not ours to judge
+            if json.Unmarshal(st.NetConf, stConf) == nil && stConf.Name != conf.Name {
+                return true
+            }
+            return valid[st.ContainerID]
+        },
+        window: defaultGCWindow,
+        lock: lock,
+    })
+    logGarbage(items)
+    return err
+}
+
+func logGarbage(items []gcItem) {
+    for _, item := range items {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] gc removed %s %s: %s\r\n", item.Kind, item.Name, item.Reason)
+    }
+}
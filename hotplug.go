@@ -0,0 +1,318 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "flag"
+    "bytes"
+    "strings"
+    "net/url"
+    "net/http"
+    "io/ioutil"
+    "text/tabwriter"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/netinfo"
+    "github.com/union-cni/pkg/state"
+
+    "github.com/containernetworking/cni/pkg/types/current"
+    "github.com/ghodss/yaml"
+)
+
+// addrFlags collects the repeated -ip of a port.
+type addrFlags []netinfo.AddrInfo
+
+func (a *addrFlags) String() string {
+    return strings.Join(addrStrings(*a), ",")
+}
+
+func (a *addrFlags) Set(s string) error {
+    *a = append(*a, netinfo.AddrInfo{Address: s})
+    return nil
+}
+
+// sandboxOf returns the state of the running sandbox of podKey.
+func sandboxOf(podKey string) (*state.State, error) {
+    states, err := state.List()
+    if err != nil {
+        return nil, err
+    }
+    for _, st := range states {
+        if st.Pod == podKey && netnsAlive(st) {
+            if st.NetInfo == nil {
+                return nil, fmt.Errorf("no network_info recorded for %s", podKey)
+            }
+            return st, nil
+        }
+    }
+    return nil, fmt.Errorf("no sandbox of %s on this node", podKey)
+}
+
+// splitArgs parses fs out of argv, the arguments may come before the
+// flags as well as after them.
+func splitArgs(fs *flag.FlagSet, argv []string) ([]string, error) {
+    var args []string
+    for len(argv) > 0 && !strings.HasPrefix(argv[0], "-") {
+        args, argv = append(args, argv[0]), argv[1:]
+    }
+    if err := fs.Parse(argv); err != nil {
+        return nil, err
+    }
+    return append(args, fs.Args()...), nil
+}
+
+// portArgs parses fs out of argv, which names one pod.
+func portArgs(fs *flag.FlagSet, argv []string) (string, error) {
+    args, err := splitArgs(fs, argv)
+    if err != nil {
+        return "", err
+    }
+    if len(args) != 1 {
+        return "", fmt.Errorf("port %s takes one pod, <namespace>/<name>", fs.Name())
+    }
+    return args[0], nil
+}
+
+// portAdd sets a new external port up in a running pod, through the node
+// daemon when it runs.
+func (c *ctl) portAdd(argv []string) error {
+    fs := flag.NewFlagSet("add", flag.ContinueOnError)
+    file := fs.String("f", "", "port file, an entry of external_ports in YAML or JSON")
+    name := fs.String("name", "", "name of the port in the pod")
+    portType := fs.String("type", "", "port type, bridge when empty")
+    hostPort := fs.String("host-port", "", "host link of a macvlan, macvtap or device port")
+    mode := fs.String("mode", "", "macvlan or macvtap mode")
+    var ips addrFlags
+    fs.Var(&ips, "ip", "static address in CIDR notation, may be repeated")
+    podKey, err := portArgs(fs, argv)
+    if err != nil {
+        return err
+    }
+
+    ext := &netinfo.ExternalInfo{}
+    if *file != "" {
+        raw, err := ioutil.ReadFile(*file)
+        if err != nil {
+            return err
+        }
+        if err = yaml.Unmarshal(raw, ext); err != nil {
+            return fmt.Errorf("failed to parse %s: %v", *file, err)
+        }
+    }
+    // flags win over the file
+    fs.Visit(func(f *flag.Flag) {
+        switch f.Name {
+            case "name":
+                ext.ContainerPort = *name
+            case "type":
+                ext.Type = *portType
+            case "host-port":
+                ext.HostPort = *hostPort
+            case "mode":
+                ext.Mode = *mode
+            case "ip":
+                ext.IPs = ips
+        }
+    })
+    if ext.ContainerPort == "" || len(ext.ContainerPort) > 15 {
+        return fmt.Errorf("bad port name %q", ext.ContainerPort)
+    }
+
+    if err = c.daemonPorts(http.MethodPost, podKey, "", ext); err == errDaemonDown {
+        err = hotplugAdd(podKey, ext)
+    }
+    if err != nil {
+        return err
+    }
+    st, err := sandboxOf(podKey)
+    if err != nil {
+        return err
+    }
+    return c.printPort(st, ext.ContainerPort)
+}
+
+// hotplugAdd sets ext up in the running sandbox of podKey, and records it
+// as hot-plugged so that DEL removes it along with the others while
+// reconcile and diff leave it alone.
+func hotplugAdd(podKey string, ext *netinfo.ExternalInfo) error {
+    st, err := sandboxOf(podKey)
+    if err != nil {
+        return err
+    }
+    if findPort(st.NetInfo, ext.ContainerPort) != nil {
+        return fmt.Errorf("%s has a port %s already", podKey, ext.ContainerPort)
+    }
+    for _, chanName := range st.NetInfo.GetSystemChannels() {
+        if chanName == ext.ContainerPort {
+            return fmt.Errorf("%s is a channel of %s", ext.ContainerPort, podKey)
+        }
+    }
+    opts, err := stateOptions(st, nil)
+    if err != nil {
+        return err
+    }
+    if err = createExternalPort(st.NetInfo, ext, opts, st, st.Netns, &current.Result{}); err != nil {
+        return err
+    }
+    st.NetInfo.ExternalPort = append(st.NetInfo.ExternalPort, *ext)
+    st.HotPlugged = append(st.HotPlugged, ext.ContainerPort)
+    return st.Save()
+}
+
+// portDel removes an external port from a running pod.
+func (c *ctl) portDel(argv []string) error {
+    fs := flag.NewFlagSet("del", flag.ContinueOnError)
+    name := fs.String("name", "", "name of the port in the pod")
+    podKey, err := portArgs(fs, argv)
+    if err != nil {
+        return err
+    }
+    if err = c.daemonPorts(http.MethodDelete, podKey, *name, nil); err == errDaemonDown {
+        err = hotplugDel(podKey, *name)
+    }
+    return err
+}
+
+// hotplugDel removes the external port name from the running sandbox of
+// podKey.
+func hotplugDel(podKey string, name string) error {
+    st, err := sandboxOf(podKey)
+    if err != nil {
+        return err
+    }
+    ext := findPort(st.NetInfo, name)
+    if ext == nil {
+        return fmt.Errorf("%s has no external port %q", podKey, name)
+    }
+    opts, err := stateOptions(st, nil)
+    if err != nil {
+        return err
+    }
+    deleteExternalPort(st.NetInfo, ext, st, st.Netns)
+    releasePort(ext.ContainerPort, st, opts)
+
+    var ports []netinfo.ExternalInfo
+    for _, p := range st.NetInfo.ExternalPort {
+        if p.ContainerPort != name {
+            ports = append(ports, p)
+        }
+    }
+    st.NetInfo.ExternalPort = ports
+    return st.Save()
+}
+
+// withHotPlugged adds to the annotation the ports unictl plugged into the
+// sandbox of st, unless it lists a port of the same name itself.
+func withHotPlugged(st *state.State, annotation *netinfo.NetworkInfo) *netinfo.NetworkInfo {
+    if len(st.HotPlugged) == 0 || st.NetInfo == nil {
+        return annotation
+    }
+    merged := *annotation
+    merged.ExternalPort = append([]netinfo.ExternalInfo{}, annotation.ExternalPort...)
+    for _, name := range st.HotPlugged {
+        if ext := findPort(st.NetInfo, name); ext != nil && findPort(annotation, name) == nil {
+            merged.ExternalPort = append(merged.ExternalPort, *ext)
+        }
+    }
+    return &merged
+}
+
+// daemonPorts has the node daemon add or remove the port, so that it
+// doesn't race with a reconcile of the pod. errDaemonDown tells the caller
+// to do it itself.
+func (c *ctl) daemonPorts(method string, podKey string, name string, ext *netinfo.ExternalInfo) error {
+    if _, err := os.Stat(c.socket); err != nil {
+        return errDaemonDown
+    }
+    var body []byte
+    if ext != nil {
+        var err error
+        if body, err = json.Marshal(ext); err != nil {
+            return err
+        }
+    }
+    query := url.Values{"pod": {podKey}, "name": {name}}
+    req, err := http.NewRequest(method, "http://unicni/ports?" + query.Encode(), bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    resp, err := unixClient(c.socket, forwardTimeout).Do(req)
+    if err != nil {
+        if dialFailed(err) {
+            return errDaemonDown
+        }
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        var e struct {
+            Error string  `json:"error"`
+        }
+        if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+            return fmt.Errorf("daemon answered %s", resp.Status)
+        }
+        return fmt.Errorf("%s", e.Error)
+    }
+    return nil
+}
+
+// servePorts adds the external port of the body to a running pod with
+// POST ?pod=, or removes one with DELETE ?pod=&name=, one at a time with
+// the requests and reconciles of the daemon.
+func (d *daemon) servePorts(w http.ResponseWriter, r *http.Request) {
+    podKey := r.URL.Query().Get("pod")
+    var err error
+    switch r.Method {
+        case http.MethodPost:
+            ext := &netinfo.ExternalInfo{}
+            if err = json.NewDecoder(r.Body).Decode(ext); err != nil {
+                writeError(w, http.StatusBadRequest, err)
+                return
+            }
+            d.mu.Lock()
+            err = hotplugAdd(podKey, ext)
+            d.mu.Unlock()
+        case http.MethodDelete:
+            d.mu.Lock()
+            err = hotplugDel(podKey, r.URL.Query().Get("name"))
+            d.mu.Unlock()
+        default:
+            writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+            return
+    }
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+func (c *ctl) printPort(st *state.State, conPort string) error {
+    var ports []*ctlPort
+    for _, port := range expectedPorts(st.NetInfo) {
+        if port.Name == conPort {
+            ports = append(ports, port)
+        }
+    }
+    inspectPorts(st, ports)
+    return c.print(ports, func(w *tabwriter.Writer) {
+        fmt.Fprintln(w, "POD\tPORT\tKIND\tADDRESSES\tHOST PEER\tBRIDGE\tSTATE")
+        for _, port := range ports {
+            addrs := "-"
+            if port.Pod != nil {
+                addrs = dash(strings.Join(port.Pod.Addrs, ","))
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", st.Pod, port.Name, port.Kind, addrs, peerName(port), dash(port.Bridge), portState(port))
+        }
+    })
+}
+
+func (c *ctl) port(argv []string) error {
+    switch {
+        case len(argv) >= 1 && argv[0] == "add":
+            return c.portAdd(argv[1:])
+        case len(argv) >= 1 && argv[0] == "del":
+            return c.portDel(argv[1:])
+    }
+    return fmt.Errorf("port takes add or del")
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "flag"
+    "sync"
+    "time"
+    "strconv"
+    "math/rand"
+    "net/http"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/link"
+)
+
+// linkTarget is a port of a pod, or the cable it is plugged in when
+// Carrier is set.
+type linkTarget struct {
+    Pod string           `json:"pod"`
+    Port string          `json:"port"`
+    Carrier bool         `json:"carrier,omitempty"`
+    // the link set up or down, in netns, "" being the host
+    name string
+    netns string
+}
+
+func (t *linkTarget) String() string {
+    return t.Pod + " " + t.Port
+}
+
+// resolve finds the link to set up or down: the port itself, or for its
+// carrier the host peer or the other end of its wire, so that the port
+// stays up without carrier.
+func (t *linkTarget) resolve() error {
+    st, err := sandboxOf(t.Pod)
+    if err != nil {
+        return err
+    }
+    if w := st.GetWire(t.Port); w != nil {
+        t.name, t.netns = t.Port, st.Netns
+        if t.Carrier {
+            t.name, t.netns = w.PeerPort, w.PeerNetns
+        }
+        return nil
+    }
+
+    var port *ctlPort
+    for _, p := range expectedPorts(st.NetInfo) {
+        if p.Name == t.Port {
+            port = p
+        }
+    }
+    switch {
+        case port == nil:
+            return fmt.Errorf("%s has no port %s", t.Pod, t.Port)
+        case !t.Carrier:
+            t.name, t.netns = t.Port, st.Netns
+            return nil
+        case port.Bridge == "":
+            // the parent of a macvlan is the NIC of the node
+            return fmt.Errorf("port %s of %s has no host peer, only its admin state can be set", t.Port, t.Pod)
+    }
+    inspectPorts(st, []*ctlPort{port})
+    if port.HostPeer == nil {
+        return fmt.Errorf("no host peer of port %s of %s", t.Port, t.Pod)
+    }
+    t.name, t.netns = port.HostPeer.Name, ""
+    return nil
+}
+
+func (t *linkTarget) transition(up bool) string {
+    switch {
+        case t.Carrier && up:
+            return "carrier on"
+        case t.Carrier:
+            return "carrier off"
+        case up:
+            return "admin up"
+    }
+    return "admin down"
+}
+
+// set takes the link up or down, every transition is logged.
+func (t *linkTarget) set(up bool) error {
+    if err := link.SetLinkUp(t.name, t.netns, up); err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] link %s: failed to set %s: %v\r\n", t, t.transition(up), err)
+        return err
+    }
+    fmt.Fprintf(os.Stderr, "[UNION CNI] link %s: %s\r\n", t, t.transition(up))
+    return nil
+}
+
+// flapSpec takes a link down for Down every Every, Count times or until
+// stopped. Random draws each down time and period up to those.
+type flapSpec struct {
+    Down string           `json:"down"`
+    Every string          `json:"every"`
+    Count int             `json:"count,omitempty"`
+    Random bool           `json:"random,omitempty"`
+    down time.Duration
+    every time.Duration
+}
+
+func (f *flapSpec) parse() (err error) {
+    if f.down, err = time.ParseDuration(f.Down); err != nil || f.down <= 0 {
+        return fmt.Errorf("bad down time %q", f.Down)
+    }
+    if f.every, err = time.ParseDuration(f.Every); err != nil || f.every <= 0 {
+        return fmt.Errorf("bad period %q", f.Every)
+    }
+    if !f.Random && f.every <= f.down {
+        return fmt.Errorf("period %s leaves the link no time up", f.Every)
+    }
+    return nil
+}
+
+func sleepOrStop(d time.Duration, stop <-chan struct{}) bool {
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+    select {
+        case <-timer.C:
+            return true
+        case <-stop:
+            return false
+    }
+}
+
+// flap runs spec on t until it is done or stop is closed, and leaves the
+// link up either way.
+func flap(t *linkTarget, spec *flapSpec, stop <-chan struct{}, transitions *int32) error {
+    rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+    down := false
+    set := func(up bool) error {
+        err := t.set(up)
+        if err == nil {
+            down = !up
+            atomic.AddInt32(transitions, 1)
+        }
+        return err
+    }
+    defer func() {
+        if down {
+            set(true)
+        }
+    }()
+
+    for i := 0; spec.Count == 0 || i < spec.Count; i++ {
+        downTime, upTime := spec.down, spec.every - spec.down
+        if spec.Random {
+            downTime = time.Duration(rnd.Int63n(int64(spec.down))) + 1
+            upTime = time.Duration(rnd.Int63n(int64(spec.every))) + 1
+        }
+        if err := set(false); err != nil {
+            return err
+        }
+        if !sleepOrStop(downTime, stop) {
+            return nil
+        }
+        if err := set(true); err != nil {
+            return err
+        }
+        if i == spec.Count - 1 || !sleepOrStop(upTime, stop) {
+            return nil
+        }
+    }
+    return nil
+}
+
+// linkHold is a link the daemon holds down or flaps, until it is
+// released or the flap is over.
+type linkHold struct {
+    ID int                `json:"id"`
+    Target *linkTarget    `json:"target"`
+    Action string         `json:"action"`
+    Flap *flapSpec        `json:"flap,omitempty"`
+    Since time.Time       `json:"since"`
+    Transitions int32     `json:"transitions"`
+    stop chan struct{}
+    done chan struct{}
+}
+
+// linkRequest is what the daemon is asked at /link.
+type linkRequest struct {
+    linkTarget
+    // down, up or flap
+    Action string         `json:"action"`
+    Flap *flapSpec        `json:"flap,omitempty"`
+}
+
+type linkHolds struct {
+    mu sync.Mutex
+    next int
+    holds map[int]*linkHold
+}
+
+func (h *linkHolds) find(t *linkTarget) *linkHold {
+    for _, hold := range h.holds {
+        if hold.Target.Pod == t.Pod && hold.Target.Port == t.Port && hold.Target.Carrier == t.Carrier {
+            return hold
+        }
+    }
+    return nil
+}
+
+// release takes the link of the hold id back up, after its flap if any.
+// It returns nil when there is no such hold, or when it is being released
+// already: only the one that takes it out of holds releases it.
+func (h *linkHolds) release(id int) (*linkHold, error) {
+    h.mu.Lock()
+    hold := h.holds[id]
+    delete(h.holds, id)
+    h.mu.Unlock()
+    if hold == nil {
+        return nil, nil
+    }
+    if hold.stop != nil {
+        close(hold.stop)
+        <-hold.done
+        return hold, nil
+    }
+    return hold, hold.Target.set(true)
+}
+
+// snapshot copies hold for the API, Transitions is counted by its flap
+// meanwhile.
+func (hold *linkHold) snapshot() *linkHold {
+    return &linkHold{
+        ID: hold.ID,
+        Target: hold.Target,
+        Action: hold.Action,
+        Flap: hold.Flap,
+        Since: hold.Since,
+        Transitions: atomic.LoadInt32(&hold.Transitions),
+    }
+}
+
+func (h *linkHolds) apply(req *linkRequest) (*linkHold, error) {
+    t := &req.linkTarget
+    if err := t.resolve(); err != nil {
+        return nil, err
+    }
+    if req.Action == "up" {
+        h.mu.Lock()
+        old := h.find(t)
+        h.mu.Unlock()
+        if old != nil {
+            if released, err := h.release(old.ID); released != nil {
+                return nil, err
+            }
+        }
+        return nil, t.set(true)
+    }
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if old := h.find(t); old != nil {
+        return nil, fmt.Errorf("link %s is held by %d already", t, old.ID)
+    }
+    hold := &linkHold{Target: t, Action: req.Action, Since: time.Now()}
+    switch req.Action {
+        case "down":
+            if err := t.set(false); err != nil {
+                return nil, err
+            }
+            hold.Transitions = 1
+        case "flap":
+            if req.Flap == nil {
+                return nil, fmt.Errorf("flap takes down and every")
+            }
+            if err := req.Flap.parse(); err != nil {
+                return nil, err
+            }
+            hold.Flap = req.Flap
+            hold.stop, hold.done = make(chan struct{}), make(chan struct{})
+        default:
+            return nil, fmt.Errorf("unknown action %q", req.Action)
+    }
+    h.next++
+    hold.ID = h.next
+    h.holds[hold.ID] = hold
+    if hold.Flap != nil {
+        go func() {
+            defer close(hold.done)
+            if err := flap(t, hold.Flap, hold.stop, &hold.Transitions); err != nil {
+                fmt.Fprintf(os.Stderr, "[UNION CNI] link %s: flap %d stopped: %v\r\n", t, hold.ID, err)
+            }
+            // over by itself, or released already
+            h.mu.Lock()
+            delete(h.holds, hold.ID)
+            h.mu.Unlock()
+        }()
+    }
+    return hold, nil
+}
+
+func (h *linkHolds) list() []*linkHold {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    holds := []*linkHold{}
+    for _, hold := range h.holds {
+        holds = append(holds, hold.snapshot())
+    }
+    return holds
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+    writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// serveLink lists the links held with GET, sets one with POST, and
+// releases one with DELETE ?id=.
+func (h *linkHolds) serveLink(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+        case http.MethodGet:
+            writeJSON(w, http.StatusOK, h.list())
+        case http.MethodPost:
+            req := &linkRequest{}
+            if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+                writeError(w, http.StatusBadRequest, err)
+                return
+            }
+            hold, err := h.apply(req)
+            if err != nil {
+                writeError(w, http.StatusBadRequest, err)
+                return
+            }
+            if hold == nil {
+                writeJSON(w, http.StatusOK, &req.linkTarget)
+                return
+            }
+            writeJSON(w, http.StatusCreated, hold.snapshot())
+        case http.MethodDelete:
+            id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+            hold, err := h.release(id)
+            if hold == nil {
+                writeError(w, http.StatusNotFound, fmt.Errorf("no link held as %q", r.URL.Query().Get("id")))
+                return
+            }
+            if err != nil {
+                writeError(w, http.StatusInternalServerError, err)
+                return
+            }
+            writeJSON(w, http.StatusOK, hold.Target)
+        default:
+            writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+    }
+}
+
+// linkCmd sets a link from the command line. A flap runs until it is
+// over or interrupted, and leaves the link up.
+func (c *ctl) linkCmd(argv []string) error {
+    if len(argv) == 0 || (argv[0] != "down" && argv[0] != "up" && argv[0] != "flap") {
+        return fmt.Errorf("link takes down, up or flap")
+    }
+    fs := flag.NewFlagSet("link " + argv[0], flag.ContinueOnError)
+    t := &linkTarget{}
+    fs.BoolVar(&t.Carrier, "carrier", false, "set the carrier of the port by its host peer or wire end, rather than the port")
+    spec := &flapSpec{}
+    fs.StringVar(&spec.Down, "down", "5s", "flap: how long the link stays down")
+    fs.StringVar(&spec.Every, "every", "30s", "flap: how often the link goes down")
+    fs.IntVar(&spec.Count, "count", 0, "flap: how many times, 0 until interrupted")
+    fs.BoolVar(&spec.Random, "random", false, "flap: draw each down time and period up to -down and -every")
+    args, err := splitArgs(fs, argv[1:])
+    if err != nil {
+        return err
+    }
+    if len(args) != 2 {
+        return fmt.Errorf("link %s takes <namespace>/<name> <port>", argv[0])
+    }
+    t.Pod, t.Port = args[0], args[1]
+    if err = t.resolve(); err != nil {
+        return err
+    }
+
+    switch argv[0] {
+        case "down":
+            return t.set(false)
+        case "up":
+            return t.set(true)
+    }
+    if err = spec.parse(); err != nil {
+        return err
+    }
+    stop := make(chan struct{})
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+    defer signal.Stop(sig)
+    go func() {
+        if _, ok := <-sig; ok {
+            close(stop)
+        }
+    }()
+    var transitions int32
+    return flap(t, spec, stop, &transitions)
+}
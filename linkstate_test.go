@@ -0,0 +1,85 @@
+package main
+
+import (
+    "sync"
+    "time"
+    "testing"
+    "sync/atomic"
+)
+
+func TestFlapSpecParse(t *testing.T) {
+    spec := flapSpec{Down: "100ms", Every: "1s", Count: 3}
+    if err := spec.parse(); err != nil {
+        t.Fatal(err)
+    }
+    if spec.down != 100 * time.Millisecond || spec.every != time.Second {
+        t.Fatalf("got down %v every %v", spec.down, spec.every)
+    }
+
+    // a random flap only draws its downtime up to down
+    random := flapSpec{Down: "10s", Every: "5s", Random: true}
+    if err := random.parse(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestFlapSpecParseInvalid(t *testing.T) {
+    for _, spec := range []flapSpec{
+        {Down: "5s", Every: "5s"},
+        {Down: "10s", Every: "5s"},
+        {Every: "5s"},
+        {Down: "1s"},
+        {Down: "soon", Every: "5s"},
+        {Down: "0s", Every: "5s"},
+        {Down: "1s", Every: "-5s", Random: true},
+    } {
+        if err := spec.parse(); err == nil {
+            t.Errorf("down %q every %q parsed", spec.Down, spec.Every)
+        }
+    }
+}
+
+func TestLinkHoldsRelease(t *testing.T) {
+    h := &linkHolds{holds: make(map[int]*linkHold)}
+    hold := &linkHold{ID: 1, Target: &linkTarget{Pod: "default/p", Port: "eth1"}, Action: "flap"}
+    hold.stop, hold.done = make(chan struct{}), make(chan struct{})
+    h.holds[hold.ID] = hold
+    // a flap counting transitions until it is stopped
+    go func() {
+        defer close(hold.done)
+        for {
+            select {
+                case <-hold.stop:
+                    return
+                default:
+                    atomic.AddInt32(&hold.Transitions, 1)
+            }
+        }
+    }()
+
+    var wg sync.WaitGroup
+    var released int32
+    for i := 0; i < 8; i++ {
+        wg.Add(2)
+        go func() {
+            defer wg.Done()
+            h.list()
+        }()
+        go func() {
+            defer wg.Done()
+            if got, err := h.release(hold.ID); got != nil {
+                if err != nil {
+                    t.Error(err)
+                }
+                atomic.AddInt32(&released, 1)
+            }
+        }()
+    }
+    wg.Wait()
+    if released != 1 {
+        t.Fatalf("released %d times", released)
+    }
+    if len(h.list()) != 0 {
+        t.Fatal("hold still listed")
+    }
+}
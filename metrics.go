@@ -0,0 +1,174 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "flag"
+    "bytes"
+    "strings"
+    "net/http"
+
+    "github.com/union-cni/pkg/link"
+    "github.com/union-cni/pkg/state"
+)
+
+const defaultMetricsListen = ":9631"
+
+// portCounters are exported for both ends of a port, by side.
+var portCounters = []struct {
+    name string
+    help string
+    value func(s *link.PortStats) uint64
+}{
+    {"unicni_port_receive_bytes_total", "Bytes received by the link.", func(s *link.PortStats) uint64 { return s.RxBytes }},
+    {"unicni_port_transmit_bytes_total", "Bytes sent by the link.", func(s *link.PortStats) uint64 { return s.TxBytes }},
+    {"unicni_port_receive_packets_total", "Packets received by the link.", func(s *link.PortStats) uint64 { return s.RxPackets }},
+    {"unicni_port_transmit_packets_total", "Packets sent by the link.", func(s *link.PortStats) uint64 { return s.TxPackets }},
+    {"unicni_port_receive_errors_total", "Receive errors of the link.", func(s *link.PortStats) uint64 { return s.RxErrors }},
+    {"unicni_port_transmit_errors_total", "Transmit errors of the link.", func(s *link.PortStats) uint64 { return s.TxErrors }},
+    {"unicni_port_receive_drops_total", "Packets dropped on receive by the link.", func(s *link.PortStats) uint64 { return s.RxDropped }},
+    {"unicni_port_transmit_drops_total", "Packets dropped on transmit by the link.", func(s *link.PortStats) uint64 { return s.TxDropped }},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabels formats name, value pairs as a label set.
+func promLabels(pairs ...string) string {
+    var parts []string
+    for i := 0; i + 1 < len(pairs); i += 2 {
+        parts = append(parts, pairs[i] + `="` + labelEscaper.Replace(pairs[i + 1]) + `"`)
+    }
+    return "{" + strings.Join(parts, ",") + "}"
+}
+
+// portSample is one end of a port with its labels.
+type portSample struct {
+    labels string
+    stats *link.PortStats
+}
+
+// bridgeSample is one group bridge with its member count.
+type bridgeSample struct {
+    labels string
+    members int
+}
+
+// collectMetrics reads the counters of the ports of every running pod
+// and device of the node, and the members of their group bridges.
+func collectMetrics() ([]portSample, []bridgeSample, error) {
+    states, err := state.List()
+    if err != nil {
+        return nil, nil, err
+    }
+    var ports []portSample
+    var bridges []bridgeSample
+    seen := make(map[string]bool)
+    for _, st := range states {
+        if st.NetInfo == nil || !netnsAlive(st) {
+            continue
+        }
+        namespace, pod := "", st.Pod
+        if i := strings.Index(st.Pod, "/"); i >= 0 {
+            namespace, pod = st.Pod[:i], st.Pod[i + 1:]
+        }
+        netInfo := st.NetInfo
+        labels := func(port string, kind string, side string, name string) string {
+            chanType := ""
+            if strings.HasPrefix(kind, "channel:") {
+                kind, chanType = "channel", strings.TrimPrefix(kind, "channel:")
+            }
+            return promLabels("namespace", namespace, "pod", pod,
+                              "credential", netInfo.GetCred(), "group", netInfo.GetGroup(),
+                              "deviceid", netInfo.GetDeviceID(), "port", port,
+                              "channel_type", chanType, "kind", kind, "side", side, "link", name)
+        }
+
+        expected := expectedPorts(netInfo)
+        for _, w := range st.Wires {
+            expected = append(expected, &ctlPort{Name: w.ContainerPort, Kind: "wire"})
+        }
+        inspectPorts(st, expected)
+        for _, port := range expected {
+            if port.Pod != nil && port.Pod.Stats != nil {
+                ports = append(ports, portSample{labels(port.Name, port.Kind, "pod", port.Pod.Name), port.Pod.Stats})
+            }
+            // the parent of a macvlan is the NIC of the node, not a peer
+            if port.Bridge != "" && port.HostPeer != nil && port.HostPeer.Stats != nil {
+                ports = append(ports, portSample{labels(port.Name, port.Kind, "host", port.HostPeer.Name), port.HostPeer.Stats})
+            }
+        }
+
+        for chanType := range netInfo.GetSystemChannels() {
+            brName := netInfo.BridgeName(chanType)
+            if seen[brName] {
+                continue
+            }
+            seen[brName] = true
+            n, err := link.BridgeMembers(brName)
+            if err != nil {
+                continue
+            }
+            bridges = append(bridges, bridgeSample{
+                promLabels("bridge", brName, "credential", netInfo.GetCred(), "group", netInfo.GetGroup(), "channel_type", chanType),
+                n,
+            })
+        }
+    }
+    return ports, bridges, nil
+}
+
+// writeMetrics writes the metrics of the node in the Prometheus text
+// format.
+func writeMetrics(w io.Writer) error {
+    ports, bridges, err := collectMetrics()
+    if err != nil {
+        return err
+    }
+    for _, c := range portCounters {
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+        for _, p := range ports {
+            fmt.Fprintf(w, "%s%s %d\n", c.name, p.labels, c.value(p.stats))
+        }
+    }
+    fmt.Fprintln(w, "# HELP unicni_bridge_members Links enslaved to the bridge of a group channel.")
+    fmt.Fprintln(w, "# TYPE unicni_bridge_members gauge")
+    for _, b := range bridges {
+        fmt.Fprintf(w, "unicni_bridge_members%s %d\n", b.labels, b.members)
+    }
+    return nil
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+        return
+    }
+    var buf bytes.Buffer
+    if err := writeMetrics(&buf); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    w.Write(buf.Bytes())
+}
+
+// metrics prints the metrics of the node once, or serves them at
+// /metrics for Prometheus to scrape.
+func (c *ctl) metrics(argv []string) error {
+    if len(argv) == 0 {
+        return writeMetrics(os.Stdout)
+    }
+    if argv[0] != "serve" {
+        return fmt.Errorf("metrics takes serve or nothing")
+    }
+    fs := flag.NewFlagSet("metrics serve", flag.ContinueOnError)
+    listen := fs.String("listen", defaultMetricsListen, "address to serve /metrics on")
+    if err := fs.Parse(argv[1:]); err != nil {
+        return err
+    }
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", serveMetrics)
+    fmt.Fprintf(os.Stderr, "[UNION CNI] serving metrics on %s\r\n", *listen)
+    return http.ListenAndServe(*listen, mux)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "net"
+    "encoding/hex"
+
+    "github.com/union-cni/pkg/link"
+
+    "github.com/vishvananda/netlink"
+    "k8s.io/api/core/v1"
+)
+
+const (
+    defaultVtepAnnotation = "unicni/vtep"
+    defaultVxlanPort = 4789
+)
+
+// OverlayConf spans the group bridges over nodes with VXLAN. Peers are
+// the VTEP addresses of the other nodes, they are completed by the
+// NodeAnnotation of every Node when set. Allocations is the
+// <namespace>/<name> of the ConfigMap recording the VNIs.
+type OverlayConf struct {
+    Underlay string         `json:"underlay"`
+    Local string            `json:"local"`
+    DstPort int             `json:"dst_port"`
+    Peers []string          `json:"peers"`
+    NodeAnnotation string   `json:"node_annotation"`
+    Allocations string      `json:"allocations"`
+}
+
+func localVtep(conf *OverlayConf) (net.IP, error) {
+    if conf.Local != "" {
+        local := net.ParseIP(conf.Local)
+        if local == nil {
+            return nil, fmt.Errorf("invalid overlay local address %q", conf.Local)
+        }
+        return local, nil
+    }
+
+    if conf.Underlay == "" {
+        return nil, nil
+    }
+    uLink, err := netlink.LinkByName(conf.Underlay)
+    if err != nil {
+        return nil, fmt.Errorf("failed to lookup underlay %q: %v", conf.Underlay, err)
+    }
+    addrs, err := netlink.AddrList(uLink, netlink.FAMILY_V4)
+    if err != nil || len(addrs) == 0 {
+        return nil, fmt.Errorf("underlay %q has no address: %v", conf.Underlay, err)
+    }
+    return addrs[0].IP, nil
+}
+
+// overlayPeers lists the static peers and those of the nodes, with the
+// IPsec nonce each node publishes. The list is complete unless the nodes
+// could not be read.
+func overlayPeers(conf *CNINetConf, local net.IP) ([]net.IP, map[string][]byte, bool) {
+    ovl := conf.Overlay
+    raw := append([]string{}, ovl.Peers...)
+    nonces := make(map[string][]byte)
+    complete := true
+    if ovl.NodeAnnotation != "" {
+        cli, err := conf.kubeClient()
+        var nodes *v1.NodeList
+        if err == nil {
+            nodes, err = cli.ListNodes()
+        }
+        if err != nil {
+            // keep going with the static peers, without pruning the others
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to list overlay peers: %v\r\n", err)
+            complete = false
+        } else {
+            for _, node := range nodes.Items {
+                vtep, ok := node.Annotations[ovl.NodeAnnotation]
+                if !ok {
+                    continue
+                }
+                raw = append(raw, vtep)
+                if nonce, err := hex.DecodeString(node.Annotations[ipsecNonceAnnotation]); err == nil && len(nonce) != 0 {
+                    if ip := net.ParseIP(vtep); ip != nil {
+                        nonces[ip.String()] = nonce
+                    }
+                }
+            }
+        }
+    }
+
+    var peers []net.IP
+    seen := make(map[string]bool)
+    for _, s := range raw {
+        peer := net.ParseIP(s)
+        if peer == nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] ignore invalid overlay peer %q\r\n", s)
+            continue
+        }
+        if peer.Equal(local) || seen[peer.String()] {
+            continue
+        }
+        seen[peer.String()] = true
+        peers = append(peers, peer)
+    }
+    return peers, nonces, complete
+}
+
+// overlayConfig resolves the netconf into what every group bridge of
+// this ADD needs but the VNI and the peers, looked up only for a bridge
+// spanned for the first time.
+func overlayConfig(conf *CNINetConf) (*link.OverlayConfig, error) {
+    if conf.Overlay == nil {
+        return nil, nil
+    }
+    if conf.Overlay.NodeAnnotation == "" {
+        conf.Overlay.NodeAnnotation = defaultVtepAnnotation
+    }
+
+    if conf.Overlay.DstPort == 0 {
+        conf.Overlay.DstPort = defaultVxlanPort
+    }
+
+    local, err := localVtep(conf.Overlay)
+    if err != nil {
+        return nil, err
+    }
+    return &link.OverlayConfig{
+        Local: local,
+        Underlay: conf.Overlay.Underlay,
+        DstPort: conf.Overlay.DstPort,
+    }, nil
+}
+
+// refreshOverlay brings the IPsec and the peers of the bridges spanned
+// already up to date with the Nodes, the keys first so that a node that
+// joined never gets traffic in clear.
+func refreshOverlay(conf *CNINetConf) error {
+    span, err := newSpanConfig(conf)
+    if err != nil || span.overlay == nil {
+        return err
+    }
+    span.loadPeers()
+    if err = applyEncryption(conf, span); err != nil {
+        return err
+    }
+    return link.SyncOverlayPeers(span.overlay.Peers, span.overlay.Complete)
+}
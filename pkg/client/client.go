@@ -2,8 +2,16 @@ package client
 
 import (
     "fmt"
+    "os"
+    "time"
+    "strings"
+    "io/ioutil"
+    "encoding/json"
 
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
     metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/types"
+    "k8s.io/apimachinery/pkg/watch"
  
     "k8s.io/api/core/v1"
     "k8s.io/client-go/kubernetes"
@@ -32,6 +40,44 @@ func CreateInsecureClient(host string, port string) *Client {
     return client
 }
 
+// AuthConfig reaches the API server over TLS with a service account
+// token or a client certificate. Without Server, the in-cluster
+// environment of the node is used.
+type AuthConfig struct {
+    Server string
+    TokenFile string
+    CAFile string
+    CertFile string
+    KeyFile string
+}
+
+func CreateClient(auth *AuthConfig) (*Client, error) {
+    if auth.Server == "" {
+        config, err := rest.InClusterConfig()
+        if err != nil {
+            return nil, fmt.Errorf("no api server given: %v", err)
+        }
+        return &Client{Host: config.Host, Config: config}, nil
+    }
+
+    config := &rest.Config{
+        Host: auth.Server,
+        TLSClientConfig: rest.TLSClientConfig{
+            CAFile: auth.CAFile,
+            CertFile: auth.CertFile,
+            KeyFile: auth.KeyFile,
+        },
+    }
+    if auth.TokenFile != "" {
+        token, err := ioutil.ReadFile(auth.TokenFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read token: %v", err)
+        }
+        config.BearerToken = strings.TrimSpace(string(token))
+    }
+    return &Client{Host: auth.Server, Config: config}, nil
+}
+
 func (cli *Client) GetPod(namespace, podname string) (*v1.Pod, error) {
     clientset, err := kubernetes.NewForConfig(cli.Config)
     if err != nil {
@@ -46,4 +92,199 @@ func (cli *Client) GetPod(namespace, podname string) (*v1.Pod, error) {
     return pod, nil
 }
 
- 
+// ListPods lists the pods of every namespace matching the field selector.
+func (cli *Client) ListPods(fieldSelector string) (*v1.PodList, error) {
+    clientset, err := kubernetes.NewForConfig(cli.Config)
+    if err != nil {
+        return nil, fmt.Errorf("Create client failed: %v", err)
+    }
+
+    pods, err := clientset.CoreV1().Pods("").List(metav1.ListOptions{FieldSelector: fieldSelector})
+    if err != nil {
+        return nil, fmt.Errorf("List pods failed: %v", err)
+    }
+
+    return pods, nil
+}
+
+// WatchPods watches the pods of ListPods from resourceVersion on.
+func (cli *Client) WatchPods(fieldSelector string, resourceVersion string) (watch.Interface, error) {
+    clientset, err := kubernetes.NewForConfig(cli.Config)
+    if err != nil {
+        return nil, fmt.Errorf("Create client failed: %v", err)
+    }
+
+    w, err := clientset.CoreV1().Pods("").Watch(metav1.ListOptions{
+        FieldSelector: fieldSelector,
+        ResourceVersion: resourceVersion,
+    })
+    if err != nil {
+        return nil, fmt.Errorf("Watch pods failed: %v", err)
+    }
+
+    return w, nil
+}
+
+func (cli *Client) ListNodes() (*v1.NodeList, error) {
+    clientset, err := kubernetes.NewForConfig(cli.Config)
+    if err != nil {
+        return nil, fmt.Errorf("Create client failed: %v", err)
+    }
+
+    nodes, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+    if err != nil {
+        return nil, fmt.Errorf("List nodes failed: %v", err)
+    }
+
+    return nodes, nil
+}
+
+func (cli *Client) GetSecret(namespace, name string) (*v1.Secret, error) {
+    clientset, err := kubernetes.NewForConfig(cli.Config)
+    if err != nil {
+        return nil, fmt.Errorf("Create client failed: %v", err)
+    }
+
+    secret, err := clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+    if err != nil {
+        return nil, fmt.Errorf("No such secret %s in namespace %s: %v", name, namespace, err)
+    }
+
+    return secret, nil
+}
+
+// configMapRetries bounds how often UpdateConfigMap starts over when
+// another writer got in first.
+const configMapRetries = 5
+
+// UpdateConfigMap runs update on the data of the ConfigMap, created empty
+// when missing, and writes it back when update reports a change. It
+// starts over when the ConfigMap was changed in between, so update may
+// run more than once.
+func (cli *Client) UpdateConfigMap(namespace, name string, update func(data map[string]string) (bool, error)) error {
+    clientset, err := kubernetes.NewForConfig(cli.Config)
+    if err != nil {
+        return fmt.Errorf("Create client failed: %v", err)
+    }
+
+    configMaps := clientset.CoreV1().ConfigMaps(namespace)
+    for i := 0; i < configMapRetries; i++ {
+        cm, err := configMaps.Get(name, metav1.GetOptions{})
+        create := apierrors.IsNotFound(err)
+        switch {
+            case create:
+                cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+            case err != nil:
+                return fmt.Errorf("Get configmap %s in namespace %s failed: %v", name, namespace, err)
+        }
+        if cm.Data == nil {
+            cm.Data = make(map[string]string)
+        }
+
+        changed, err := update(cm.Data)
+        if err != nil || !changed {
+            return err
+        }
+        if create {
+            _, err = configMaps.Create(cm)
+        } else {
+            _, err = configMaps.Update(cm)
+        }
+        if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+            continue
+        }
+        if err != nil {
+            return fmt.Errorf("Update configmap %s in namespace %s failed: %v", name, namespace, err)
+        }
+        return nil
+    }
+    return fmt.Errorf("Update configmap %s in namespace %s failed: changed %d times in between", name, namespace, configMapRetries)
+}
+
+// SetPodAnnotation sets the annotation of the pod, an empty value
+// removes it.
+func (cli *Client) SetPodAnnotation(namespace, podname, key, value string) error {
+    clientset, err := kubernetes.NewForConfig(cli.Config)
+    if err != nil {
+        return fmt.Errorf("Create client failed: %v", err)
+    }
+
+    var v interface{}
+    if value != "" {
+        v = value
+    }
+    patch, err := json.Marshal(map[string]interface{}{
+        "metadata": map[string]interface{}{
+            "annotations": map[string]interface{}{key: v},
+        },
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = clientset.CoreV1().Pods(namespace).Patch(podname, types.MergePatchType, patch)
+    if err != nil {
+        return fmt.Errorf("Patch pod %s in namespace %s failed: %v", podname, namespace, err)
+    }
+    return nil
+}
+
+// SetNodeAnnotation sets the annotation of the node.
+func (cli *Client) SetNodeAnnotation(nodename, key, value string) error {
+    clientset, err := kubernetes.NewForConfig(cli.Config)
+    if err != nil {
+        return fmt.Errorf("Create client failed: %v", err)
+    }
+
+    patch, err := json.Marshal(map[string]interface{}{
+        "metadata": map[string]interface{}{
+            "annotations": map[string]interface{}{key: value},
+        },
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = clientset.CoreV1().Nodes().Patch(nodename, types.MergePatchType, patch)
+    if err != nil {
+        return fmt.Errorf("Patch node %s failed: %v", nodename, err)
+    }
+    return nil
+}
+
+// CreatePodEvent posts an event about the pod, from unicni on this node.
+func (cli *Client) CreatePodEvent(pod *v1.Pod, eventType, reason, message string) error {
+    clientset, err := kubernetes.NewForConfig(cli.Config)
+    if err != nil {
+        return fmt.Errorf("Create client failed: %v", err)
+    }
+
+    host, _ := os.Hostname()
+    now := metav1.Now()
+    event := &v1.Event{
+        ObjectMeta: metav1.ObjectMeta{
+            Name: fmt.Sprintf("%s.%x", pod.Name, time.Now().UnixNano()),
+            Namespace: pod.Namespace,
+        },
+        InvolvedObject: v1.ObjectReference{
+            Kind: "Pod",
+            APIVersion: "v1",
+            Namespace: pod.Namespace,
+            Name: pod.Name,
+            UID: pod.UID,
+        },
+        Reason: reason,
+        Message: message,
+        Type: eventType,
+        Source: v1.EventSource{Component: "unicni", Host: host},
+        FirstTimestamp: now,
+        LastTimestamp: now,
+        Count: 1,
+    }
+
+    _, err = clientset.CoreV1().Events(pod.Namespace).Create(event)
+    if err != nil {
+        return fmt.Errorf("Create event of pod %s in namespace %s failed: %v", pod.Name, pod.Namespace, err)
+    }
+    return nil
+}
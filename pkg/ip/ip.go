@@ -3,30 +3,208 @@ package ip
 import (
     "fmt"
     "os"
+    "net"
+    "syscall"
 
     "github.com/containernetworking/plugins/pkg/ns"
     "github.com/vishvananda/netlink"
 )
 
-func AddrAddInNS(linkName string, ipaddr string, nspath string) error {
-    addr, _ := netlink.ParseAddr(ipaddr)
+// Addr is one address of a port. NoDad and Optimistic only matter
+// for IPv6. An address in the subnet of a former one becomes secondary.
+type Addr struct {
+    Address string
+    NoDad bool
+    Optimistic bool
+}
+
+// Route is a static route of a port. An empty or "default" Dst is the
+// default route, Table 0 is the main table.
+type Route struct {
+    Dst string
+    Gateway string
+    Metric int
+    Table int
+}
+
+func (a *Addr) parse() (*netlink.Addr, error) {
+    addr, err := netlink.ParseAddr(a.Address)
+    if err != nil {
+        return nil, fmt.Errorf("invalid address %q: %v", a.Address, err)
+    }
+    if addr.IP.To4() == nil {
+        if a.NoDad {
+            addr.Flags |= syscall.IFA_F_NODAD
+        }
+        if a.Optimistic {
+            addr.Flags |= syscall.IFA_F_OPTIMISTIC
+        }
+    }
+    return addr, nil
+}
+
+func (r *Route) parse(l netlink.Link) (*netlink.Route, error) {
+    route := &netlink.Route{
+        LinkIndex: l.Attrs().Index,
+        Priority: r.Metric,
+        Table: r.Table,
+    }
+    if r.Dst != "" && r.Dst != "default" {
+        _, dst, err := net.ParseCIDR(r.Dst)
+        if err != nil {
+            return nil, fmt.Errorf("invalid route destination %q: %v", r.Dst, err)
+        }
+        route.Dst = dst
+    }
+    if r.Gateway != "" {
+        route.Gw = net.ParseIP(r.Gateway)
+        if route.Gw == nil {
+            return nil, fmt.Errorf("invalid route gateway %q", r.Gateway)
+        }
+    } else {
+        route.Scope = netlink.SCOPE_LINK
+    }
+    return route, nil
+}
 
-    netNS,err := ns.GetNS(nspath)
+// doInNS runs fn on the link in the namespace.
+func doInNS(linkName string, nspath string, fn func(netlink.Link) error) error {
+    netNS, err := ns.GetNS(nspath)
     if err != nil {
         return err
     }
+    defer netNS.Close()
 
-    err = netNS.Do(func (_ ns.NetNS) error {
+    return netNS.Do(func (_ ns.NetNS) error {
             l, err := netlink.LinkByName(linkName)
             if err != nil {
                 fmt.Fprintf(os.Stderr, "[UNION CNI] failed to lookup %q in %q: %v\r\n", linkName, nspath, err)
                 return err
             }
+            return fn(l)
+    })
+}
+
+func AddrAddInNS(linkName string, ipaddr string, nspath string) error {
+    return AddrsAddInNS(linkName, []*Addr{{Address: ipaddr}}, nspath)
+}
+
+// AddrsAddInNS sets the addresses in order, the ones already there are
+// updated so that ADD can be run again.
+func AddrsAddInNS(linkName string, addrs []*Addr, nspath string) error {
+    return doInNS(linkName, nspath, func(l netlink.Link) error {
+            for _, a := range addrs {
+                addr, err := a.parse()
+                if err != nil {
+                    return err
+                }
+                if err = netlink.AddrReplace(l, addr); err != nil {
+                    return fmt.Errorf("failed to add %s to %s: %v", a.Address, linkName, err)
+                }
+            }
+            return nil
+    })
+}
+
+// AddrsDelInNS removes the addresses in reverse order, secondaries
+// first, the missing ones are skipped.
+func AddrsDelInNS(linkName string, addrs []*Addr, nspath string) error {
+    return doInNS(linkName, nspath, func(l netlink.Link) error {
+            for i := len(addrs) - 1; i >= 0; i-- {
+                addr, err := addrs[i].parse()
+                if err != nil {
+                    return err
+                }
+                err = netlink.AddrDel(l, addr)
+                if err != nil && err != syscall.EADDRNOTAVAIL {
+                    return fmt.Errorf("failed to delete %s from %s: %v", addrs[i].Address, linkName, err)
+                }
+            }
+            return nil
+    })
+}
+
+func RouteAddInNS(linkName string, dst *net.IPNet, gw net.IP, nspath string) error {
+    return doInNS(linkName, nspath, func(l netlink.Link) error {
+            route := &netlink.Route{
+                LinkIndex: l.Attrs().Index,
+                Dst: dst,
+                Gw: gw,
+            }
+            return netlink.RouteReplace(route)
+    })
+}
+
+// RoutesAddInNS adds or replaces the routes, the addresses that make
+// their gateways reachable must be there already.
+func RoutesAddInNS(linkName string, routes []*Route, nspath string) error {
+    return doInNS(linkName, nspath, func(l netlink.Link) error {
+            for _, r := range routes {
+                route, err := r.parse(l)
+                if err != nil {
+                    return err
+                }
+                if err = netlink.RouteReplace(route); err != nil {
+                    return fmt.Errorf("failed to add route %s via %q on %s: %v", route.Dst, r.Gateway, linkName, err)
+                }
+            }
+            return nil
+    })
+}
 
-            return netlink.AddrAdd(l, addr)
+// RoutesDelInNS removes the routes, the missing ones are skipped.
+func RoutesDelInNS(linkName string, routes []*Route, nspath string) error {
+    return doInNS(linkName, nspath, func(l netlink.Link) error {
+            for _, r := range routes {
+                route, err := r.parse(l)
+                if err != nil {
+                    return err
+                }
+                err = netlink.RouteDel(route)
+                if err != nil && err != syscall.ESRCH {
+                    return fmt.Errorf("failed to delete route %s on %s: %v", route.Dst, linkName, err)
+                }
+            }
+            return nil
     })
+}
+
+// SetDefaultRouteInNS makes the link the default route of the family of
+// every gateway, replacing the default routes of the other links in the
+// main table.
+func SetDefaultRouteInNS(linkName string, gateways []string, nspath string) error {
+    return doInNS(linkName, nspath, func(l netlink.Link) error {
+            for _, s := range gateways {
+                gw := net.ParseIP(s)
+                if gw == nil {
+                    return fmt.Errorf("invalid default gateway %q", s)
+                }
+                family := netlink.FAMILY_V4
+                if gw.To4() == nil {
+                    family = netlink.FAMILY_V6
+                }
 
-    netNS.Close()
+                routes, err := netlink.RouteList(nil, family)
+                if err != nil {
+                    return fmt.Errorf("failed to list routes: %v", err)
+                }
+                for i := range routes {
+                    r := &routes[i]
+                    if r.Dst == nil && r.LinkIndex != l.Attrs().Index {
+                        if err = netlink.RouteDel(r); err != nil && err != syscall.ESRCH {
+                            return fmt.Errorf("failed to delete default route %s: %v", r, err)
+                        }
+                    }
+                }
 
-    return err
+                route := &netlink.Route{
+                    LinkIndex: l.Attrs().Index,
+                    Gw: gw,
+                }
+                if err = netlink.RouteReplace(route); err != nil {
+                    return fmt.Errorf("failed to set default route via %s on %s: %v", s, linkName, err)
+                }
+            }
+            return nil
+    })
 }
@@ -0,0 +1,101 @@
+package ipam
+
+import (
+    "fmt"
+    "os"
+    "bytes"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "encoding/json"
+
+    "github.com/containernetworking/cni/pkg/types"
+    "github.com/containernetworking/cni/pkg/types/current"
+    "github.com/containernetworking/cni/pkg/version"
+)
+
+// Delegate runs a standard CNI IPAM plugin (host-local, static, dhcp...)
+// on behalf of one port, through the CNI exec protocol.
+type Delegate struct {
+    CNIVersion string
+    NetName string
+    ContainerID string
+    Netns string
+    Args string
+    Path string
+}
+
+func (d *Delegate) find(plugin string) (string, error) {
+    for _, dir := range filepath.SplitList(d.Path) {
+        path := filepath.Join(dir, plugin)
+        if info, err := os.Stat(path); err == nil && !info.IsDir() {
+            return path, nil
+        }
+    }
+    return "", fmt.Errorf("failed to find ipam plugin %q in %q", plugin, d.Path)
+}
+
+func (d *Delegate) exec(command string, ifName string, ipamConf json.RawMessage) ([]byte, error) {
+    var plugin struct {
+        Type string `json:"type"`
+    }
+    if err := json.Unmarshal(ipamConf, &plugin); err != nil || plugin.Type == "" {
+        return nil, fmt.Errorf("ipam of %q has no type: %v", ifName, err)
+    }
+    path, err := d.find(plugin.Type)
+    if err != nil {
+        return nil, err
+    }
+
+    if d.CNIVersion == "" {
+        d.CNIVersion = version.Current()
+    }
+    stdin, err := json.Marshal(map[string]interface{}{
+        "cniVersion": d.CNIVersion,
+        "name": d.NetName,
+        "ipam": ipamConf,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    cmd := exec.Command(path)
+    cmd.Stdin = bytes.NewReader(stdin)
+    cmd.Stderr = os.Stderr
+    cmd.Env = append(os.Environ(),
+        "CNI_COMMAND=" + command,
+        "CNI_CONTAINERID=" + d.ContainerID,
+        "CNI_NETNS=" + d.Netns,
+        "CNI_IFNAME=" + ifName,
+        "CNI_ARGS=" + d.Args,
+        "CNI_PATH=" + d.Path,
+    )
+    stdout, err := cmd.Output()
+    if err != nil {
+        pluginErr := &types.Error{}
+        if jerr := json.Unmarshal(stdout, pluginErr); jerr == nil && pluginErr.Msg != "" {
+            return nil, pluginErr
+        }
+        return nil, fmt.Errorf("ipam plugin %s %s failed: %v", plugin.Type, strings.ToLower(command), err)
+    }
+    return stdout, nil
+}
+
+// Add returns the addresses, routes and DNS the plugin assigned to ifName.
+func (d *Delegate) Add(ifName string, ipamConf json.RawMessage) (*current.Result, error) {
+    stdout, err := d.exec("ADD", ifName, ipamConf)
+    if err != nil {
+        return nil, err
+    }
+
+    res, err := version.NewResult(d.CNIVersion, stdout)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse ipam result of %q: %v", ifName, err)
+    }
+    return current.NewResultFromResult(res)
+}
+
+func (d *Delegate) Del(ifName string, ipamConf json.RawMessage) error {
+    _, err := d.exec("DEL", ifName, ipamConf)
+    return err
+}
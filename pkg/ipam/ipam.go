@@ -0,0 +1,223 @@
+package ipam
+
+import (
+    "fmt"
+    "os"
+    "net"
+    "syscall"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+)
+
+const (
+    defaultStoreDir = "/var/lib/unicni/ipam"
+    // never walk more than this, large IPv6 subnets would take forever
+    maxScan = 1 << 16
+)
+
+// StoreDir may be changed for testing or by netconf.
+var StoreDir = defaultStoreDir
+
+// Pool is the subnet of one credential/group/channel. Reserved maps a
+// device id to the address it always gets.
+type Pool struct {
+    Name string
+    Subnet *net.IPNet
+    Reserved map[string]net.IP
+}
+
+type lease struct {
+    DeviceID string         `json:"deviceid"`
+    ContainerID string      `json:"container_id"`
+}
+
+// poolData is kept in one file per pool. Sticky remembers the last address
+// of every device, so that a restarted device gets it back.
+type poolData struct {
+    Leases map[string]lease     `json:"leases"`
+    Sticky map[string]string    `json:"sticky"`
+}
+
+func poolDir(name string) string {
+    return filepath.Join(StoreDir, name)
+}
+
+// withPool runs fn with the pool data under an exclusive lock, and writes
+// it back when fn succeeds.
+func withPool(name string, fn func(*poolData) error) error {
+    dir := poolDir(name)
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return fmt.Errorf("failed to create ipam dir %q: %v", dir, err)
+    }
+
+    lock, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0600)
+    if err != nil {
+        return err
+    }
+    defer lock.Close()
+    if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+        return fmt.Errorf("failed to lock pool %q: %v", name, err)
+    }
+    defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+    data := &poolData{}
+    path := filepath.Join(dir, "pool.json")
+    rawData, err := ioutil.ReadFile(path)
+    if err == nil {
+        err = json.Unmarshal(rawData, data)
+    }
+    if err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("failed to load pool %q: %v", name, err)
+    }
+    if data.Leases == nil {
+        data.Leases = make(map[string]lease)
+    }
+    if data.Sticky == nil {
+        data.Sticky = make(map[string]string)
+    }
+
+    if err = fn(data); err != nil {
+        return err
+    }
+
+    if rawData, err = json.Marshal(data); err != nil {
+        return err
+    }
+    if err = ioutil.WriteFile(path + ".tmp", rawData, 0600); err != nil {
+        return err
+    }
+    return os.Rename(path + ".tmp", path)
+}
+
+func nextIP(ip net.IP) net.IP {
+    next := make(net.IP, len(ip))
+    copy(next, ip)
+    for i := len(next) - 1; i >= 0; i-- {
+        next[i]++
+        if next[i] != 0 {
+            break
+        }
+    }
+    return next
+}
+
+// hosts returns the usable addresses of the subnet, network and broadcast
+// addresses excluded for IPv4.
+func hosts(subnet *net.IPNet) []net.IP {
+    var ips []net.IP
+    ones, bits := subnet.Mask.Size()
+    ip := subnet.IP.Mask(subnet.Mask)
+    if ip.To4() != nil {
+        ip = ip.To4()
+    }
+    for i := 0; i < maxScan && subnet.Contains(ip); i++ {
+        ips = append(ips, ip)
+        ip = nextIP(ip)
+    }
+    if ip.To4() != nil && bits - ones > 1 && len(ips) > 2 {
+        ips = ips[1:]
+        if !subnet.Contains(ip) {
+            ips = ips[:len(ips) - 1]
+        }
+    }
+    return ips
+}
+
+func (pool *Pool) reservedFor(ip net.IP) string {
+    for dev, rip := range pool.Reserved {
+        if rip.Equal(ip) {
+            return dev
+        }
+    }
+    return ""
+}
+
+func (pool *Pool) pick(data *poolData, deviceID string) (net.IP, error) {
+    if ip, ok := pool.Reserved[deviceID]; ok && deviceID != "" {
+        if !pool.Subnet.Contains(ip) {
+            return nil, fmt.Errorf("reserved address %s of %q is out of %s", ip, deviceID, pool.Subnet)
+        }
+        if l, ok := data.Leases[ip.String()]; ok && l.DeviceID != deviceID {
+            return nil, fmt.Errorf("reserved address %s of %q is used by %q", ip, deviceID, l.DeviceID)
+        }
+        return ip, nil
+    }
+
+    owners := make(map[string]string)
+    for dev, ip := range data.Sticky {
+        owners[ip] = dev
+    }
+    if s, ok := data.Sticky[deviceID]; ok && deviceID != "" {
+        if _, leased := data.Leases[s]; !leased && pool.reservedFor(net.ParseIP(s)) == "" {
+            return net.ParseIP(s), nil
+        }
+    }
+
+    var stolen net.IP
+    for _, ip := range hosts(pool.Subnet) {
+        if _, leased := data.Leases[ip.String()]; leased || pool.reservedFor(ip) != "" {
+            continue
+        }
+        if owner, ok := owners[ip.String()]; ok && owner != deviceID {
+            // only taken from another device when nothing else is left
+            if stolen == nil {
+                stolen = ip
+            }
+            continue
+        }
+        return ip, nil
+    }
+
+    if stolen == nil {
+        return nil, fmt.Errorf("no free address left in %s", pool.Subnet)
+    }
+    delete(data.Sticky, owners[stolen.String()])
+    return stolen, nil
+}
+
+// Allocate returns the address of the container in the pool, allocating
+// one if needed. A device gets back its reserved or last address.
+func Allocate(pool *Pool, deviceID string, containerID string) (*net.IPNet, error) {
+    var addr *net.IPNet
+    err := withPool(pool.Name, func(data *poolData) error {
+        for s, l := range data.Leases {
+            if l.ContainerID == containerID {
+                addr = &net.IPNet{IP: net.ParseIP(s), Mask: pool.Subnet.Mask}
+                return nil
+            }
+        }
+
+        ip, err := pool.pick(data, deviceID)
+        if err != nil {
+            return err
+        }
+        data.Leases[ip.String()] = lease{
+            DeviceID: deviceID,
+            ContainerID: containerID,
+        }
+        if deviceID != "" {
+            data.Sticky[deviceID] = ip.String()
+        }
+        addr = &net.IPNet{IP: ip, Mask: pool.Subnet.Mask}
+        return nil
+    })
+    return addr, err
+}
+
+// Release frees the addresses of the container, the device keeps
+// its sticky address for next time.
+func Release(poolName string, containerID string) error {
+    if _, err := os.Stat(poolDir(poolName)); os.IsNotExist(err) {
+        return nil
+    }
+
+    return withPool(poolName, func(data *poolData) error {
+        for s, l := range data.Leases {
+            if l.ContainerID == containerID {
+                delete(data.Leases, s)
+            }
+        }
+        return nil
+    })
+}
@@ -0,0 +1,195 @@
+package ipam
+
+import (
+    "os"
+    "net"
+    "testing"
+    "io/ioutil"
+)
+
+// step allocates for a device and container, or releases the container
+// when release is set. want is the address expected, or "error".
+type step struct {
+    deviceID string
+    containerID string
+    release bool
+    want string
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+    _, subnet, err := net.ParseCIDR(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return subnet
+}
+
+func TestAllocate(t *testing.T) {
+    tests := []struct {
+        name string
+        subnet string
+        reserved map[string]string
+        steps []step
+    }{
+        {
+            name: "first hosts in order",
+            subnet: "10.0.0.0/29",
+            steps: []step{
+                {deviceID: "a", containerID: "c1", want: "10.0.0.1"},
+                {deviceID: "b", containerID: "c2", want: "10.0.0.2"},
+                {deviceID: "", containerID: "c3", want: "10.0.0.3"},
+            },
+        },
+        {
+            name: "same container gets the same address",
+            subnet: "10.0.0.0/29",
+            steps: []step{
+                {deviceID: "a", containerID: "c1", want: "10.0.0.1"},
+                {deviceID: "a", containerID: "c1", want: "10.0.0.1"},
+            },
+        },
+        {
+            name: "sticky address after restart",
+            subnet: "10.0.0.0/29",
+            steps: []step{
+                {deviceID: "a", containerID: "c1", want: "10.0.0.1"},
+                {deviceID: "b", containerID: "c2", want: "10.0.0.2"},
+                {containerID: "c1", release: true},
+                {containerID: "c2", release: true},
+                {deviceID: "b", containerID: "c4", want: "10.0.0.2"},
+                {deviceID: "a", containerID: "c3", want: "10.0.0.1"},
+            },
+        },
+        {
+            name: "sticky address is not given to a new device",
+            subnet: "10.0.0.0/29",
+            steps: []step{
+                {deviceID: "a", containerID: "c1", want: "10.0.0.1"},
+                {containerID: "c1", release: true},
+                {deviceID: "b", containerID: "c2", want: "10.0.0.2"},
+            },
+        },
+        {
+            name: "sticky address taken when nothing else is left",
+            subnet: "10.0.0.0/30",
+            steps: []step{
+                {deviceID: "a", containerID: "c1", want: "10.0.0.1"},
+                {deviceID: "b", containerID: "c2", want: "10.0.0.2"},
+                {containerID: "c1", release: true},
+                {deviceID: "c", containerID: "c3", want: "10.0.0.1"},
+                {containerID: "c2", release: true},
+                {deviceID: "a", containerID: "c4", want: "10.0.0.2"},
+            },
+        },
+        {
+            name: "reserved address",
+            subnet: "10.0.0.0/29",
+            reserved: map[string]string{"a": "10.0.0.5"},
+            steps: []step{
+                {deviceID: "b", containerID: "c1", want: "10.0.0.1"},
+                {deviceID: "a", containerID: "c2", want: "10.0.0.5"},
+            },
+        },
+        {
+            name: "reserved address skipped for others",
+            subnet: "10.0.0.0/30",
+            reserved: map[string]string{"a": "10.0.0.1"},
+            steps: []step{
+                {deviceID: "b", containerID: "c1", want: "10.0.0.2"},
+                {deviceID: "c", containerID: "c2", want: "error"},
+                {deviceID: "a", containerID: "c3", want: "10.0.0.1"},
+            },
+        },
+        {
+            name: "reserved address out of the subnet",
+            subnet: "10.0.0.0/29",
+            reserved: map[string]string{"a": "10.0.1.1"},
+            steps: []step{
+                {deviceID: "a", containerID: "c1", want: "error"},
+            },
+        },
+        {
+            name: "exhaustion",
+            subnet: "10.0.0.0/30",
+            steps: []step{
+                {deviceID: "a", containerID: "c1", want: "10.0.0.1"},
+                {deviceID: "b", containerID: "c2", want: "10.0.0.2"},
+                {deviceID: "c", containerID: "c3", want: "error"},
+                {containerID: "c1", release: true},
+                {deviceID: "c", containerID: "c3", want: "10.0.0.1"},
+            },
+        },
+        {
+            name: "point to point subnet",
+            subnet: "10.0.0.0/31",
+            steps: []step{
+                {deviceID: "a", containerID: "c1", want: "10.0.0.0"},
+                {deviceID: "b", containerID: "c2", want: "10.0.0.1"},
+                {deviceID: "c", containerID: "c3", want: "error"},
+            },
+        },
+        {
+            name: "ipv6",
+            subnet: "fd00::/126",
+            steps: []step{
+                {deviceID: "a", containerID: "c1", want: "fd00::"},
+                {deviceID: "b", containerID: "c2", want: "fd00::1"},
+            },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dir, err := ioutil.TempDir("", "ipam")
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer os.RemoveAll(dir)
+            StoreDir = dir
+            defer func() { StoreDir = defaultStoreDir }()
+
+            pool := &Pool{Name: "pool", Subnet: mustCIDR(t, tt.subnet), Reserved: make(map[string]net.IP)}
+            for dev, ip := range tt.reserved {
+                pool.Reserved[dev] = net.ParseIP(ip)
+            }
+            for i, s := range tt.steps {
+                if s.release {
+                    if err := Release(pool.Name, s.containerID); err != nil {
+                        t.Fatalf("step %d: release %s: %v", i, s.containerID, err)
+                    }
+                    continue
+                }
+                addr, err := Allocate(pool, s.deviceID, s.containerID)
+                if s.want == "error" {
+                    if err == nil {
+                        t.Fatalf("step %d: got %s, want an error", i, addr)
+                    }
+                    continue
+                }
+                if err != nil {
+                    t.Fatalf("step %d: %v", i, err)
+                }
+                if !addr.IP.Equal(net.ParseIP(s.want)) {
+                    t.Fatalf("step %d: got %s, want %s", i, addr.IP, s.want)
+                }
+            }
+        })
+    }
+}
+
+func TestReleaseUnknownPool(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ipam")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    StoreDir = dir
+    defer func() { StoreDir = defaultStoreDir }()
+
+    if err := Release("missing", "c1"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(poolDir("missing")); !os.IsNotExist(err) {
+        t.Fatalf("release created the pool: %v", err)
+    }
+}
@@ -0,0 +1,347 @@
+package ipsec
+
+import (
+    "fmt"
+    "os"
+    "net"
+    "time"
+    "syscall"
+    "io/ioutil"
+    "path/filepath"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/binary"
+
+    "github.com/vishvananda/netlink"
+)
+
+const (
+    // reqid tags the states and policies owned by unicni
+    unicniReqid = 0x756e69
+    aeadAlgo = "rfc4106(gcm(aes))"
+    // AES-128 key followed by the 4 byte salt
+    aeadKeyLen = 20
+    aeadICVLen = 128
+    minKeyLen = 16
+    nonceLen = 16
+)
+
+// RunDir lives as long as the states of the kernel, until the next boot.
+var RunDir = "/run/unicni"
+
+// Config protects the UDP traffic to Port between Local and every peer.
+// Keys and SPIs are derived from Key, the rekey epoch and the nonce of
+// the sending node, so that every node computes the same ones once the
+// nonces are published. A peer without a nonce gets no inbound state,
+// its traffic is dropped.
+type Config struct {
+    Local net.IP
+    Peers []net.IP
+    Port int
+    Key []byte
+    RekeyInterval time.Duration
+    Nonce []byte
+    PeerNonces map[string][]byte
+}
+
+type nonceRecord struct {
+    Nonce string              `json:"nonce"`
+    // outbound states were installed with it
+    Installed bool            `json:"installed"`
+}
+
+func nonceFile() string {
+    return filepath.Join(RunDir, "ipsec-nonce")
+}
+
+func readNonce() (*nonceRecord, []byte) {
+    raw, err := ioutil.ReadFile(nonceFile())
+    if err != nil {
+        return nil, nil
+    }
+    rec := &nonceRecord{}
+    if json.Unmarshal(raw, rec) != nil {
+        return nil, nil
+    }
+    nonce, err := hex.DecodeString(rec.Nonce)
+    if err != nil || len(nonce) != nonceLen {
+        return nil, nil
+    }
+    return rec, nonce
+}
+
+func writeNonce(rec *nonceRecord) error {
+    if err := os.MkdirAll(RunDir, 0700); err != nil {
+        return err
+    }
+    raw, err := json.Marshal(rec)
+    if err != nil {
+        return err
+    }
+    tmp := nonceFile() + ".tmp"
+    if err = ioutil.WriteFile(tmp, raw, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, nonceFile())
+}
+
+// Nonce returns the nonce of the outbound states of local, and whether
+// it is a new one to publish before Apply. A new nonce is drawn after a
+// boot, or when the states installed with the last one are gone, so that
+// a key is never used again with its sequence numbers started over,
+// which would repeat the GCM nonces.
+func Nonce(local net.IP) ([]byte, bool, error) {
+    rec, nonce := readNonce()
+    if rec != nil && (!rec.Installed || hasOutbound(local)) {
+        return nonce, false, nil
+    }
+    nonce = make([]byte, nonceLen)
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, false, err
+    }
+    if err := writeNonce(&nonceRecord{Nonce: hex.EncodeToString(nonce)}); err != nil {
+        return nil, false, fmt.Errorf("failed to record ipsec nonce: %v", err)
+    }
+    return nonce, true, nil
+}
+
+func hasOutbound(local net.IP) bool {
+    states, err := netlink.XfrmStateList(family(local))
+    if err != nil {
+        // assume the worst
+        return false
+    }
+    for i := range states {
+        if states[i].Reqid == unicniReqid && states[i].Src.Equal(local) {
+            return true
+        }
+    }
+    return false
+}
+
+// Lock serializes the runs of Nonce and Apply of the node.
+func Lock() (func(), error) {
+    if err := os.MkdirAll(RunDir, 0700); err != nil {
+        return nil, err
+    }
+    lock, err := os.OpenFile(filepath.Join(RunDir, "ipsec.lock"), os.O_RDWR|os.O_CREATE, 0600)
+    if err != nil {
+        return nil, err
+    }
+    if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+        lock.Close()
+        return nil, fmt.Errorf("failed to lock ipsec: %v", err)
+    }
+    return func() {
+        syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+        lock.Close()
+    }, nil
+}
+
+func (cfg *Config) epoch(now time.Time) int64 {
+    return now.Unix() / int64(cfg.RekeyInterval / time.Second)
+}
+
+// derive returns the key and SPI of the SA from src to dst in epoch,
+// nonce being the one of src.
+func (cfg *Config) derive(epoch int64, src net.IP, dst net.IP, nonce []byte) ([]byte, int) {
+    mac := hmac.New(sha256.New, cfg.Key)
+    fmt.Fprintf(mac, "%d/%s/%s/%x", epoch, src, dst, nonce)
+    sum := mac.Sum(nil)
+    // SPIs below 256 are reserved
+    spi := int(binary.BigEndian.Uint32(sum[aeadKeyLen:]) & 0x7fffffff | 0x100)
+    return sum[:aeadKeyLen], spi
+}
+
+func (cfg *Config) state(epoch int64, src net.IP, dst net.IP, nonce []byte) *netlink.XfrmState {
+    key, spi := cfg.derive(epoch, src, dst, nonce)
+    return &netlink.XfrmState{
+        Src: src,
+        Dst: dst,
+        Proto: netlink.XFRM_PROTO_ESP,
+        Mode: netlink.XFRM_MODE_TRANSPORT,
+        Spi: spi,
+        Reqid: unicniReqid,
+        ReplayWindow: 32,
+        Aead: &netlink.XfrmStateAlgo{
+            Name: aeadAlgo,
+            Key: key,
+            ICVLen: aeadICVLen,
+        },
+    }
+}
+
+func hostNet(ip net.IP) *net.IPNet {
+    bits := 32
+    if ip.To4() == nil {
+        bits = 128
+    }
+    return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func (cfg *Config) policy(dir netlink.Dir, src net.IP, dst net.IP) *netlink.XfrmPolicy {
+    return &netlink.XfrmPolicy{
+        Src: hostNet(src),
+        Dst: hostNet(dst),
+        Proto: netlink.Proto(syscall.IPPROTO_UDP),
+        DstPort: cfg.Port,
+        Dir: dir,
+        Tmpls: []netlink.XfrmPolicyTmpl{
+            {
+                Src: src,
+                Dst: dst,
+                Proto: netlink.XFRM_PROTO_ESP,
+                Mode: netlink.XFRM_MODE_TRANSPORT,
+                Reqid: unicniReqid,
+            },
+        },
+    }
+}
+
+func family(ip net.IP) int {
+    if ip.To4() == nil {
+        return netlink.FAMILY_V6
+    }
+    return netlink.FAMILY_V4
+}
+
+func stateKey(sa *netlink.XfrmState) string {
+    return fmt.Sprintf("%s>%s/%x", sa.Src, sa.Dst, sa.Spi)
+}
+
+// Apply installs the policies and the states of the current epoch,
+// and removes what belongs to former epochs or peers. Outbound traffic
+// uses the current epoch, inbound also accepts its neighbours, since the
+// nodes don't roll over at the very same time. The outbound states of
+// the current epoch stay until it is over, even for a peer gone, so that
+// a peer coming back gets them as they are rather than added again.
+func Apply(cfg *Config) error {
+    if len(cfg.Key) < minKeyLen {
+        return fmt.Errorf("ipsec key is shorter than %d bytes", minKeyLen)
+    }
+    if cfg.RekeyInterval < time.Second {
+        return fmt.Errorf("invalid rekey interval %v", cfg.RekeyInterval)
+    }
+    if len(cfg.Nonce) != nonceLen {
+        return fmt.Errorf("ipsec nonce is not %d bytes", nonceLen)
+    }
+
+    epoch := cfg.epoch(time.Now())
+    wanted := make(map[string]*netlink.XfrmState)
+    for _, peer := range cfg.Peers {
+        out := cfg.state(epoch, cfg.Local, peer, cfg.Nonce)
+        wanted[stateKey(out)] = out
+        peerNonce, ok := cfg.PeerNonces[peer.String()]
+        if !ok {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] ipsec peer %s has no nonce published, its traffic is dropped\r\n", peer)
+            continue
+        }
+        for e := epoch - 1; e <= epoch + 1; e++ {
+            in := cfg.state(e, peer, cfg.Local, peerNonce)
+            wanted[stateKey(in)] = in
+        }
+    }
+
+    current, err := netlink.XfrmStateList(family(cfg.Local))
+    if err != nil {
+        return fmt.Errorf("failed to list xfrm states: %v", err)
+    }
+    for i := range current {
+        sa := &current[i]
+        if sa.Reqid != unicniReqid {
+            continue
+        }
+        if _, ok := wanted[stateKey(sa)]; ok {
+            delete(wanted, stateKey(sa))
+            continue
+        }
+        if sa.Src.Equal(cfg.Local) {
+            if _, spi := cfg.derive(epoch, cfg.Local, sa.Dst, cfg.Nonce); spi == sa.Spi {
+                continue
+            }
+        }
+        if err = netlink.XfrmStateDel(sa); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to delete xfrm state %s: %v\r\n", stateKey(sa), err)
+        }
+    }
+
+    installed := false
+    for _, sa := range wanted {
+        if err = netlink.XfrmStateAdd(sa); err != nil && err != syscall.EEXIST {
+            return fmt.Errorf("failed to add xfrm state %s: %v", stateKey(sa), err)
+        }
+        installed = installed || sa.Src.Equal(cfg.Local)
+    }
+    if installed {
+        if rec, nonce := readNonce(); rec != nil && hmac.Equal(nonce, cfg.Nonce) && !rec.Installed {
+            rec.Installed = true
+            if err = writeNonce(rec); err != nil {
+                return fmt.Errorf("failed to record ipsec nonce: %v", err)
+            }
+        }
+    }
+
+    return applyPolicies(cfg)
+}
+
+func applyPolicies(cfg *Config) error {
+    peers := make(map[string]bool)
+    for _, peer := range cfg.Peers {
+        peers[peer.String()] = true
+        for _, p := range []*netlink.XfrmPolicy{
+            cfg.policy(netlink.XFRM_DIR_OUT, cfg.Local, peer),
+            cfg.policy(netlink.XFRM_DIR_IN, peer, cfg.Local),
+        } {
+            if err := netlink.XfrmPolicyUpdate(p); err != nil {
+                return fmt.Errorf("failed to update xfrm policy %s: %v", p, err)
+            }
+        }
+    }
+
+    policies, err := netlink.XfrmPolicyList(family(cfg.Local))
+    if err != nil {
+        return fmt.Errorf("failed to list xfrm policies: %v", err)
+    }
+    for i := range policies {
+        p := &policies[i]
+        if len(p.Tmpls) != 1 || p.Tmpls[0].Reqid != unicniReqid {
+            continue
+        }
+        peer := p.Tmpls[0].Dst
+        if p.Dir == netlink.XFRM_DIR_IN {
+            peer = p.Tmpls[0].Src
+        }
+        if !peers[peer.String()] {
+            netlink.XfrmPolicyDel(p)
+        }
+    }
+    return nil
+}
+
+// Flush removes every state and policy owned by unicni.
+func Flush() error {
+    policies, err := netlink.XfrmPolicyList(netlink.FAMILY_ALL)
+    if err != nil {
+        return fmt.Errorf("failed to list xfrm policies: %v", err)
+    }
+    for i := range policies {
+        p := &policies[i]
+        if len(p.Tmpls) == 1 && p.Tmpls[0].Reqid == unicniReqid {
+            netlink.XfrmPolicyDel(p)
+        }
+    }
+
+    states, err := netlink.XfrmStateList(netlink.FAMILY_ALL)
+    if err != nil {
+        return fmt.Errorf("failed to list xfrm states: %v", err)
+    }
+    for i := range states {
+        if states[i].Reqid == unicniReqid {
+            netlink.XfrmStateDel(&states[i])
+        }
+    }
+    return nil
+}
@@ -11,6 +11,7 @@ import (
 const defaultMTU = 1400
 const defaultPromiscMode = true
 const sysBrPath = "/sys/class/net/%s/brif"
+const bridgeAlias = "unicni"
 
 type Bridge struct {
     Data *netlink.Bridge
@@ -101,6 +102,10 @@ func CreateBridge(name string) (*Bridge, error) {
     if err != nil {
         return nil, fmt.Errorf("failed to create bridge %q: %v", name, err)
     }
+    // tells the garbage collector the bridge is ours
+    if br.Attrs().Alias == "" {
+        netlink.LinkSetAlias(br, bridgeAlias)
+    }
 
     bridge := &Bridge{
         Data: br,
@@ -110,6 +115,8 @@ func CreateBridge(name string) (*Bridge, error) {
     return bridge, nil
 }
 
+// DeleteBridgeIfEmpty deletes the bridge once no pod port is left on it,
+// uplinks to other nodes don't count and go away with the bridge.
 func DeleteBridgeIfEmpty(brName string) error {
     // walk over the bridge path    
     brPath := fmt.Sprintf(sysBrPath, brName)
@@ -117,6 +124,7 @@ func DeleteBridgeIfEmpty(brName string) error {
     if err != nil {
         return err
     }
+    defer brDir.Close()
 
     // read all names from brDir
     names,err := brDir.Readdirnames(0)
@@ -124,9 +132,19 @@ func DeleteBridgeIfEmpty(brName string) error {
         return err
     }
 
+    var uplinks []netlink.Link
+    for _, name := range names {
+        l, err := netlink.LinkByName(name)
+        if err != nil || !isUplink(l) {
+            return nil
+        }
+        uplinks = append(uplinks, l)
+    }
+
     // empty bridge, we do delete it
-    if len(names) == 0 {
-        DeleteBridge(brName)
+    for _, l := range uplinks {
+        netlink.LinkDel(l)
     }
+    DeleteBridge(brName)
     return  nil
 }
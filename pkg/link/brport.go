@@ -0,0 +1,87 @@
+package link
+
+import (
+    "fmt"
+    "os"
+
+    "github.com/vishvananda/netlink"
+    "github.com/vishvananda/netlink/nl"
+    "golang.org/x/sys/unix"
+)
+
+// bridge port attributes missing from the vendored netlink
+const (
+    brportMcastFlood = 27
+    brportIsolated = 33
+)
+
+// PortFlags holds the bridge settings of one enslaved port.
+// A nil field leaves the kernel default untouched.
+type PortFlags struct {
+    Hairpin *bool
+    Learning *bool
+    UnicastFlood *bool
+    MulticastFlood *bool
+    Isolated *bool
+    BpduGuard *bool
+    RootBlock *bool
+    FastLeave *bool
+}
+
+func setBrportAttr(link netlink.Link, attr int, mode bool) error {
+    req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+
+    msg := nl.NewIfInfomsg(unix.AF_BRIDGE)
+    msg.Index = int32(link.Attrs().Index)
+    req.AddData(msg)
+
+    val := []byte{0}
+    if mode {
+        val[0] = 1
+    }
+    br := nl.NewRtAttr(unix.IFLA_PROTINFO|unix.NLA_F_NESTED, nil)
+    nl.NewRtAttrChild(br, attr, val)
+    req.AddData(br)
+
+    _, err := req.Execute(unix.NETLINK_ROUTE, 0)
+    return err
+}
+
+// SetPortFlags applies the flags to a link already enslaved to the bridge,
+// it must be called after AddLink.
+func (br *Bridge)SetPortFlags(link netlink.Link, flags *PortFlags) error {
+    if flags == nil {
+        return nil
+    }
+
+    setters := []struct {
+        name string
+        mode *bool
+        set func(netlink.Link, bool) error
+    }{
+        {"hairpin", flags.Hairpin, netlink.LinkSetHairpin},
+        {"learning", flags.Learning, netlink.LinkSetLearning},
+        {"unicast_flood", flags.UnicastFlood, netlink.LinkSetFlood},
+        {"multicast_flood", flags.MulticastFlood, func(l netlink.Link, mode bool) error {
+            return setBrportAttr(l, brportMcastFlood, mode)
+        }},
+        {"isolated", flags.Isolated, func(l netlink.Link, mode bool) error {
+            return setBrportAttr(l, brportIsolated, mode)
+        }},
+        {"bpdu_guard", flags.BpduGuard, netlink.LinkSetGuard},
+        {"root_block", flags.RootBlock, netlink.LinkSetRootBlock},
+        {"fast_leave", flags.FastLeave, netlink.LinkSetFastLeave},
+    }
+
+    for _, s := range setters {
+        if s.mode == nil {
+            continue
+        }
+        if err := s.set(link, *s.mode); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to set %s on port %q of bridge %q: %v\r\n", s.name, link.Attrs().Name, br.Name, err)
+            return fmt.Errorf("failed to set %s on %q: %v", s.name, link.Attrs().Name, err)
+        }
+    }
+
+    return nil
+}
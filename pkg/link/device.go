@@ -0,0 +1,158 @@
+package link
+
+import (
+    "fmt"
+    "os"
+    "net"
+    "syscall"
+
+    "github.com/union-cni/pkg/state"
+
+    "github.com/containernetworking/plugins/pkg/ns"
+    "github.com/vishvananda/netlink"
+)
+
+func saveDevice(l netlink.Link, conPort string) (*state.DeviceState, error) {
+    addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list addresses of %q: %v", l.Attrs().Name, err)
+    }
+
+    dev := &state.DeviceState{
+        Name: l.Attrs().Name,
+        ContainerPort: conPort,
+        MTU: l.Attrs().MTU,
+        Up: l.Attrs().Flags & net.FlagUp != 0,
+    }
+    for _, addr := range addrs {
+        // link local addresses come back by themselves
+        if addr.IP.IsLinkLocalUnicast() {
+            continue
+        }
+        dev.Addrs = append(dev.Addrs, addr.IPNet.String())
+    }
+    return dev, nil
+}
+
+// restoreDevice renames the link and puts back MTU, addresses and
+// admin state, it runs in the namespace the link currently lives in.
+func restoreDevice(name string, newName string, dev *state.DeviceState) error {
+    l, err := netlink.LinkByName(name)
+    if err != nil {
+        return fmt.Errorf("failed to lookup %q: %v", name, err)
+    }
+
+    if err = netlink.LinkSetDown(l); err != nil {
+        return fmt.Errorf("failed to set %q down: %v", name, err)
+    }
+
+    if name != newName {
+        if err = netlink.LinkSetName(l, newName); err != nil {
+            return fmt.Errorf("failed to rename %q to %q: %v", name, newName, err)
+        }
+    }
+
+    if dev.MTU > 0 && l.Attrs().MTU != dev.MTU {
+        if err = netlink.LinkSetMTU(l, dev.MTU); err != nil {
+            return fmt.Errorf("failed to set mtu of %q: %v", newName, err)
+        }
+    }
+
+    for _, ipaddr := range dev.Addrs {
+        addr, err := netlink.ParseAddr(ipaddr)
+        if err != nil {
+            return fmt.Errorf("invalid address %q of %q: %v", ipaddr, newName, err)
+        }
+        if err = netlink.AddrAdd(l, addr); err != nil && err != syscall.EEXIST {
+            return fmt.Errorf("failed to add address %q to %q: %v", ipaddr, newName, err)
+        }
+    }
+
+    if dev.Up {
+        if err = netlink.LinkSetUp(l); err != nil {
+            return fmt.Errorf("failed to set %q up: %v", newName, err)
+        }
+    }
+    return nil
+}
+
+// MoveDeviceToNS hands the host device hostPort over to the pod, where it
+// is named conPort. The returned state is needed by MoveDeviceToHost.
+func MoveDeviceToNS(hostPort string, conPort string, nspath string) (*state.DeviceState, error) {
+    if conPort == "" {
+        conPort = hostPort
+    }
+
+    hLink, err := netlink.LinkByName(hostPort)
+    if err != nil {
+        return nil, fmt.Errorf("failed to lookup device %q: %v", hostPort, err)
+    }
+
+    dev, err := saveDevice(hLink, conPort)
+    if err != nil {
+        return nil, err
+    }
+
+    netns, err := ns.GetNS(nspath)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open netns %q: %v", nspath, err)
+    }
+    defer netns.Close()
+
+    if err = netlink.LinkSetNsFd(hLink, int(netns.Fd())); err != nil {
+        return nil, fmt.Errorf("failed to move device %q to netns: %v", hostPort, err)
+    }
+
+    err = netns.Do(func(hostNS ns.NetNS) error {
+        err := restoreDevice(hostPort, conPort, dev)
+        if err == nil {
+            return nil
+        }
+        // give the device back, a half configured uplink is useless in the pod
+        if l, lerr := netlink.LinkByName(conPort); lerr == nil {
+            netlink.LinkSetName(l, hostPort)
+        }
+        if l, lerr := netlink.LinkByName(hostPort); lerr == nil {
+            netlink.LinkSetNsFd(l, int(hostNS.Fd()))
+        }
+        return err
+    })
+    if err != nil {
+        restoreDevice(hostPort, hostPort, dev)
+        return nil, err
+    }
+
+    return dev, nil
+}
+
+// MoveDeviceToHost is the reverse of MoveDeviceToNS. If the pod netns is
+// already gone the kernel has returned the device on its own, so only its
+// configuration is restored.
+func MoveDeviceToHost(dev *state.DeviceState, nspath string) error {
+    netns, err := ns.GetNS(nspath)
+    if err == nil {
+        err = netns.Do(func(hostNS ns.NetNS) error {
+            l, err := netlink.LinkByName(dev.ContainerPort)
+            if err != nil {
+                return fmt.Errorf("failed to lookup %q in %q: %v", dev.ContainerPort, nspath, err)
+            }
+            netlink.LinkSetDown(l)
+            // rename before leaving, container_port may be taken on the host
+            if err = netlink.LinkSetName(l, dev.Name); err != nil {
+                return fmt.Errorf("failed to rename %q to %q: %v", dev.ContainerPort, dev.Name, err)
+            }
+            return netlink.LinkSetNsFd(l, int(hostNS.Fd()))
+        })
+        netns.Close()
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to move device %q back to host: %v\r\n", dev.Name, err)
+        }
+    }
+
+    name := dev.Name
+    if _, lerr := netlink.LinkByName(name); lerr != nil {
+        // returned by the kernel, it still carries the pod side name
+        name = dev.ContainerPort
+    }
+    return restoreDevice(name, dev.Name, dev)
+}
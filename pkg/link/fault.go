@@ -0,0 +1,262 @@
+package link
+
+import (
+    "fmt"
+    "net"
+    "time"
+    "encoding/binary"
+
+    "github.com/containernetworking/plugins/pkg/ns"
+    "github.com/vishvananda/netlink"
+    "golang.org/x/sys/unix"
+)
+
+// Impairment is what the root qdisc of a link does to what it sends:
+// netem delays, loses, duplicates, corrupts or reorders it, a tbf above
+// caps its rate.
+type Impairment struct {
+    Delay time.Duration
+    Jitter time.Duration
+    // in %
+    Loss float32
+    Duplicate float32
+    Corrupt float32
+    Reorder float32
+    // bytes per second, 0 for no cap
+    Rate uint64
+}
+
+func (imp *Impairment) hasNetem() bool {
+    return imp.Delay != 0 || imp.Loss != 0 || imp.Duplicate != 0 || imp.Corrupt != 0 || imp.Reorder != 0
+}
+
+// DropRule drops the IPv4 packets that match it, every packet when it is
+// empty.
+type DropRule struct {
+    Protocol uint8
+    Src *net.IPNet
+    Dst *net.IPNet
+    Sport uint16
+    Dport uint16
+}
+
+func (r *DropRule) empty() bool {
+    return r.Protocol == 0 && r.Src == nil && r.Dst == nil && r.Sport == 0 && r.Dport == 0
+}
+
+// withLink runs fn on the link name of nspath, "" being the host.
+func withLink(name string, nspath string, fn func(l netlink.Link) error) error {
+    run := func() error {
+        l, err := netlink.LinkByName(name)
+        if err != nil {
+            return fmt.Errorf("failed to lookup %q: %v", name, err)
+        }
+        return fn(l)
+    }
+    if nspath == "" {
+        return run()
+    }
+    return ns.WithNetNSPath(nspath, func(_ ns.NetNS) error {
+        return run()
+    })
+}
+
+func tbf(index int, parent uint32, rate uint64) *netlink.Tbf {
+    // a burst of 10ms, never less than a jumbo frame
+    burst := rate / 100
+    if burst < 10000 {
+        burst = 10000
+    }
+    buffer := float64(burst) * float64(time.Second / time.Microsecond) / float64(rate) * netlink.TickInUsec()
+    return &netlink.Tbf{
+        QdiscAttrs: netlink.QdiscAttrs{
+            LinkIndex: index,
+            Handle: netlink.MakeHandle(1, 0),
+            Parent: parent,
+        },
+        Rate: rate,
+        // 50ms of queue
+        Limit: uint32(rate / 20 + burst),
+        Buffer: uint32(buffer),
+    }
+}
+
+// SetImpairment replaces the root qdisc of the link name of nspath by
+// imp.
+func SetImpairment(name string, nspath string, imp *Impairment) error {
+    return withLink(name, nspath, func(l netlink.Link) error {
+        index := l.Attrs().Index
+        netemParent, netemHandle := uint32(netlink.HANDLE_ROOT), netlink.MakeHandle(1, 0)
+        if imp.Rate != 0 {
+            if err := netlink.QdiscReplace(tbf(index, netlink.HANDLE_ROOT, imp.Rate)); err != nil {
+                return fmt.Errorf("failed to cap rate of %q: %v", name, err)
+            }
+            // netem goes under the single class of the tbf
+            netemParent, netemHandle = netlink.MakeHandle(1, 1), netlink.MakeHandle(10, 0)
+        }
+        if !imp.hasNetem() {
+            return nil
+        }
+        netem := netlink.NewNetem(netlink.QdiscAttrs{
+            LinkIndex: index,
+            Handle: netemHandle,
+            Parent: netemParent,
+        }, netlink.NetemQdiscAttrs{
+            Latency: uint32(imp.Delay / time.Microsecond),
+            Jitter: uint32(imp.Jitter / time.Microsecond),
+            Loss: imp.Loss,
+            Duplicate: imp.Duplicate,
+            CorruptProb: imp.Corrupt,
+            ReorderProb: imp.Reorder,
+        })
+        if err := netlink.QdiscReplace(netem); err != nil {
+            if imp.Rate != 0 {
+                netlink.QdiscDel(tbf(index, netlink.HANDLE_ROOT, imp.Rate))
+            }
+            return fmt.Errorf("failed to impair %q: %v", name, err)
+        }
+        return nil
+    })
+}
+
+// ClearImpairment gives the link its default root qdisc back.
+func ClearImpairment(name string, nspath string) error {
+    return withLink(name, nspath, func(l netlink.Link) error {
+        qdiscs, err := netlink.QdiscList(l)
+        if err != nil {
+            return err
+        }
+        for _, q := range qdiscs {
+            if q.Attrs().Parent == netlink.HANDLE_ROOT && (q.Type() == "netem" || q.Type() == "tbf") {
+                return netlink.QdiscDel(q)
+            }
+        }
+        return nil
+    })
+}
+
+func clsact(index int) *netlink.GenericQdisc {
+    return &netlink.GenericQdisc{
+        QdiscAttrs: netlink.QdiscAttrs{
+            LinkIndex: index,
+            Handle: netlink.MakeHandle(0xffff, 0),
+            Parent: netlink.HANDLE_CLSACT,
+        },
+        QdiscType: "clsact",
+    }
+}
+
+// ingressQdisc returns the type of the qdisc at ffff: of the link, clsact
+// for drop rules, ingress for the redirect of a TAP, "" when there is none.
+func ingressQdisc(l netlink.Link) (string, error) {
+    qdiscs, err := netlink.QdiscList(l)
+    if err != nil {
+        return "", err
+    }
+    for _, q := range qdiscs {
+        if q.Attrs().Handle == netlink.MakeHandle(0xffff, 0) {
+            return q.Type(), nil
+        }
+    }
+    return "", nil
+}
+
+func u32Key(off int32, val []byte, mask []byte) netlink.TcU32Key {
+    return netlink.TcU32Key{
+        Off: off,
+        Val: binary.BigEndian.Uint32(val),
+        Mask: binary.BigEndian.Uint32(mask),
+    }
+}
+
+// u32Sel matches r against an IPv4 header without options.
+func u32Sel(r *DropRule) *netlink.TcU32Sel {
+    sel := &netlink.TcU32Sel{Flags: 1} // TC_U32_TERMINAL
+    if r.Protocol != 0 {
+        sel.Keys = append(sel.Keys, u32Key(8, []byte{0, r.Protocol, 0, 0}, []byte{0, 0xff, 0, 0}))
+    }
+    if r.Src != nil {
+        sel.Keys = append(sel.Keys, u32Key(12, r.Src.IP.To4(), r.Src.Mask))
+    }
+    if r.Dst != nil {
+        sel.Keys = append(sel.Keys, u32Key(16, r.Dst.IP.To4(), r.Dst.Mask))
+    }
+    if r.Sport != 0 || r.Dport != 0 {
+        val, mask := make([]byte, 4), make([]byte, 4)
+        binary.BigEndian.PutUint16(val, r.Sport)
+        binary.BigEndian.PutUint16(val[2:], r.Dport)
+        if r.Sport != 0 {
+            mask[0], mask[1] = 0xff, 0xff
+        }
+        if r.Dport != 0 {
+            mask[2], mask[3] = 0xff, 0xff
+        }
+        sel.Keys = append(sel.Keys, u32Key(20, val, mask))
+    }
+    return sel
+}
+
+// AddDropRules drops what the link name of nspath sends when it matches
+// one of egress, and what it receives when it matches one of ingress.
+func AddDropRules(name string, nspath string, egress []DropRule, ingress []DropRule) error {
+    return withLink(name, nspath, func(l netlink.Link) error {
+        index := l.Attrs().Index
+        // the redirect of a TAP steals every packet before any filter
+        // added after it, and leaves no room for clsact
+        switch qdisc, err := ingressQdisc(l); {
+            case err != nil:
+                return fmt.Errorf("failed to list qdiscs of %q: %v", name, err)
+            case qdisc == "clsact":
+                return fmt.Errorf("%q has drop rules already", name)
+            case qdisc != "":
+                return fmt.Errorf("%q has an %s qdisc, a TAP redirect, no drop rule can go before it", name, qdisc)
+        }
+        if err := netlink.QdiscAdd(clsact(index)); err != nil {
+            return fmt.Errorf("failed to add clsact qdisc to %q: %v", name, err)
+        }
+        add := func(parent uint32, rules []DropRule) error {
+            for i := range rules {
+                r := &rules[i]
+                filter := &netlink.U32{
+                    FilterAttrs: netlink.FilterAttrs{
+                        LinkIndex: index,
+                        Parent: parent,
+                        Priority: uint16(i + 1),
+                        Protocol: unix.ETH_P_IP,
+                    },
+                    Actions: []netlink.Action{&netlink.GenericAction{
+                        ActionAttrs: netlink.ActionAttrs{Action: netlink.TC_ACT_SHOT},
+                    }},
+                }
+                if r.empty() {
+                    filter.Protocol = unix.ETH_P_ALL
+                } else {
+                    filter.Sel = u32Sel(r)
+                }
+                if err := netlink.FilterAdd(filter); err != nil {
+                    return fmt.Errorf("failed to add drop filter to %q: %v", name, err)
+                }
+            }
+            return nil
+        }
+        err := add(netlink.HANDLE_MIN_EGRESS, egress)
+        if err == nil {
+            err = add(netlink.HANDLE_MIN_INGRESS, ingress)
+        }
+        if err != nil {
+            netlink.QdiscDel(clsact(index))
+        }
+        return err
+    })
+}
+
+// ClearDropRules removes the clsact qdisc of the link, with its filters.
+// Any other qdisc at ffff: is left alone.
+func ClearDropRules(name string, nspath string) error {
+    return withLink(name, nspath, func(l netlink.Link) error {
+        if qdisc, err := ingressQdisc(l); err != nil || qdisc != "clsact" {
+            return err
+        }
+        return netlink.QdiscDel(clsact(l.Attrs().Index))
+    })
+}
@@ -0,0 +1,45 @@
+package link
+
+import (
+    "net"
+    "reflect"
+    "testing"
+
+    "github.com/vishvananda/netlink"
+)
+
+func TestU32SelMatchAll(t *testing.T) {
+    sel := u32Sel(&DropRule{})
+    if sel.Flags != 1 || len(sel.Keys) != 0 {
+        t.Fatalf("got %+v, want a terminal selector without keys", sel)
+    }
+}
+
+func TestU32SelIPv4Header(t *testing.T) {
+    _, src, _ := net.ParseCIDR("10.0.0.0/8")
+    _, dst, _ := net.ParseCIDR("192.168.1.7/32")
+    sel := u32Sel(&DropRule{Protocol: 6, Src: src, Dst: dst, Sport: 1, Dport: 2})
+    // protocol, addresses and then the ports, right after a header
+    // without options
+    want := []netlink.TcU32Key{
+        {Off: 8, Val: 0x00060000, Mask: 0x00ff0000},
+        {Off: 12, Val: 0x0a000000, Mask: 0xff000000},
+        {Off: 16, Val: 0xc0a80107, Mask: 0xffffffff},
+        {Off: 20, Val: 0x00010002, Mask: 0xffffffff},
+    }
+    if !reflect.DeepEqual(sel.Keys, want) {
+        t.Fatalf("got %+v, want %+v", sel.Keys, want)
+    }
+}
+
+func TestU32SelOnePort(t *testing.T) {
+    // both ports share a word, the other one must stay unmatched
+    dport := u32Sel(&DropRule{Dport: 53}).Keys
+    if len(dport) != 1 || dport[0] != (netlink.TcU32Key{Off: 20, Val: 53, Mask: 0x0000ffff}) {
+        t.Errorf("dport 53: got %+v", dport)
+    }
+    sport := u32Sel(&DropRule{Sport: 179}).Keys
+    if len(sport) != 1 || sport[0] != (netlink.TcU32Key{Off: 20, Val: 179 << 16, Mask: 0xffff0000}) {
+        t.Errorf("sport 179: got %+v", sport)
+    }
+}
@@ -0,0 +1,103 @@
+package link
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/vishvananda/netlink"
+)
+
+const (
+    OrphanVeth = "veth"
+    OrphanBridge = "bridge"
+    OrphanTunnel = "tunnel"
+    OrphanUplink = "uplink"
+)
+
+// Orphan is a host link unicni created and nothing uses anymore.
+type Orphan struct {
+    Kind string         `json:"kind"`
+    Name string         `json:"name"`
+    Index int           `json:"index"`
+    Reason string       `json:"reason"`
+}
+
+// ownerBridge returns the bridge an uplink or a host tunnel was made for.
+func ownerBridge(l netlink.Link) (string, string, bool) {
+    alias := l.Attrs().Alias
+    switch {
+        case strings.HasPrefix(alias, uplinkAliasPrefix):
+            return OrphanUplink, strings.TrimPrefix(alias, uplinkAliasPrefix), true
+        case strings.HasPrefix(alias, tunnelAlias("")):
+            return OrphanTunnel, strings.TrimPrefix(alias, tunnelAlias("")), true
+    }
+    return "", "", false
+}
+
+// FindOrphans lists the host links unicni left behind: host veths out
+// of any bridge, bridges without pod port, and uplinks or tunnels of a
+// missing bridge. A bridge is unicni's when it carries its alias or
+// owned tells so, bridges inUse are never listed.
+func FindOrphans(owned func(brName string) bool, inUse func(brName string) bool) ([]Orphan, error) {
+    links, err := netlink.LinkList()
+    if err != nil {
+        return nil, fmt.Errorf("failed to list links: %v", err)
+    }
+
+    names := make(map[string]bool)
+    podPorts := make(map[int]int)
+    for _, l := range links {
+        names[l.Attrs().Name] = true
+        if master := l.Attrs().MasterIndex; master != 0 && !IsInfraPort(l) {
+            podPorts[master]++
+        }
+    }
+
+    var orphans []Orphan
+    for _, l := range links {
+        attrs := l.Attrs()
+        switch {
+            case l.Type() == "veth" && strings.HasPrefix(attrs.Name, defaultPrefix) && attrs.MasterIndex == 0:
+                // the host end of every pod port is enslaved right away
+                orphans = append(orphans, Orphan{OrphanVeth, attrs.Name, attrs.Index, "host veth out of any bridge"})
+            case l.Type() == "bridge":
+                if attrs.Alias != bridgeAlias && !owned(attrs.Name) {
+                    continue
+                }
+                if podPorts[attrs.Index] == 0 && !inUse(attrs.Name) {
+                    orphans = append(orphans, Orphan{OrphanBridge, attrs.Name, attrs.Index, "bridge without pod port"})
+                }
+            default:
+                kind, brName, ok := ownerBridge(l)
+                if !ok {
+                    continue
+                }
+                if !names[brName] {
+                    orphans = append(orphans, Orphan{kind, attrs.Name, attrs.Index, fmt.Sprintf("bridge %s is gone", brName)})
+                }
+        }
+    }
+    return orphans, nil
+}
+
+// RemoveOrphan deletes the orphan, unless its name now belongs to
+// another link. The uplinks and tunnels of a bridge go along with it.
+func RemoveOrphan(o Orphan) error {
+    l, err := netlink.LinkByIndex(o.Index)
+    if err != nil || l.Attrs().Name != o.Name {
+        return nil
+    }
+    if o.Kind == OrphanBridge {
+        links, err := netlink.LinkList()
+        if err != nil {
+            return err
+        }
+        for _, member := range links {
+            if member.Attrs().MasterIndex == o.Index && IsInfraPort(member) {
+                netlink.LinkDel(member)
+            }
+        }
+        return DeleteBridge(o.Name)
+    }
+    return netlink.LinkDel(l)
+}
@@ -0,0 +1,213 @@
+package link
+
+import (
+    "fmt"
+    "syscall"
+
+    "github.com/containernetworking/plugins/pkg/ns"
+    "github.com/vishvananda/netlink"
+)
+
+// PortInfo is what the kernel tells about one end of a port.
+type PortInfo struct {
+    Name string         `json:"name"`
+    Index int           `json:"index"`
+    Type string         `json:"type"`
+    Mac string          `json:"mac,omitempty"`
+    Up bool             `json:"up"`
+    Alias string        `json:"alias,omitempty"`
+    Addrs []string      `json:"addrs,omitempty"`
+    // host side only
+    Master string       `json:"master,omitempty"`
+    // pod side only, the host link it is paired with or stacked on
+    PeerIndex int       `json:"peer_index,omitempty"`
+    Stats *PortStats    `json:"stats,omitempty"`
+}
+
+// PortStats are the counters of a link since it was created.
+type PortStats struct {
+    RxBytes uint64      `json:"rx_bytes"`
+    TxBytes uint64      `json:"tx_bytes"`
+    RxPackets uint64    `json:"rx_packets"`
+    TxPackets uint64    `json:"tx_packets"`
+    RxErrors uint64     `json:"rx_errors"`
+    TxErrors uint64     `json:"tx_errors"`
+    RxDropped uint64    `json:"rx_dropped"`
+    TxDropped uint64    `json:"tx_dropped"`
+}
+
+// FdbEntry is one entry of the forwarding database of a bridge.
+type FdbEntry struct {
+    Port string         `json:"port"`
+    Mac string          `json:"mac"`
+    Static bool         `json:"static"`
+}
+
+// VlanEntry is one VLAN of a bridge member.
+type VlanEntry struct {
+    Port string         `json:"port"`
+    Vid int             `json:"vid"`
+    Pvid bool           `json:"pvid"`
+    Untagged bool       `json:"untagged"`
+}
+
+// BridgeInfo describes a bridge with its members, FDB and VLANs.
+type BridgeInfo struct {
+    PortInfo
+    Members []PortInfo  `json:"members"`
+    Fdb []FdbEntry      `json:"fdb"`
+    Vlans []VlanEntry   `json:"vlans"`
+}
+
+func portInfo(l netlink.Link) *PortInfo {
+    attrs := l.Attrs()
+    info := &PortInfo{
+        Name: attrs.Name,
+        Index: attrs.Index,
+        Type: l.Type(),
+        Mac: attrs.HardwareAddr.String(),
+        Up: attrs.Flags & syscall.IFF_UP != 0,
+        Alias: attrs.Alias,
+        PeerIndex: attrs.ParentIndex,
+    }
+    if st := attrs.Statistics; st != nil {
+        info.Stats = &PortStats{
+            RxBytes: st.RxBytes,
+            TxBytes: st.TxBytes,
+            RxPackets: st.RxPackets,
+            TxPackets: st.TxPackets,
+            RxErrors: st.RxErrors,
+            TxErrors: st.TxErrors,
+            RxDropped: st.RxDropped,
+            TxDropped: st.TxDropped,
+        }
+    }
+    if addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL); err == nil {
+        for _, a := range addrs {
+            info.Addrs = append(info.Addrs, a.IPNet.String())
+        }
+    }
+    return info
+}
+
+// HostPort describes a link of the host, with the bridge it belongs to.
+func HostPort(index int) (*PortInfo, error) {
+    l, err := netlink.LinkByIndex(index)
+    if err != nil {
+        return nil, err
+    }
+    info := portInfo(l)
+    info.PeerIndex = 0
+    if master := l.Attrs().MasterIndex; master != 0 {
+        if m, err := netlink.LinkByIndex(master); err == nil {
+            info.Master = m.Attrs().Name
+        }
+    }
+    return info, nil
+}
+
+// PodPort describes a link of the pod. PeerIndex is the host veth peer,
+// the parent of a macvlan or macvtap, 0 for a moved device.
+func PodPort(name string, nspath string) (*PortInfo, error) {
+    netns, err := ns.GetNS(nspath)
+    if err != nil {
+        return nil, err
+    }
+    defer netns.Close()
+
+    var info *PortInfo
+    err = netns.Do(func (_ ns.NetNS) error {
+        l, err := netlink.LinkByName(name)
+        if err != nil {
+            return err
+        }
+        info = portInfo(l)
+        // a TAP reaches the host through the veth marked with its name
+        if v, err := netlink.LinkByAlias(tapAlias(name)); err == nil && v != nil {
+            info.PeerIndex = v.Attrs().ParentIndex
+        }
+        return nil
+    })
+    return info, err
+}
+
+// BridgeMembers counts the links enslaved to the bridge name.
+func BridgeMembers(name string) (int, error) {
+    br, err := BridgeByName(name)
+    if err != nil {
+        return 0, err
+    }
+    links, err := netlink.LinkList()
+    if err != nil {
+        return 0, fmt.Errorf("failed to list links: %v", err)
+    }
+    n := 0
+    for _, l := range links {
+        if l.Attrs().MasterIndex == br.Attrs().Index {
+            n++
+        }
+    }
+    return n, nil
+}
+
+// InspectBridge returns the bridge with what the kernel knows about it.
+func InspectBridge(name string) (*BridgeInfo, error) {
+    br, err := BridgeByName(name)
+    if err != nil {
+        return nil, err
+    }
+    info := &BridgeInfo{
+        PortInfo: *portInfo(br),
+        Members: []PortInfo{},
+        Fdb: []FdbEntry{},
+        Vlans: []VlanEntry{},
+    }
+    info.PeerIndex = 0
+
+    links, err := netlink.LinkList()
+    if err != nil {
+        return nil, fmt.Errorf("failed to list links: %v", err)
+    }
+    names := make(map[int]string)
+    for _, l := range links {
+        if l.Attrs().MasterIndex != br.Attrs().Index {
+            continue
+        }
+        member := portInfo(l)
+        member.PeerIndex = 0
+        member.Master = name
+        info.Members = append(info.Members, *member)
+        names[l.Attrs().Index] = l.Attrs().Name
+
+        neighs, err := netlink.NeighList(l.Attrs().Index, syscall.AF_BRIDGE)
+        if err != nil {
+            continue
+        }
+        for _, n := range neighs {
+            info.Fdb = append(info.Fdb, FdbEntry{
+                Port: l.Attrs().Name,
+                Mac: n.HardwareAddr.String(),
+                Static: n.State & netlink.NUD_PERMANENT != 0,
+            })
+        }
+    }
+
+    vlans, err := netlink.BridgeVlanList()
+    if err == nil {
+        for index, list := range vlans {
+            port, ok := names[int(index)]
+            if !ok {
+                continue
+            }
+            for _, v := range list {
+                info.Vlans = append(info.Vlans, VlanEntry{
+                    Port: port,
+                    Vid: int(v.Vid),
+                    Pvid: v.PortVID(),
+                    Untagged: v.EngressUntag(),
+                })
+            }
+        }
+    }
+    return info, nil
+}
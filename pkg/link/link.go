@@ -1,8 +1,11 @@
 package link
 
 import (
+    "fmt"
+
     "github.com/vishvananda/netlink"
     "github.com/containernetworking/cni/pkg/types/current"
+    "github.com/containernetworking/plugins/pkg/ns"
 )
 
 func Interface(l netlink.Link, sandbox string) *current.Interface {
@@ -19,3 +22,45 @@ func Interface(l netlink.Link, sandbox string) *current.Interface {
         }
     }
 }
+
+// InterfaceInNS describes the link name of the namespace, the link is
+// looked up there so that its MAC is the final one.
+func InterfaceInNS(name string, nspath string) (*current.Interface, error) {
+    netns, err := ns.GetNS(nspath)
+    if err != nil {
+        return nil, err
+    }
+    defer netns.Close()
+
+    var iface *current.Interface
+    err = netns.Do(func (_ ns.NetNS) error {
+        l, err := netlink.LinkByName(name)
+        if err != nil {
+            return err
+        }
+        iface = Interface(l, nspath)
+        return nil
+    })
+    return iface, err
+}
+
+// SetLinkUp sets the link name of nspath up or down, nspath "" is the
+// host.
+func SetLinkUp(name string, nspath string, up bool) error {
+    set := func() error {
+        l, err := netlink.LinkByName(name)
+        if err != nil {
+            return fmt.Errorf("failed to lookup %q: %v", name, err)
+        }
+        if up {
+            return netlink.LinkSetUp(l)
+        }
+        return netlink.LinkSetDown(l)
+    }
+    if nspath == "" {
+        return set()
+    }
+    return ns.WithNetNSPath(nspath, func(_ ns.NetNS) error {
+        return set()
+    })
+}
@@ -2,9 +2,19 @@ package link
 
 import (
     "fmt"
+    "sync"
+    "runtime"
+    "strings"
+    "io/ioutil"
 
     "github.com/containernetworking/plugins/pkg/ns"
     "github.com/vishvananda/netlink"
+    "golang.org/x/sys/unix"
+)
+
+const (
+    macvtapDevPath = "/dev/tap%d"
+    macvtapSysDev = "/sys/class/net/%s/macvtap/tap%d/dev"
 )
 
 func modeFromString(s string) (netlink.MacvlanMode, error) {
@@ -24,6 +34,69 @@ func modeFromString(s string) (netlink.MacvlanMode, error) {
 
 
 func CreateMacvlanInNS(hostPort string, conPort string, mode string, nspath string) (cLink netlink.Link, err error) {
+    return createMacvlanInNS(hostPort, conPort, mode, false, nspath)
+}
+
+// CreateMacvtapInNS works as CreateMacvlanInNS, it also returns the path of
+// the character device the workload opens, which is /dev/tap<ifindex>.
+func CreateMacvtapInNS(hostPort string, conPort string, mode string, nspath string) (cLink netlink.Link, devPath string, err error) {
+    cLink, err = createMacvlanInNS(hostPort, conPort, mode, true, nspath)
+    if err != nil {
+        return nil, "", err
+    }
+    return cLink, fmt.Sprintf(macvtapDevPath, cLink.Attrs().Index), nil
+}
+
+// MacvtapDevNum returns the major and minor number of the character
+// device of the macvtap conPort of nspath, for workloads which have to
+// mknod it in their own /dev. The minor is not the ifindex, it is read
+// from a sysfs mounted in the netns, as the one of the host only shows
+// the links of the host.
+func MacvtapDevNum(conPort string, nspath string) (major int, minor int, err error) {
+    netns, err := ns.GetNS(nspath)
+    if err != nil {
+        return 0, 0, err
+    }
+    defer netns.Close()
+
+    // on a thread of its own, it dies with the goroutine and its mounts
+    // with it
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        runtime.LockOSThread()
+
+        if err = netns.Set(); err != nil {
+            return
+        }
+        if err = unix.Unshare(unix.CLONE_NEWNS); err != nil {
+            return
+        }
+        if err = unix.Mount("", "/", "", unix.MS_SLAVE | unix.MS_REC, ""); err != nil {
+            return
+        }
+        if err = unix.Mount("sysfs", "/sys", "sysfs", 0, ""); err != nil {
+            return
+        }
+        var l netlink.Link
+        if l, err = netlink.LinkByName(conPort); err != nil {
+            return
+        }
+        var raw []byte
+        raw, err = ioutil.ReadFile(fmt.Sprintf(macvtapSysDev, conPort, l.Attrs().Index))
+        if err != nil {
+            return
+        }
+        if _, err = fmt.Sscanf(strings.TrimSpace(string(raw)), "%d:%d", &major, &minor); err != nil {
+            err = fmt.Errorf("bad device number %q of %s", raw, conPort)
+        }
+    }()
+    wg.Wait()
+    return major, minor, err
+}
+
+func createMacvlanInNS(hostPort string, conPort string, mode string, macvtap bool, nspath string) (cLink netlink.Link, err error) {
     set_mode := netlink.MACVLAN_MODE_VEPA
     if mode != "" {
         set_mode,err = modeFromString(mode) 
@@ -46,7 +119,7 @@ func CreateMacvlanInNS(hostPort string, conPort string, mode string, nspath stri
     netns,_ := ns.GetNS(nspath)
     defer netns.Close()
 
-    tmpLink := &netlink.Macvlan{
+    macvlan := netlink.Macvlan{
         LinkAttrs: netlink.LinkAttrs{
             MTU:         defaultMtu,
             Name:        tmpName,
@@ -55,9 +128,13 @@ func CreateMacvlanInNS(hostPort string, conPort string, mode string, nspath stri
         },
         Mode: set_mode,
     }
+    var tmpLink netlink.Link = &macvlan
+    if macvtap {
+        tmpLink = &netlink.Macvtap{Macvlan: macvlan}
+    }
 
     if err = netlink.LinkAdd(tmpLink); err != nil {
-         return nil, fmt.Errorf("failed to create macvlan: %v", err)
+         return nil, fmt.Errorf("failed to create %s: %v", tmpLink.Type(), err)
     }
 
     // fixed the name in namespace
@@ -69,7 +146,7 @@ func CreateMacvlanInNS(hostPort string, conPort string, mode string, nspath stri
         }
         if err != nil {
             _ = netlink.LinkDel(tmpLink)
-            return fmt.Errorf("failed to rename macvlan to %q: %v", conPort, err)
+            return fmt.Errorf("failed to rename %s to %q: %v", tmpLink.Type(), conPort, err)
         }
 
         cLink, err = netlink.LinkByName(conPort)
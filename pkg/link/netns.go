@@ -0,0 +1,92 @@
+package link
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "runtime"
+    "path/filepath"
+
+    "github.com/containernetworking/plugins/pkg/ns"
+    "github.com/vishvananda/netlink"
+    "golang.org/x/sys/unix"
+)
+
+const netnsRunDir = "/var/run/netns"
+
+// NetnsPath is where the named netns name is mounted, as ip-netns does.
+func NetnsPath(name string) string {
+    return filepath.Join(netnsRunDir, name)
+}
+
+// CreateNamedNS creates the netns name under /var/run/netns, or returns
+// the path of the one already there.
+func CreateNamedNS(name string) (string, error) {
+    nspath := NetnsPath(name)
+    if netns, err := ns.GetNS(nspath); err == nil {
+        netns.Close()
+        return nspath, nil
+    }
+
+    if err := os.MkdirAll(netnsRunDir, 0755); err != nil {
+        return "", err
+    }
+    f, err := os.Create(nspath)
+    if err != nil {
+        return "", err
+    }
+    f.Close()
+
+    // unshare on a thread of its own, it dies with the goroutine
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        runtime.LockOSThread()
+
+        var origNS ns.NetNS
+        origNS, err = ns.GetCurrentNS()
+        if err != nil {
+            return
+        }
+        defer origNS.Close()
+
+        if err = unix.Unshare(unix.CLONE_NEWNET); err != nil {
+            return
+        }
+        defer origNS.Set()
+
+        threadNS := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+        err = unix.Mount(threadNS, nspath, "none", unix.MS_BIND, "")
+    }()
+    wg.Wait()
+
+    if err != nil {
+        unix.Unmount(nspath, unix.MNT_DETACH)
+        os.Remove(nspath)
+        return "", fmt.Errorf("failed to create netns %s: %v", name, err)
+    }
+
+    // lo is down in a new netns
+    err = ns.WithNetNSPath(nspath, func(_ ns.NetNS) error {
+        lo, err := netlink.LinkByName("lo")
+        if err != nil {
+            return err
+        }
+        return netlink.LinkSetUp(lo)
+    })
+    return nspath, err
+}
+
+// DeleteNamedNS unmounts and removes the netns name. The links in it go
+// along with it.
+func DeleteNamedNS(name string) error {
+    nspath := NetnsPath(name)
+    if _, err := os.Stat(nspath); os.IsNotExist(err) {
+        return nil
+    }
+    if err := unix.Unmount(nspath, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+        return fmt.Errorf("failed to unmount netns %s: %v", name, err)
+    }
+    return os.Remove(nspath)
+}
@@ -0,0 +1,200 @@
+package link
+
+import (
+    "fmt"
+    "os"
+    "net"
+    "strings"
+    "syscall"
+    "hash/fnv"
+
+    "github.com/vishvananda/netlink"
+)
+
+const (
+    uplinkAliasPrefix = "uplink:"
+    overlayPrefix = "uvx"
+    maxVNI = 0xffffff
+)
+
+// OverlayConfig describes the VXLAN joining a group bridge to the
+// same bridge on the peer nodes.
+type OverlayConfig struct {
+    VNI uint32
+    Local net.IP
+    Underlay string
+    DstPort int
+    Peers []net.IP
+    // Peers is every peer, the entries of the others are removed
+    Complete bool
+}
+
+// uplinks are bridge members leading to other nodes, they are tagged
+// by alias with the bridge they serve.
+func uplinkAlias(brName string) string {
+    return uplinkAliasPrefix + brName
+}
+
+func isUplink(l netlink.Link) bool {
+    return strings.HasPrefix(l.Attrs().Alias, uplinkAliasPrefix)
+}
+
+// IsInfraPort tells whether a bridge member is an uplink or a host
+// tunnel rather than the host end of a pod port.
+func IsInfraPort(l netlink.Link) bool {
+    return isUplink(l) || strings.HasPrefix(l.Attrs().Alias, tunnelAlias(""))
+}
+
+// UplinkID returns the VLAN or VNI of the uplink of the bridge, 0 when it
+// has none yet.
+func (br *Bridge)UplinkID() int {
+    links, err := netlink.LinkList()
+    if err != nil {
+        return 0
+    }
+    for _, l := range links {
+        if l.Attrs().MasterIndex != br.Data.Attrs().Index || l.Attrs().Alias != uplinkAlias(br.Name) {
+            continue
+        }
+        switch u := l.(type) {
+            case *netlink.Vlan:
+                return u.VlanId
+            case *netlink.Vxlan:
+                return u.VxlanId
+        }
+    }
+    return 0
+}
+
+func groupHash(cred string, group string, chanType string) uint32 {
+    h := fnv.New32a()
+    h.Write([]byte(cred + "/" + group + "/" + chanType))
+    return h.Sum32()
+}
+
+// OverlayVNI hashes a group channel into a VNI, the first one tried when
+// it is allocated one.
+func OverlayVNI(cred string, group string, chanType string) uint32 {
+    vni := groupHash(cred, group, chanType) & maxVNI
+    if vni == 0 {
+        vni = 1
+    }
+    return vni
+}
+
+func OverlayName(vni uint32) string {
+    return fmt.Sprintf("%s%06x", overlayPrefix, vni)
+}
+
+// syncPeers makes the head-end replication entries of the VXLAN match
+// the peer list, broadcast and unknown traffic goes to every peer. The
+// entries of peers not listed are only removed when the list is
+// complete, a partial one only adds.
+func syncPeers(vx netlink.Link, peers []net.IP, complete bool) error {
+    zeroMac := net.HardwareAddr{0, 0, 0, 0, 0, 0}
+    wanted := make(map[string]bool)
+    for _, peer := range peers {
+        wanted[peer.String()] = true
+    }
+
+    neighs, err := netlink.NeighList(vx.Attrs().Index, syscall.AF_BRIDGE)
+    if err != nil {
+        return fmt.Errorf("failed to list fdb of %q: %v", vx.Attrs().Name, err)
+    }
+    for _, n := range neighs {
+        if n.HardwareAddr.String() != zeroMac.String() || n.IP == nil {
+            continue
+        }
+        if wanted[n.IP.String()] {
+            delete(wanted, n.IP.String())
+            continue
+        }
+        if complete {
+            netlink.NeighDel(&n)
+        }
+    }
+
+    for _, peer := range peers {
+        if !wanted[peer.String()] {
+            continue
+        }
+        err := netlink.NeighAppend(&netlink.Neigh{
+            LinkIndex: vx.Attrs().Index,
+            Family: syscall.AF_BRIDGE,
+            State: netlink.NUD_PERMANENT,
+            Flags: netlink.NTF_SELF,
+            IP: peer,
+            HardwareAddr: zeroMac,
+        })
+        if err != nil && err != syscall.EEXIST {
+            return fmt.Errorf("failed to add peer %s to %q: %v", peer, vx.Attrs().Name, err)
+        }
+    }
+    return nil
+}
+
+// SyncOverlayPeers refreshes the peers of every overlay of the node.
+func SyncOverlayPeers(peers []net.IP, complete bool) error {
+    links, err := netlink.LinkList()
+    if err != nil {
+        return err
+    }
+    for _, l := range links {
+        if _, ok := l.(*netlink.Vxlan); !ok || !isUplink(l) {
+            continue
+        }
+        if err = syncPeers(l, peers, complete); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// EnsureOverlay attaches the VXLAN to the bridge if not done yet,
+// and refreshes its peers.
+func (br *Bridge)EnsureOverlay(cfg *OverlayConfig) (netlink.Link, error) {
+    name := OverlayName(cfg.VNI)
+    vx, err := netlink.LinkByName(name)
+    if err != nil {
+        port := cfg.DstPort
+        if port == 0 {
+            port = defaultVxlanPort
+        }
+        vxlan := &netlink.Vxlan{
+            LinkAttrs: netlink.LinkAttrs{
+                Name: name,
+                MTU: defaultMtu,
+            },
+            VxlanId: int(cfg.VNI),
+            SrcAddr: cfg.Local,
+            Port: port,
+            Learning: true,
+        }
+        if cfg.Underlay != "" {
+            uLink, err := netlink.LinkByName(cfg.Underlay)
+            if err != nil {
+                return nil, fmt.Errorf("failed to lookup underlay %q: %v", cfg.Underlay, err)
+            }
+            vxlan.VtepDevIndex = uLink.Attrs().Index
+        }
+        if err = netlink.LinkAdd(vxlan); err != nil && err != syscall.EEXIST {
+            return nil, fmt.Errorf("failed to create overlay %q: %v", name, err)
+        }
+        if vx, err = netlink.LinkByName(name); err != nil {
+            return nil, fmt.Errorf("failed to lookup overlay %q: %v", name, err)
+        }
+        if err = netlink.LinkSetAlias(vx, uplinkAlias(br.Name)); err != nil {
+            netlink.LinkDel(vx)
+            return nil, fmt.Errorf("failed to tag overlay %q: %v", name, err)
+        }
+        if err = br.AddLink(vx); err != nil {
+            netlink.LinkDel(vx)
+            return nil, err
+        }
+        fmt.Fprintf(os.Stderr, "[UNION CNI] overlay %s (vni %d) attached to %s\r\n", name, cfg.VNI, br.Name)
+    } else if vx.Attrs().MasterIndex != br.Data.Attrs().Index {
+        return nil, fmt.Errorf("overlay %q already serves another bridge, vni clash?", name)
+    }
+
+    return vx, syncPeers(vx, cfg.Peers, cfg.Complete)
+}
@@ -0,0 +1,240 @@
+package link
+
+import (
+    "fmt"
+    "os"
+
+    "github.com/containernetworking/plugins/pkg/ns"
+    "github.com/vishvananda/netlink"
+    "golang.org/x/sys/unix"
+)
+
+// A TAP in the pod reaches the group bridge through a veth pair, whose
+// pod end is joined to the TAP by a tc redirect or by a bridge.
+const (
+    TapAttachVeth = "veth"
+    TapAttachBridge = "bridge"
+)
+
+// TapConfig describes a persistent TAP device, Owner and Group
+// are left to root when negative.
+type TapConfig struct {
+    Owner int
+    Group int
+    VnetHdr bool
+    Queues int
+}
+
+func DefaultTapConfig() *TapConfig {
+    return &TapConfig{
+        Owner: -1,
+        Group: -1,
+        Queues: 1,
+    }
+}
+
+func tapIoctl(f *os.File, req uintptr, arg int) error {
+    _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+    if errno != 0 {
+        return errno
+    }
+    return nil
+}
+
+// CreateTap creates a persistent multi-queue TAP in the current namespace.
+func CreateTap(name string, cfg *TapConfig) (netlink.Link, error) {
+    if cfg == nil {
+        cfg = DefaultTapConfig()
+    }
+
+    queues := cfg.Queues
+    if queues <= 0 {
+        queues = 1
+    }
+    flags := netlink.TUNTAP_MULTI_QUEUE_DEFAULTS
+    if cfg.VnetHdr {
+        flags |= netlink.TUNTAP_VNET_HDR
+    }
+
+    tap := &netlink.Tuntap{
+        LinkAttrs: netlink.LinkAttrs{
+            Name: name,
+            MTU: defaultMtu,
+        },
+        Mode: netlink.TUNTAP_MODE_TAP,
+        Flags: flags,
+        Queues: queues,
+    }
+    if err := netlink.LinkAdd(tap); err != nil {
+        return nil, fmt.Errorf("failed to create tap %q: %v", name, err)
+    }
+    // the queues are reopened by the workload, our fds only set it up
+    defer func() {
+        for _, f := range tap.Fds {
+            f.Close()
+        }
+    }()
+
+    var err error
+    if cfg.Owner >= 0 {
+        if err = tapIoctl(tap.Fds[0], unix.TUNSETOWNER, cfg.Owner); err != nil {
+            err = fmt.Errorf("failed to set owner of tap %q: %v", name, err)
+        }
+    }
+    if err == nil && cfg.Group >= 0 {
+        if err = tapIoctl(tap.Fds[0], unix.TUNSETGROUP, cfg.Group); err != nil {
+            err = fmt.Errorf("failed to set group of tap %q: %v", name, err)
+        }
+    }
+    if err != nil {
+        netlink.LinkDel(tap)
+        return nil, err
+    }
+
+    l, err := netlink.LinkByName(name)
+    if err != nil {
+        return nil, fmt.Errorf("failed to lookup tap %q: %v", name, err)
+    }
+    if err = netlink.LinkSetUp(l); err != nil {
+        netlink.LinkDel(l)
+        return nil, fmt.Errorf("failed to set tap %q up: %v", name, err)
+    }
+    return l, nil
+}
+
+// tapAlias marks the pod end veth of a TAP, so DEL can find it.
+func tapAlias(name string) string {
+    return "tap:" + name
+}
+
+// redirect sends everything received on from out of to.
+func redirect(from netlink.Link, to netlink.Link) error {
+    qdisc := &netlink.Ingress{
+        QdiscAttrs: netlink.QdiscAttrs{
+            LinkIndex: from.Attrs().Index,
+            Handle: netlink.MakeHandle(0xffff, 0),
+            Parent: netlink.HANDLE_INGRESS,
+        },
+    }
+    if err := netlink.QdiscAdd(qdisc); err != nil {
+        return fmt.Errorf("failed to add ingress qdisc to %q: %v", from.Attrs().Name, err)
+    }
+
+    filter := &netlink.U32{
+        FilterAttrs: netlink.FilterAttrs{
+            LinkIndex: from.Attrs().Index,
+            Parent: netlink.MakeHandle(0xffff, 0),
+            Priority: 1,
+            Protocol: unix.ETH_P_ALL,
+        },
+        Actions: []netlink.Action{netlink.NewMirredAction(to.Attrs().Index)},
+    }
+    if err := netlink.FilterAdd(filter); err != nil {
+        return fmt.Errorf("failed to redirect %q to %q: %v", from.Attrs().Name, to.Attrs().Name, err)
+    }
+    return nil
+}
+
+// joinTap glues the TAP to the pod end veth, either through a small
+// bridge or with a tc redirect in both directions.
+func joinTap(tLink netlink.Link, vLink netlink.Link, attach string) error {
+    if attach == TapAttachBridge {
+        brName, err := getRandomName()
+        if err != nil {
+            return err
+        }
+        br, err := CreateBridge(brName)
+        if err != nil {
+            return err
+        }
+        if err = br.AddLink(vLink); err == nil {
+            err = br.AddLink(tLink)
+        }
+        if err != nil {
+            netlink.LinkDel(br.Data)
+        }
+        return err
+    }
+
+    if err := redirect(vLink, tLink); err != nil {
+        return err
+    }
+    return redirect(tLink, vLink)
+}
+
+// CreateTapInNS creates the TAP inside the pod and wires it to the host
+// through a veth pair, the returned host end is left for the caller
+// to enslave.
+func CreateTapInNS(name string, cfg *TapConfig, attach string, nspath string) (tLink netlink.Link, peerLink netlink.Link, err error) {
+    netns, err := ns.GetNS(nspath)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to open netns %q: %v", nspath, err)
+    }
+    defer netns.Close()
+
+    podEnd, err := getRandomName()
+    if err != nil {
+        return nil, nil, err
+    }
+    vLink, peerLink, err := CreateVethPairRandom(podEnd)
+    if err != nil {
+        return nil, nil, err
+    }
+    if err = JoinNetNS(podEnd, nspath); err != nil {
+        netlink.LinkDel(vLink)
+        return nil, nil, err
+    }
+
+    err = netns.Do(func(_ ns.NetNS) error {
+        vLink, err := netlink.LinkByName(podEnd)
+        if err != nil {
+            return err
+        }
+        if err = netlink.LinkSetAlias(vLink, tapAlias(name)); err != nil {
+            return err
+        }
+        if tLink, err = CreateTap(name, cfg); err != nil {
+            return err
+        }
+        if err = joinTap(tLink, vLink, attach); err != nil {
+            netlink.LinkDel(tLink)
+        }
+        return err
+    })
+    if err != nil {
+        DelLinkInNS(podEnd, nspath)
+        return nil, nil, err
+    }
+
+    return tLink, peerLink, nil
+}
+
+// DelTapInNS removes the TAP together with the veth and bridge
+// created by CreateTapInNS.
+func DelTapInNS(name string, nspath string) error {
+    netns, err := ns.GetNS(nspath)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to open namespace %s: %v\r\n", nspath, err)
+        return err
+    }
+    defer netns.Close()
+
+    return netns.Do(func(_ ns.NetNS) error {
+        // the pod end veth takes its host peer along
+        if vLink, err := netlink.LinkByAlias(tapAlias(name)); err == nil && vLink != nil {
+            netlink.LinkDel(vLink)
+        }
+
+        tLink, err := netlink.LinkByName(name)
+        if err != nil {
+            return fmt.Errorf("failed to lookup tap %q: %v", name, err)
+        }
+        if master := tLink.Attrs().MasterIndex; master != 0 {
+            if brLink, err := netlink.LinkByIndex(master); err == nil {
+                netlink.LinkDel(brLink)
+            }
+        }
+
+        return netlink.LinkDel(tLink)
+    })
+}
@@ -0,0 +1,167 @@
+package link
+
+import (
+    "fmt"
+    "net"
+
+    "github.com/containernetworking/plugins/pkg/ns"
+    "github.com/vishvananda/netlink"
+)
+
+const (
+    TunnelGretap = "gretap"
+    TunnelGre = "gre"
+    TunnelVxlan = "vxlan"
+
+    defaultVxlanPort = 4789
+)
+
+// TunnelConfig describes a point to point tunnel, Key is the GRE key
+// or the VXLAN VNI. Underlay optionally names the device carrying it.
+type TunnelConfig struct {
+    Type string
+    Local net.IP
+    Remote net.IP
+    Key uint32
+    TTL uint8
+    DstPort int
+    Underlay string
+}
+
+// IsL2 tells whether the tunnel carries ethernet frames and thus may
+// be enslaved to a bridge.
+func (cfg *TunnelConfig) IsL2() bool {
+    return cfg.Type == TunnelGretap || cfg.Type == TunnelVxlan
+}
+
+func tunnelAlias(name string) string {
+    return "tun:" + name
+}
+
+func newTunnel(name string, cfg *TunnelConfig) (netlink.Link, error) {
+    if cfg.Remote == nil {
+        return nil, fmt.Errorf("tunnel %q has no remote address", name)
+    }
+
+    attrs := netlink.LinkAttrs{
+        Name: name,
+        MTU: defaultMtu,
+    }
+    var parent int
+    if cfg.Underlay != "" {
+        uLink, err := netlink.LinkByName(cfg.Underlay)
+        if err != nil {
+            return nil, fmt.Errorf("failed to lookup underlay %q: %v", cfg.Underlay, err)
+        }
+        parent = uLink.Attrs().Index
+    }
+
+    switch cfg.Type {
+    case TunnelGretap:
+        return &netlink.Gretap{
+            LinkAttrs: attrs,
+            IKey: cfg.Key,
+            OKey: cfg.Key,
+            Local: cfg.Local,
+            Remote: cfg.Remote,
+            Ttl: cfg.TTL,
+            Link: uint32(parent),
+        }, nil
+    case TunnelGre:
+        return &netlink.Gretun{
+            LinkAttrs: attrs,
+            IKey: cfg.Key,
+            OKey: cfg.Key,
+            Local: cfg.Local,
+            Remote: cfg.Remote,
+            Ttl: cfg.TTL,
+            Link: uint32(parent),
+        }, nil
+    case TunnelVxlan:
+        port := cfg.DstPort
+        if port == 0 {
+            port = defaultVxlanPort
+        }
+        return &netlink.Vxlan{
+            LinkAttrs: attrs,
+            VxlanId: int(cfg.Key),
+            VtepDevIndex: parent,
+            SrcAddr: cfg.Local,
+            Group: cfg.Remote,
+            TTL: int(cfg.TTL),
+            Port: port,
+            Learning: true,
+        }, nil
+    default:
+        return nil, fmt.Errorf("unknown tunnel type: %q", cfg.Type)
+    }
+}
+
+// CreateTunnel creates the tunnel in the current namespace and sets it up.
+func CreateTunnel(name string, cfg *TunnelConfig) (netlink.Link, error) {
+    tun, err := newTunnel(name, cfg)
+    if err != nil {
+        return nil, err
+    }
+
+    if err = netlink.LinkAdd(tun); err != nil {
+        return nil, fmt.Errorf("failed to create %s tunnel %q: %v", cfg.Type, name, err)
+    }
+
+    tLink, err := netlink.LinkByName(name)
+    if err == nil {
+        err = netlink.LinkSetUp(tLink)
+    }
+    if err != nil {
+        netlink.LinkDel(tun)
+        return nil, fmt.Errorf("failed to set tunnel %q up: %v", name, err)
+    }
+    return tLink, nil
+}
+
+// CreateHostTunnel creates an L2 tunnel on the host with a random name,
+// tagged with owner so that DelHostTunnel can find it again.
+func CreateHostTunnel(owner string, cfg *TunnelConfig) (netlink.Link, error) {
+    if !cfg.IsL2() {
+        return nil, fmt.Errorf("%s tunnel can not be bridged, create it in the pod", cfg.Type)
+    }
+
+    name, err := getRandomName()
+    if err != nil {
+        return nil, err
+    }
+    tLink, err := CreateTunnel(name, cfg)
+    if err != nil {
+        return nil, err
+    }
+    if err = netlink.LinkSetAlias(tLink, tunnelAlias(owner)); err != nil {
+        netlink.LinkDel(tLink)
+        return nil, fmt.Errorf("failed to tag tunnel %q: %v", name, err)
+    }
+    return tLink, nil
+}
+
+func DelHostTunnel(owner string) error {
+    tLink, err := netlink.LinkByAlias(tunnelAlias(owner))
+    if err != nil || tLink == nil {
+        return ErrLinkNotFound
+    }
+    return netlink.LinkDel(tLink)
+}
+
+// CreateTunnelInNS creates the tunnel right inside the pod, the underlay
+// is then reached through the pod routes.
+func CreateTunnelInNS(name string, cfg *TunnelConfig, nspath string) (tLink netlink.Link, err error) {
+    netns, err := ns.GetNS(nspath)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open netns %q: %v", nspath, err)
+    }
+    defer netns.Close()
+
+    err = netns.Do(func(_ ns.NetNS) error {
+        var err error
+        tLink, err = CreateTunnel(name, cfg)
+        return err
+    })
+    return tLink, err
+}
@@ -180,3 +180,56 @@ func SetPromiscOn(link netlink.Link) error {
 
     return nil
 }
+
+// moveAndRename moves the link tmp into nspath as name, and sets it up.
+func moveAndRename(tmp string, name string, nspath string) error {
+    l, err := netlink.LinkByName(tmp)
+    if err != nil {
+        return err
+    }
+    netns, err := ns.GetNS(nspath)
+    if err != nil {
+        return err
+    }
+    defer netns.Close()
+    if err = netlink.LinkSetNsFd(l, int(netns.Fd())); err != nil {
+        return fmt.Errorf("failed to move %q to netns %q: %v", tmp, nspath, err)
+    }
+    return netns.Do(func (_ ns.NetNS) error {
+        l, err := netlink.LinkByName(tmp)
+        if err != nil {
+            return err
+        }
+        if err = netlink.LinkSetName(l, name); err != nil {
+            return fmt.Errorf("failed to rename %q to %q: %v", tmp, name, err)
+        }
+        return netlink.LinkSetUp(l)
+    })
+}
+
+// CreateWire joins two netns back to back, by a veth pair named aName
+// in aNS and bName in bNS. Nothing of it stays on the host.
+func CreateWire(aName string, aNS string, bName string, bNS string) error {
+    aTmp, err := getRandomName()
+    if err != nil {
+        return err
+    }
+    bTmp, err := getRandomName()
+    if err != nil {
+        return err
+    }
+    aLink, _, err := CreateVethPair(aTmp, bTmp)
+    if err != nil {
+        return fmt.Errorf("failed to create veth pair: %v", err)
+    }
+    if err = moveAndRename(aTmp, aName, aNS); err != nil {
+        netlink.LinkDel(aLink)
+        return err
+    }
+    if err = moveAndRename(bTmp, bName, bNS); err != nil {
+        // the pair goes along with its first end
+        DelLinkInNS(aName, aNS)
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,74 @@
+package link
+
+import (
+    "fmt"
+    "os"
+    "syscall"
+
+    "github.com/vishvananda/netlink"
+)
+
+const (
+    maxLinkName = 15
+    vlanPrefix = "uvl"
+)
+
+// UplinkVID hashes a group channel into [min, max], the first VLAN tried
+// when it is allocated one.
+func UplinkVID(cred string, group string, chanType string, min int, max int) int {
+    return min + int(groupHash(cred, group, chanType) % uint32(max - min + 1))
+}
+
+func vlanName(device string, vid int) string {
+    name := fmt.Sprintf("%s.%d", device, vid)
+    if len(name) > maxLinkName {
+        name = fmt.Sprintf("%s%d", vlanPrefix, vid)
+    }
+    return name
+}
+
+// EnsureVlanUplink attaches the VLAN vid of the physical device to the
+// bridge if not done yet.
+func (br *Bridge)EnsureVlanUplink(device string, vid int) (netlink.Link, error) {
+    name := vlanName(device, vid)
+    vl, err := netlink.LinkByName(name)
+    if err == nil {
+        if vl.Attrs().MasterIndex != br.Data.Attrs().Index {
+            return nil, fmt.Errorf("vlan %q already serves another bridge, vlan clash?", name)
+        }
+        return vl, nil
+    }
+
+    parent, err := netlink.LinkByName(device)
+    if err != nil {
+        return nil, fmt.Errorf("failed to lookup uplink %q: %v", device, err)
+    }
+    if err = netlink.LinkSetUp(parent); err != nil {
+        return nil, fmt.Errorf("failed to set uplink %q up: %v", device, err)
+    }
+
+    vlan := &netlink.Vlan{
+        LinkAttrs: netlink.LinkAttrs{
+            Name: name,
+            ParentIndex: parent.Attrs().Index,
+        },
+        VlanId: vid,
+    }
+    if err = netlink.LinkAdd(vlan); err != nil && err != syscall.EEXIST {
+        return nil, fmt.Errorf("failed to create vlan %q: %v", name, err)
+    }
+    if vl, err = netlink.LinkByName(name); err != nil {
+        return nil, fmt.Errorf("failed to lookup vlan %q: %v", name, err)
+    }
+    if err = netlink.LinkSetAlias(vl, uplinkAlias(br.Name)); err != nil {
+        netlink.LinkDel(vl)
+        return nil, fmt.Errorf("failed to tag vlan %q: %v", name, err)
+    }
+    if err = br.AddLink(vl); err != nil {
+        netlink.LinkDel(vl)
+        return nil, err
+    }
+
+    fmt.Fprintf(os.Stderr, "[UNION CNI] vlan %s attached to %s\r\n", name, br.Name)
+    return vl, nil
+}
@@ -7,6 +7,9 @@ import (
     "encoding/json"
 
     "github.com/union-cni/pkg/client"
+
+    "github.com/containernetworking/cni/pkg/types"
+    "k8s.io/api/core/v1"
 )
 
 var (
@@ -17,12 +20,92 @@ const (
     netInfoKey = "network_info"
 )
 
+// BridgePort describes the bridge flags of the host side port,
+// unset flags keep the kernel defaults.
+type BridgePort struct {
+    Hairpin *bool           `json:"hairpin"`
+    Learning *bool          `json:"learning"`
+    UnicastFlood *bool      `json:"unicast_flood"`
+    MulticastFlood *bool    `json:"multicast_flood"`
+    Isolated *bool          `json:"isolated"`
+    BpduGuard *bool         `json:"bpdu_guard"`
+    RootBlock *bool         `json:"root_block"`
+    FastLeave *bool         `json:"fast_leave"`
+}
+
+// TapInfo configures a TAP port, Attach is either "veth" (default)
+// or "bridge".
+type TapInfo struct {
+    Owner *int              `json:"owner"`
+    Group *int              `json:"group"`
+    VnetHdr bool            `json:"vnet_hdr"`
+    Queues int              `json:"queues"`
+    Attach string           `json:"attach"`
+}
+
+// TunnelInfo configures a gretap, gre or vxlan external port, Key is
+// the GRE key or the VXLAN VNI. L2 tunnels stay on the host unless InPod
+// is set, gre is always created in the pod.
+type TunnelInfo struct {
+    Local string            `json:"local"`
+    Remote string           `json:"remote"`
+    Key uint32              `json:"key"`
+    TTL uint8               `json:"ttl"`
+    DstPort int             `json:"dst_port"`
+    InPod bool              `json:"in_pod"`
+}
+
+// AddrInfo is one address of a port, NoDad and Optimistic apply
+// to IPv6 only.
+type AddrInfo struct {
+    Address string          `json:"address"`
+    NoDad bool              `json:"nodad"`
+    Optimistic bool         `json:"optimistic"`
+}
+
+// RouteInfo is a static route of a port. An empty or "default" Dst is
+// the default route, Table 0 is the main table.
+type RouteInfo struct {
+    Dst string              `json:"dst"`
+    Gateway string          `json:"gateway"`
+    Metric int              `json:"metric"`
+    Table int               `json:"table"`
+}
+
+// DefaultRouteInfo makes Port the default route of the pod, one
+// gateway per address family.
+type DefaultRouteInfo struct {
+    Port string             `json:"port"`
+    Gateways []string       `json:"gateways"`
+}
+
 type ExternalInfo struct {
     HostPort string         `json:"host_port"`
     ContainerPort string    `json:"container_port"`
     Type string             `json:"type"`
     Mode string		    `json:"mode"`
     IP string               `json:"ipaddr"`
+    BridgePort *BridgePort  `json:"bridge_port"`
+    Tap *TapInfo            `json:"tap"`
+    Tunnel *TunnelInfo      `json:"tunnel"`
+    IPAM json.RawMessage    `json:"ipam,omitempty"`
+    IPs []AddrInfo          `json:"ips"`
+    Routes []RouteInfo      `json:"routes"`
+}
+
+// ChannelInfo holds the optional settings of a system channel,
+// keyed by channel type in NetworkInfo. Subnet turns on the built-in
+// IPAM, Reservations maps device ids to their fixed address. IPAM is
+// handed as is to a CNI IPAM plugin and takes precedence over Subnet.
+type ChannelInfo struct {
+    Type string             `json:"type"`
+    BridgePort *BridgePort  `json:"bridge_port"`
+    Tap *TapInfo            `json:"tap"`
+    Subnet string           `json:"subnet"`
+    Reservations map[string]string `json:"reservations"`
+    IPAM json.RawMessage    `json:"ipam,omitempty"`
+    IPs []AddrInfo          `json:"ips"`
+    Routes []RouteInfo      `json:"routes"`
 }
 
 type NetworkInfo struct {
@@ -30,7 +113,11 @@ type NetworkInfo struct {
     Group       string `json:"group"`
     DeviceID    string `json:"deviceid"`
     SystemChan  map[string]string  `json:"system_channels"`
+    ChannelConfig map[string]*ChannelInfo `json:"channel_config"`
     ExternalPort []ExternalInfo `json:"external_ports"`
+    DefaultRoute *DefaultRouteInfo `json:"default_route"`
+    // only reported in the result, the runtime owns resolv.conf
+    DNS types.DNS           `json:"dns"`
 }
 
 func (netInfo *NetworkInfo)GetExternalPorts() ([]ExternalInfo) {
@@ -42,6 +129,16 @@ func (netInfo *NetworkInfo)GetExternalPorts() ([]ExternalInfo) {
     }
 }
 
+// IsInvalid tells whether GetNetInfo failed on the annotation itself,
+// rather than on the API server or on a pod without annotation.
+func IsInvalid(err error) bool {
+    switch err.(type) {
+        case *json.SyntaxError, *json.UnmarshalTypeError:
+            return true
+    }
+    return err == ErrNoSuchItem
+}
+
 func GetNetInfo(host string, port string, k8sNamespace string, podName string) (*NetworkInfo, error) {
     k8scli := client.CreateInsecureClient(host, port)
     pod, err := k8scli.GetPod(k8sNamespace, podName)
@@ -49,17 +146,31 @@ func GetNetInfo(host string, port string, k8sNamespace string, podName string) (
          fmt.Fprintf(os.Stderr, "[UNION CNI] failed to get pod: %v\r\n", err)
          return nil, err
     }
+    return FromPod(pod)
+}
+
+// Changed tells whether the annotation differs between two versions
+// of a pod.
+func Changed(old *v1.Pod, pod *v1.Pod) bool {
+    return old.Annotations[netInfoKey] != pod.Annotations[netInfoKey]
+}
 
+// FromPod reads the annotation of a pod already at hand.
+func FromPod(pod *v1.Pod) (*NetworkInfo, error) {
     rawData, ok := pod.Annotations[netInfoKey]
     if !ok {
         fmt.Fprintf(os.Stderr, "[UNION CNI] no annotation: network_info\r\n")
         return nil, fmt.Errorf("no annotation: network_info")
     }
+    return Parse(rawData)
+}
 
+// Parse reads and checks the annotation value.
+func Parse(rawData string) (*NetworkInfo, error) {
     netInfo := &NetworkInfo{}
-    err = json.Unmarshal([]byte(rawData), netInfo)
+    err := json.Unmarshal([]byte(rawData), netInfo)
     if err != nil {
-        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to convert raw %s to json: %v\r\n", err)
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to convert raw %s to json: %v\r\n", rawData, err)
         return nil, err
     }
 
@@ -80,6 +191,14 @@ func (netInfo *NetworkInfo)GetSystemChannels() (map[string]string) {
     return netInfo.SystemChan
 }
 
+// GetChannelInfo never returns nil, a channel without settings gets an empty one.
+func (netInfo *NetworkInfo)GetChannelInfo(chanType string) *ChannelInfo {
+    if info, ok := netInfo.ChannelConfig[chanType]; ok && info != nil {
+        return info
+    }
+    return &ChannelInfo{}
+}
+
 func (netInfo *NetworkInfo)GetDeviceID() string {
     return netInfo.DeviceID
 }
@@ -91,3 +210,23 @@ func (netInfo *NetworkInfo)GetCred() string {
 func (netInfo *NetworkInfo)GetGroup() string {
     return netInfo.Group
 }
+
+// BridgeName is the host bridge of the system channel chanType, shared
+// by the whole group.
+func BridgeName(cred string, group string, chanType string) string {
+    return fmt.Sprintf("%s-%s-%s", cred, group, chanType)
+}
+
+// PortBridgeName is the host bridge of the external port conPort, owned
+// by the device alone.
+func PortBridgeName(cred string, group string, devID string, conPort string) string {
+    return fmt.Sprintf("%s%s-%s%s", cred, group, devID, conPort)
+}
+
+func (netInfo *NetworkInfo)BridgeName(chanType string) string {
+    return BridgeName(netInfo.Crediential, netInfo.Group, chanType)
+}
+
+func (netInfo *NetworkInfo)PortBridgeName(conPort string) string {
+    return PortBridgeName(netInfo.Crediential, netInfo.Group, netInfo.DeviceID, conPort)
+}
@@ -0,0 +1,190 @@
+package podcache
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/union-cni/pkg/client"
+
+    "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+    // DEL mostly comes once the pod object is gone, keep it until then
+    keepDeleted = 10 * time.Minute
+    retryDelay = time.Second
+)
+
+// Cache holds the pods of one node, kept up to date by a list and watch
+// of the API server.
+type Cache struct {
+    cli *client.Client
+    node string
+
+    mu sync.RWMutex
+    pods map[string]*v1.Pod
+    deleted map[string]time.Time
+    synced bool
+    handlers []UpdateFunc
+}
+
+// UpdateFunc is called with the former and the new version of a pod the
+// cache already knew.
+type UpdateFunc func(old *v1.Pod, pod *v1.Pod)
+
+func key(namespace string, name string) string {
+    return namespace + "/" + name
+}
+
+func New(cli *client.Client, node string) *Cache {
+    return &Cache{
+        cli: cli,
+        node: node,
+        pods: make(map[string]*v1.Pod),
+        deleted: make(map[string]time.Time),
+    }
+}
+
+// Get returns the pod, nil when the cache doesn't know it (yet).
+func (c *Cache) Get(namespace string, name string) *v1.Pod {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.pods[key(namespace, name)]
+}
+
+// Synced tells whether the first list is done.
+func (c *Cache) Synced() bool {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.synced
+}
+
+// OnUpdate registers fn, to be set before Run.
+func (c *Cache) OnUpdate(fn UpdateFunc) {
+    c.handlers = append(c.handlers, fn)
+}
+
+func (c *Cache) set(pod *v1.Pod) {
+    k := key(pod.Namespace, pod.Name)
+    c.mu.Lock()
+    old := c.pods[k]
+    c.pods[k] = pod
+    delete(c.deleted, k)
+    c.mu.Unlock()
+
+    if old != nil {
+        for _, fn := range c.handlers {
+            fn(old, pod)
+        }
+    }
+}
+
+func (c *Cache) remove(pod *v1.Pod) {
+    c.mu.Lock()
+    c.deleted[key(pod.Namespace, pod.Name)] = time.Now()
+    c.mu.Unlock()
+}
+
+// purge forgets the pods deleted for long enough.
+func (c *Cache) purge() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for k, t := range c.deleted {
+        if time.Since(t) > keepDeleted {
+            delete(c.pods, k)
+            delete(c.deleted, k)
+        }
+    }
+}
+
+// sync lists the pods and returns the version to watch from.
+func (c *Cache) sync(selector string) (string, error) {
+    list, err := c.cli.ListPods(selector)
+    if err != nil {
+        return "", err
+    }
+
+    c.mu.Lock()
+    seen := make(map[string]bool)
+    var updates [][2]*v1.Pod
+    for i := range list.Items {
+        pod := &list.Items[i]
+        k := key(pod.Namespace, pod.Name)
+        if old, ok := c.pods[k]; ok && old.ResourceVersion != pod.ResourceVersion {
+            // changes missed while the watch was down
+            updates = append(updates, [2]*v1.Pod{old, pod})
+        }
+        c.pods[k] = pod
+        delete(c.deleted, k)
+        seen[k] = true
+    }
+    for k := range c.pods {
+        if _, ok := c.deleted[k]; !ok && !seen[k] {
+            c.deleted[k] = time.Now()
+        }
+    }
+    c.synced = true
+    c.mu.Unlock()
+
+    for _, u := range updates {
+        for _, fn := range c.handlers {
+            fn(u[0], u[1])
+        }
+    }
+    return list.ResourceVersion, nil
+}
+
+// Run lists and watches until stop is closed, listing again whenever
+// the watch ends.
+func (c *Cache) Run(stop <-chan struct{}) {
+    selector := fmt.Sprintf("spec.nodeName=%s", c.node)
+    for {
+        err := c.watch(selector, stop)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] pod watch of %s: %v\r\n", c.node, err)
+        }
+        select {
+            case <-stop:
+                return
+            case <-time.After(retryDelay):
+        }
+    }
+}
+
+func (c *Cache) watch(selector string, stop <-chan struct{}) error {
+    rv, err := c.sync(selector)
+    if err != nil {
+        return err
+    }
+    w, err := c.cli.WatchPods(selector, rv)
+    if err != nil {
+        return err
+    }
+    defer w.Stop()
+
+    for {
+        select {
+            case <-stop:
+                return nil
+            case ev, ok := <-w.ResultChan():
+                if !ok {
+                    return nil
+                }
+                pod, isPod := ev.Object.(*v1.Pod)
+                switch {
+                    case ev.Type == watch.Error:
+                        return fmt.Errorf("watch error: %v", ev.Object)
+                    case !isPod:
+                        continue
+                    case ev.Type == watch.Deleted:
+                        c.remove(pod)
+                    default:
+                        c.set(pod)
+                }
+                c.purge()
+        }
+    }
+}
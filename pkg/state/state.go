@@ -0,0 +1,297 @@
+package state
+
+import (
+    "fmt"
+    "os"
+    "io/ioutil"
+    "strings"
+    "time"
+    "path/filepath"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/netinfo"
+)
+
+const (
+    defaultStateDir = "/var/lib/unicni"
+    defaultMacvtapDir = "/var/lib/unicni/macvtap"
+)
+
+// DeviceState is the host side configuration of a NIC handed to a pod,
+// it is used to restore the NIC on DEL.
+type DeviceState struct {
+    Name string             `json:"name"`
+    ContainerPort string    `json:"container_port"`
+    MTU int                 `json:"mtu"`
+    Addrs []string          `json:"addrs"`
+    Up bool                 `json:"up"`
+}
+
+// MacvtapState tells the workload which character device belongs
+// to a macvtap port.
+type MacvtapState struct {
+    ContainerPort string    `json:"container_port"`
+    Path string             `json:"path"`
+    Major int               `json:"major"`
+    Minor int               `json:"minor"`
+}
+
+// LeaseState is an address the built-in IPAM gave to the container.
+type LeaseState struct {
+    Pool string             `json:"pool"`
+    ContainerPort string    `json:"container_port"`
+    Address string          `json:"address"`
+}
+
+// DelegationState is a port addressed by a CNI IPAM plugin, whose
+// configuration is needed again to release the address.
+type DelegationState struct {
+    ContainerPort string    `json:"container_port"`
+    IPAM json.RawMessage    `json:"ipam"`
+}
+
+// WireState is a port wired back to back to a port of another netns,
+// as unictl topology does.
+type WireState struct {
+    ContainerPort string    `json:"container_port"`
+    PeerNetns string        `json:"peer_netns"`
+    PeerPort string         `json:"peer_port"`
+}
+
+// State is what unicni remembers about one container between ADD and DEL.
+type State struct {
+    ContainerID string      `json:"container_id"`
+    Netns string            `json:"netns"`
+    Devices []DeviceState   `json:"devices"`
+    Macvtaps []MacvtapState `json:"macvtaps"`
+    Leases []LeaseState     `json:"leases"`
+    Delegations []DelegationState `json:"delegations"`
+    Wires []WireState       `json:"wires,omitempty"`
+    // what the node daemon needs to bring a running pod to a new annotation
+    Pod string              `json:"pod"`
+    NetConf json.RawMessage `json:"netconf"`
+    CNIArgs string          `json:"cni_args"`
+    CNIPath string          `json:"cni_path"`
+    NetInfo *netinfo.NetworkInfo `json:"network_info"`
+    // the lab of a device unictl topology set up, no runtime knows it
+    Lab string              `json:"lab,omitempty"`
+    // external ports unictl plugged in, the annotation doesn't list them
+    HotPlugged []string     `json:"hot_plugged,omitempty"`
+}
+
+// StateDir may be changed for testing or by netconf.
+var StateDir = defaultStateDir
+
+// MacvtapDir holds a file per pod with its macvtaps, the only thing of
+// the state a pod may see.
+var MacvtapDir = defaultMacvtapDir
+
+// MacvtapPath is the macvtap file of the pod <namespace>/<name>.
+func MacvtapPath(pod string) string {
+    return filepath.Join(MacvtapDir, strings.Replace(pod, "/", "_", 1) + ".json")
+}
+
+// saveMacvtaps writes the macvtap file of the pod of st, in place so that
+// a bind mount of it sees the new content.
+func (st *State) saveMacvtaps() error {
+    if st.Pod == "" {
+        return nil
+    }
+    path := MacvtapPath(st.Pod)
+    if len(st.Macvtaps) == 0 {
+        if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        return nil
+    }
+    if err := os.MkdirAll(MacvtapDir, 0755); err != nil {
+        return fmt.Errorf("failed to create macvtap dir %q: %v", MacvtapDir, err)
+    }
+    rawData, err := json.Marshal(st.Macvtaps)
+    if err != nil {
+        return err
+    }
+    if err = ioutil.WriteFile(path, rawData, 0644); err != nil {
+        return fmt.Errorf("failed to write macvtaps %q: %v", path, err)
+    }
+    return nil
+}
+
+func statePath(containerID string) string {
+    return filepath.Join(StateDir, containerID + ".json")
+}
+
+func New(containerID string, netns string) *State {
+    return &State{
+        ContainerID: containerID,
+        Netns: netns,
+    }
+}
+
+// Load returns os.IsNotExist errors untouched, so callers can tell
+// a missing state from a broken one.
+func Load(containerID string) (*State, error) {
+    rawData, err := ioutil.ReadFile(statePath(containerID))
+    if err != nil {
+        return nil, err
+    }
+
+    st := &State{}
+    if err = json.Unmarshal(rawData, st); err != nil {
+        return nil, fmt.Errorf("failed to parse state of %q: %v", containerID, err)
+    }
+    return st, nil
+}
+
+func (st *State) Save() error {
+    if err := os.MkdirAll(StateDir, 0700); err != nil {
+        return fmt.Errorf("failed to create state dir %q: %v", StateDir, err)
+    }
+
+    rawData, err := json.Marshal(st)
+    if err != nil {
+        return err
+    }
+
+    // write then rename, a crash never leaves a truncated state behind
+    path := statePath(st.ContainerID)
+    tmpPath := path + ".tmp"
+    if err = ioutil.WriteFile(tmpPath, rawData, 0600); err != nil {
+        return fmt.Errorf("failed to write state %q: %v", tmpPath, err)
+    }
+    if err = os.Rename(tmpPath, path); err != nil {
+        return err
+    }
+    return st.saveMacvtaps()
+}
+
+// List loads every state of the node, the broken ones are skipped.
+func List() ([]*State, error) {
+    paths, err := filepath.Glob(filepath.Join(StateDir, "*.json"))
+    if err != nil {
+        return nil, err
+    }
+    var states []*State
+    for _, path := range paths {
+        st, err := Load(strings.TrimSuffix(filepath.Base(path), ".json"))
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] %v\r\n", err)
+            continue
+        }
+        states = append(states, st)
+    }
+    return states, nil
+}
+
+// Modified returns when the state was last saved.
+func Modified(containerID string) (time.Time, error) {
+    info, err := os.Stat(statePath(containerID))
+    if err != nil {
+        return time.Time{}, err
+    }
+    return info.ModTime(), nil
+}
+
+// Remove forgets the container, and the macvtap file of its pod unless
+// another sandbox of the pod has one.
+func Remove(containerID string) error {
+    if st, err := Load(containerID); err == nil && len(st.Macvtaps) != 0 && !otherSandbox(st) {
+        os.Remove(MacvtapPath(st.Pod))
+    }
+    err := os.Remove(statePath(containerID))
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+func otherSandbox(st *State) bool {
+    states, _ := List()
+    for _, other := range states {
+        if other.Pod == st.Pod && other.ContainerID != st.ContainerID {
+            return true
+        }
+    }
+    return false
+}
+
+func (st *State) AddDevice(dev DeviceState) {
+    st.Devices = append(st.Devices, dev)
+}
+
+// GetDevice looks the device up by its name inside the pod.
+func (st *State) GetDevice(conPort string) *DeviceState {
+    if st == nil {
+        return nil
+    }
+    for i := range st.Devices {
+        if st.Devices[i].ContainerPort == conPort {
+            return &st.Devices[i]
+        }
+    }
+    return nil
+}
+
+func (st *State) AddMacvtap(tap MacvtapState) {
+    st.Macvtaps = append(st.Macvtaps, tap)
+}
+
+func (st *State) AddLease(l LeaseState) {
+    st.Leases = append(st.Leases, l)
+}
+
+func (st *State) AddDelegation(d DelegationState) {
+    st.Delegations = append(st.Delegations, d)
+}
+
+// AddWire records w, unless its port is recorded already.
+func (st *State) AddWire(w WireState) {
+    if st.GetWire(w.ContainerPort) == nil {
+        st.Wires = append(st.Wires, w)
+    }
+}
+
+func (st *State) GetWire(conPort string) *WireState {
+    for i := range st.Wires {
+        if st.Wires[i].ContainerPort == conPort {
+            return &st.Wires[i]
+        }
+    }
+    return nil
+}
+
+// RemovePort forgets everything recorded about a port of the pod.
+func (st *State) RemovePort(conPort string) {
+    var devices []DeviceState
+    for _, d := range st.Devices {
+        if d.ContainerPort != conPort {
+            devices = append(devices, d)
+        }
+    }
+    var macvtaps []MacvtapState
+    for _, m := range st.Macvtaps {
+        if m.ContainerPort != conPort {
+            macvtaps = append(macvtaps, m)
+        }
+    }
+    var leases []LeaseState
+    for _, l := range st.Leases {
+        if l.ContainerPort != conPort {
+            leases = append(leases, l)
+        }
+    }
+    var delegations []DelegationState
+    for _, d := range st.Delegations {
+        if d.ContainerPort != conPort {
+            delegations = append(delegations, d)
+        }
+    }
+    var hotPlugged []string
+    for _, name := range st.HotPlugged {
+        if name != conPort {
+            hotPlugged = append(hotPlugged, name)
+        }
+    }
+    st.Devices, st.Macvtaps, st.Leases, st.Delegations = devices, macvtaps, leases, delegations
+    st.HotPlugged = hotPlugged
+}
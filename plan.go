@@ -0,0 +1,297 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "io"
+    "bytes"
+    "sort"
+    "strings"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/link"
+    "github.com/union-cni/pkg/netinfo"
+    "github.com/union-cni/pkg/state"
+
+    "github.com/containernetworking/cni/pkg/types/current"
+    "github.com/vishvananda/netlink"
+)
+
+// step is one operation of the setup of a port. do touches the kernel,
+// undo takes it back when a later step of the same port fails. Steps
+// without action only keep the books and are left out of a plan.
+type step struct {
+    Action string      `json:"action"`
+    do func() error
+    undo func()
+}
+
+// portPlan is the setup of one port. Err is known before anything is
+// done, the port can't be set up at all then.
+type portPlan struct {
+    Port string        `json:"port"`
+    Kind string        `json:"kind"`
+    Steps []*step      `json:"steps"`
+    Skip string        `json:"skip,omitempty"`
+    Err error          `json:"-"`
+}
+
+func (p *portPlan) add(action string, do func() error, undo func()) {
+    p.Steps = append(p.Steps, &step{Action: action, do: do, undo: undo})
+}
+
+// run does the steps in order, and undoes the done ones on failure.
+func (p *portPlan) run() error {
+    if p.Err != nil || p.Skip != "" {
+        return p.Err
+    }
+    for i, s := range p.Steps {
+        if err := s.do(); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] %s: failed to %s: %v\r\n", p.Port, s.Action, err)
+            for j := i - 1; j >= 0; j-- {
+                if p.Steps[j].undo != nil {
+                    p.Steps[j].undo()
+                }
+            }
+            return err
+        }
+    }
+    return nil
+}
+
+func (p *portPlan) MarshalJSON() ([]byte, error) {
+    var actions []string
+    for _, s := range p.Steps {
+        if s.Action != "" {
+            actions = append(actions, s.Action)
+        }
+    }
+    errMsg := ""
+    if p.Err != nil {
+        errMsg = p.Err.Error()
+    }
+    return json.Marshal(&struct {
+        Port string         `json:"port"`
+        Kind string         `json:"kind"`
+        Steps []string      `json:"steps"`
+        Skip string         `json:"skip,omitempty"`
+        Error string        `json:"error,omitempty"`
+    }{p.Port, p.Kind, actions, p.Skip, errMsg})
+}
+
+// networkPlan is the setup of a pod: its channels, then its external
+// ports, then what belongs to the pod as a whole.
+type networkPlan struct {
+    Channels []*portPlan    `json:"channels"`
+    Ports []*portPlan       `json:"external_ports"`
+    Pod *portPlan           `json:"pod"`
+}
+
+// portLinks carries what the steps of a port hand to each other.
+type portLinks struct {
+    br *link.Bridge
+    con netlink.Link
+    host netlink.Link
+}
+
+func (p *portPlan) addBridge(l *portLinks, brName string) {
+    p.add("create bridge " + brName, func() (err error) {
+        l.br, err = link.CreateBridge(brName)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to create bridge %s: %v\r\n", brName, err)
+            return failure(reasonBridgeCreateFailed, fmt.Errorf("failed to create bridge %s: %v", brName, err))
+        }
+        return nil
+    }, func() {
+        link.DeleteBridgeIfEmpty(brName)
+    })
+}
+
+// addVeth pairs conPort with a random host end, moves it into the pod
+// and enslaves the host end to the bridge.
+func (p *portPlan) addVeth(l *portLinks, conPort string, brName string, nspath string) {
+    p.add(fmt.Sprintf("create veth pair %s/sim*", conPort), func() (err error) {
+        l.con, l.host, err = link.CreateVethPairRandom(conPort)
+        if err == nil {
+            // don't care the promisc mode failed or not
+            link.SetPromiscOn(l.con)
+        }
+        return err
+    }, func() {
+        netlink.LinkDel(l.host)
+    })
+    p.add(fmt.Sprintf("move %s to netns %s", conPort, nspath), func() error {
+        return link.JoinNetNS(conPort, nspath)
+    }, nil)
+    p.add(fmt.Sprintf("attach the host end of %s to bridge %s", conPort, brName), func() error {
+        return l.br.AddLink(l.host)
+    }, nil)
+}
+
+// addTap creates the TAP in the pod, wired to a host veth enslaved to
+// the bridge.
+func (p *portPlan) addTap(l *portLinks, conPort string, info *netinfo.TapInfo, brName string, nspath string) {
+    cfg, attach := tapConfig(info)
+    if attach == "" {
+        attach = link.TapAttachVeth
+    }
+    join := "a tc redirect"
+    if attach == link.TapAttachBridge {
+        join = "a bridge"
+    }
+    p.add(fmt.Sprintf("create tap %s in netns %s, joined by %s to veth pair sim*/sim*", conPort, nspath, join), func() (err error) {
+        l.con, l.host, err = link.CreateTapInNS(conPort, cfg, attach, nspath)
+        return err
+    }, func() {
+        link.DelTapInNS(conPort, nspath)
+    })
+    p.add(fmt.Sprintf("attach the host veth of %s to bridge %s", conPort, brName), func() error {
+        return l.br.AddLink(l.host)
+    }, nil)
+}
+
+func (p *portPlan) addPortFlags(l *portLinks, bp *netinfo.BridgePort, brName string) {
+    if bp == nil {
+        return
+    }
+    p.add("set bridge port flags on " + brName, func() error {
+        return l.br.SetPortFlags(l.host, portFlags(bp))
+    }, nil)
+}
+
+// addAddrs sets the static addresses and routes of a port one by one,
+// then reports them.
+func (p *portPlan) addAddrs(netInfo *netinfo.NetworkInfo, conPort string, ips []netinfo.AddrInfo, routes []netinfo.RouteInfo, nspath string, result *current.Result) {
+    for _, a := range ips {
+        a := a
+        p.add(fmt.Sprintf("add address %s to %s", a.Address, conPort), func() error {
+            return addPortAddrs(conPort, []netinfo.AddrInfo{a}, nil, nspath)
+        }, nil)
+    }
+    for _, r := range routes {
+        r := r
+        action := fmt.Sprintf("add route %s", dash(r.Dst))
+        if r.Gateway != "" {
+            action += " via " + r.Gateway
+        }
+        if r.Table != 0 {
+            action += fmt.Sprintf(" table %d", r.Table)
+        }
+        p.add(action + " to " + conPort, func() error {
+            return addPortAddrs(conPort, nil, []netinfo.RouteInfo{r}, nspath)
+        }, nil)
+    }
+    p.add("", func() error {
+        reportAddrs(netInfo, conPort, addrStrings(ips), result)
+        reportRoutes(routes, result)
+        return nil
+    }, nil)
+}
+
+// ipamType names the IPAM plugin of a port.
+func ipamType(conf json.RawMessage) string {
+    var ipamConf struct {
+        Type string     `json:"type"`
+    }
+    json.Unmarshal(conf, &ipamConf)
+    return ipamConf.Type
+}
+
+// spanAction describes how attachSpan reaches the other nodes, "" when
+// the bridge stays on the node.
+func spanAction(span *spanConfig, cred string, group string, chanType string, brName string) string {
+    switch {
+        case span == nil:
+        case span.overlay != nil:
+            // the VLAN or VNI is only allocated when the step runs
+            return fmt.Sprintf("span bridge %s over nodes by a vxlan of a vni allocated in %s/%s", brName, span.alloc.namespace, span.alloc.name)
+        case span.uplink != nil:
+            return fmt.Sprintf("span bridge %s over nodes by a vlan of %s allocated from %d-%d in %s/%s",
+                               brName, span.uplink.Device, span.uplink.VlanMin, span.uplink.VlanMax, span.alloc.namespace, span.alloc.name)
+    }
+    return ""
+}
+
+// planNetwork lays out the setup of the pod, nothing is done yet.
+func planNetwork(netInfo *netinfo.NetworkInfo, opts *addOptions, st *state.State, netns string, result *current.Result) *networkPlan {
+    np := &networkPlan{}
+    var chanTypes []string
+    for chanType := range netInfo.GetSystemChannels() {
+        chanTypes = append(chanTypes, chanType)
+    }
+    sort.Strings(chanTypes)
+    for _, chanType := range chanTypes {
+        chanName := netInfo.GetSystemChannels()[chanType]
+        np.Channels = append(np.Channels, planChannel(netInfo, chanType, chanName, opts, st, netns, result))
+    }
+
+    extPorts := netInfo.GetExternalPorts()
+    for i := range extPorts {
+        np.Ports = append(np.Ports, planExternalPort(netInfo, &extPorts[i], opts, st, netns, result))
+    }
+
+    np.Pod = &portPlan{Port: "pod", Kind: "pod"}
+    if dr := netInfo.DefaultRoute; dr != nil && dr.Port != "" {
+        // once every port is up, the gateway has to be reachable
+        np.Pod.add(fmt.Sprintf("set default route via %s to %s", strings.Join(dr.Gateways, ","), dr.Port), func() error {
+            return applyDefaultRoute(netInfo, netns)
+        }, nil)
+    }
+    np.Pod.add("", func() error {
+        reportNetwork(netInfo, result)
+        return nil
+    }, nil)
+    return np
+}
+
+// run sets the pod up along the plan. A failed channel or default route
+// stops it, a failed external port is only reported.
+func (np *networkPlan) run(opts *addOptions) error {
+    for _, p := range np.Channels {
+        if err := p.run(); err != nil {
+            return err
+        }
+    }
+    for _, p := range np.Ports {
+        if err := p.run(); err != nil {
+            opts.events.warn("port " + p.Port, err)
+        }
+    }
+    if err := np.Pod.run(); err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to set default route: %v\r\n", err)
+        return err
+    }
+    return nil
+}
+
+// print writes the plan as numbered steps.
+func (np *networkPlan) print(w io.Writer) {
+    n := 0
+    ports := append(append(append([]*portPlan{}, np.Channels...), np.Ports...), np.Pod)
+    for _, p := range ports {
+        switch {
+            case p.Err != nil:
+                fmt.Fprintf(w, "-\t%s\tfails: %v\n", p.Port, p.Err)
+                continue
+            case p.Skip != "":
+                fmt.Fprintf(w, "-\t%s\tskipped: %s\n", p.Port, p.Skip)
+                continue
+        }
+        for _, s := range p.Steps {
+            if s.Action == "" {
+                continue
+            }
+            n++
+            fmt.Fprintf(w, "%d\t%s\t%s\n", n, p.Port, s.Action)
+        }
+    }
+}
+
+// logPlan writes the plan of a dry run ADD to stderr.
+func logPlan(np *networkPlan) {
+    var buf bytes.Buffer
+    np.print(&buf)
+    for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] dry run: %s\r\n", strings.Replace(line, "\t", " ", -1))
+    }
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "net"
+
+    "github.com/union-cni/pkg/ip"
+    "github.com/union-cni/pkg/netinfo"
+
+    "github.com/containernetworking/cni/pkg/types"
+    "github.com/containernetworking/cni/pkg/types/current"
+)
+
+func addrConfig(infos []netinfo.AddrInfo) []*ip.Addr {
+    var addrs []*ip.Addr
+    for _, info := range infos {
+        addrs = append(addrs, &ip.Addr{
+            Address: info.Address,
+            NoDad: info.NoDad,
+            Optimistic: info.Optimistic,
+        })
+    }
+    return addrs
+}
+
+func routeConfig(infos []netinfo.RouteInfo) []*ip.Route {
+    var routes []*ip.Route
+    for _, info := range infos {
+        routes = append(routes, &ip.Route{
+            Dst: info.Dst,
+            Gateway: info.Gateway,
+            Metric: info.Metric,
+            Table: info.Table,
+        })
+    }
+    return routes
+}
+
+// addPortAddrs sets the static addresses then the routes of the port.
+func addPortAddrs(conPort string, ips []netinfo.AddrInfo, routes []netinfo.RouteInfo, nspath string) error {
+    if len(ips) != 0 {
+        if err := ip.AddrsAddInNS(conPort, addrConfig(ips), nspath); err != nil {
+            return err
+        }
+    }
+    if len(routes) != 0 {
+        return ip.RoutesAddInNS(conPort, routeConfig(routes), nspath)
+    }
+    return nil
+}
+
+// delPortAddrs undoes addPortAddrs, it matters for the ports that go
+// back to the host.
+func delPortAddrs(conPort string, ips []netinfo.AddrInfo, routes []netinfo.RouteInfo, nspath string) {
+    if len(routes) != 0 {
+        if err := ip.RoutesDelInNS(conPort, routeConfig(routes), nspath); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to delete routes of %s: %v\r\n", conPort, err)
+        }
+    }
+    if len(ips) != 0 {
+        if err := ip.AddrsDelInNS(conPort, addrConfig(ips), nspath); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to delete addresses of %s: %v\r\n", conPort, err)
+        }
+    }
+}
+
+func applyDefaultRoute(netInfo *netinfo.NetworkInfo, nspath string) error {
+    dr := netInfo.DefaultRoute
+    if dr == nil || dr.Port == "" {
+        return nil
+    }
+    if len(dr.Gateways) == 0 {
+        return fmt.Errorf("default route on %s has no gateway", dr.Port)
+    }
+    return ip.SetDefaultRouteInNS(dr.Port, dr.Gateways, nspath)
+}
+
+// defaultGateway returns the default gateway of the port that lies in
+// the subnet, if the port is the default route.
+func defaultGateway(netInfo *netinfo.NetworkInfo, conPort string, subnet *net.IPNet) net.IP {
+    dr := netInfo.DefaultRoute
+    if dr == nil || dr.Port != conPort {
+        return nil
+    }
+    for _, s := range dr.Gateways {
+        if gw := net.ParseIP(s); gw != nil && subnet.Contains(gw) {
+            return gw
+        }
+    }
+    return nil
+}
+
+// reportAddrs adds the static addresses of the port to the result, tied
+// to the last interface, which must be the port.
+func reportAddrs(netInfo *netinfo.NetworkInfo, conPort string, addrs []string, result *current.Result) {
+    for _, s := range addrs {
+        ipaddr, subnet, err := net.ParseCIDR(s)
+        if err != nil {
+            continue
+        }
+        version := "4"
+        if ipaddr.To4() == nil {
+            version = "6"
+        }
+        result.IPs = append(result.IPs, &current.IPConfig{
+            Version: version,
+            Interface: current.Int(len(result.Interfaces) - 1),
+            Address: net.IPNet{IP: ipaddr, Mask: subnet.Mask},
+            Gateway: defaultGateway(netInfo, conPort, subnet),
+        })
+    }
+}
+
+func reportRoutes(routes []netinfo.RouteInfo, result *current.Result) {
+    for _, r := range routes {
+        if r.Table != 0 {
+            // the result only knows the main table
+            continue
+        }
+        route := &types.Route{GW: net.ParseIP(r.Gateway)}
+        if r.Dst == "" || r.Dst == "default" {
+            route.Dst = defaultDst(route.GW)
+        } else if _, dst, err := net.ParseCIDR(r.Dst); err == nil {
+            route.Dst = *dst
+        } else {
+            continue
+        }
+        result.Routes = append(result.Routes, route)
+    }
+}
+
+func defaultDst(gw net.IP) net.IPNet {
+    if gw != nil && gw.To4() == nil {
+        return net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+    }
+    return net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+}
+
+// reportNetwork adds what belongs to the pod rather than to a port.
+func reportNetwork(netInfo *netinfo.NetworkInfo, result *current.Result) {
+    if dr := netInfo.DefaultRoute; dr != nil && dr.Port != "" {
+        for _, s := range dr.Gateways {
+            if gw := net.ParseIP(s); gw != nil {
+                result.Routes = append(result.Routes, &types.Route{Dst: defaultDst(gw), GW: gw})
+            }
+        }
+    }
+
+    dns := netInfo.DNS
+    result.DNS.Nameservers = append(result.DNS.Nameservers, dns.Nameservers...)
+    result.DNS.Search = append(result.DNS.Search, dns.Search...)
+    result.DNS.Options = append(result.DNS.Options, dns.Options...)
+    if dns.Domain != "" {
+        result.DNS.Domain = dns.Domain
+    }
+}
+
+func addrStrings(infos []netinfo.AddrInfo) []string {
+    var addrs []string
+    for _, info := range infos {
+        addrs = append(addrs, info.Address)
+    }
+    return addrs
+}
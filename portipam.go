@@ -0,0 +1,80 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/ip"
+    "github.com/union-cni/pkg/ipam"
+    "github.com/union-cni/pkg/netinfo"
+    "github.com/union-cni/pkg/state"
+
+    "github.com/containernetworking/cni/pkg/types/current"
+)
+
+// delegateAddr asks the IPAM plugin for the addresses of the port, applies
+// them with their routes in the pod and merges them into the result. The
+// port must be the last interface of the result.
+func delegateAddr(d *ipam.Delegate, ipamConf json.RawMessage, conPort string, st *state.State, nspath string, result *current.Result) error {
+    ipamResult, err := d.Add(conPort, ipamConf)
+    if err != nil {
+        return err
+    }
+    // recorded first, DEL must release the address even if we fail below
+    st.AddDelegation(state.DelegationState{
+        ContainerPort: conPort,
+        IPAM: ipamConf,
+    })
+
+    index := len(result.Interfaces) - 1
+    for _, ipc := range ipamResult.IPs {
+        if err = ip.AddrAddInNS(conPort, ipc.Address.String(), nspath); err != nil {
+            return fmt.Errorf("failed to add %s to %s: %v", ipc.Address.String(), conPort, err)
+        }
+        ipc.Interface = current.Int(index)
+        result.IPs = append(result.IPs, ipc)
+    }
+
+    for _, route := range ipamResult.Routes {
+        if err = ip.RouteAddInNS(conPort, &route.Dst, route.GW, nspath); err != nil {
+            return fmt.Errorf("failed to add route %s to %s: %v", route.Dst.String(), conPort, err)
+        }
+        result.Routes = append(result.Routes, route)
+    }
+
+    // the pod resolv.conf belongs to the runtime, DNS is only reported
+    result.DNS.Nameservers = append(result.DNS.Nameservers, ipamResult.DNS.Nameservers...)
+    result.DNS.Search = append(result.DNS.Search, ipamResult.DNS.Search...)
+    result.DNS.Options = append(result.DNS.Options, ipamResult.DNS.Options...)
+    if result.DNS.Domain == "" {
+        result.DNS.Domain = ipamResult.DNS.Domain
+    }
+    return nil
+}
+
+// releaseDelegated runs the IPAM DEL of every delegated port, those of the
+// state and, without state, those of the annotation.
+func releaseDelegated(d *ipam.Delegate, netInfo *netinfo.NetworkInfo, st *state.State) {
+    var delegations []state.DelegationState
+    if st != nil {
+        delegations = st.Delegations
+    } else if netInfo != nil {
+        for chanType, chanName := range netInfo.GetSystemChannels() {
+            if conf := netInfo.GetChannelInfo(chanType).IPAM; len(conf) != 0 {
+                delegations = append(delegations, state.DelegationState{ContainerPort: chanName, IPAM: conf})
+            }
+        }
+        for _, ext := range netInfo.GetExternalPorts() {
+            if len(ext.IPAM) != 0 {
+                delegations = append(delegations, state.DelegationState{ContainerPort: ext.ContainerPort, IPAM: ext.IPAM})
+            }
+        }
+    }
+
+    for _, del := range delegations {
+        if err := d.Del(del.ContainerPort, del.IPAM); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to release address of %s: %v\r\n", del.ContainerPort, err)
+        }
+    }
+}
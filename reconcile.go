@@ -0,0 +1,257 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "reflect"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/ipam"
+    "github.com/union-cni/pkg/netinfo"
+    "github.com/union-cni/pkg/state"
+
+    "github.com/containernetworking/cni/pkg/skel"
+    "github.com/containernetworking/cni/pkg/types/current"
+)
+
+const (
+    reasonChannelAdded = "ChannelAdded"
+    reasonChannelRemoved = "ChannelRemoved"
+    reasonPortAdded = "PortAdded"
+    reasonPortRemoved = "PortRemoved"
+    reasonAddressesChanged = "AddressesChanged"
+    reasonDefaultRouteChanged = "DefaultRouteChanged"
+)
+
+func podKey(k8sArgs *K8SArgs) string {
+    return fmt.Sprintf("%s/%s", k8sArgs.K8S_POD_NAMESPACE, k8sArgs.K8S_POD_NAME)
+}
+
+// sameChannel tells whether a channel can stay, its addresses and
+// routes change in place.
+func sameChannel(a *netinfo.ChannelInfo, b *netinfo.ChannelInfo) bool {
+    ac, bc := *a, *b
+    ac.IPs, ac.Routes, bc.IPs, bc.Routes = nil, nil, nil, nil
+    return reflect.DeepEqual(ac, bc)
+}
+
+func samePort(a *netinfo.ExternalInfo, b *netinfo.ExternalInfo) bool {
+    ac, bc := *a, *b
+    ac.IP, ac.IPs, ac.Routes, bc.IP, bc.IPs, bc.Routes = "", nil, nil, "", nil, nil
+    return reflect.DeepEqual(ac, bc)
+}
+
+// portAddrs folds ipaddr into the static addresses of the port.
+func portAddrs(ext *netinfo.ExternalInfo) []netinfo.AddrInfo {
+    if ext.IP == "" {
+        return ext.IPs
+    }
+    return append([]netinfo.AddrInfo{{Address: ext.IP}}, ext.IPs...)
+}
+
+// changeAddrs swaps the static addresses and routes of a port, it
+// returns false when there was nothing to change.
+func changeAddrs(conPort string, oldIPs []netinfo.AddrInfo, oldRoutes []netinfo.RouteInfo, newIPs []netinfo.AddrInfo, newRoutes []netinfo.RouteInfo, nspath string) (bool, error) {
+    if reflect.DeepEqual(oldIPs, newIPs) && reflect.DeepEqual(oldRoutes, newRoutes) {
+        return false, nil
+    }
+    delPortAddrs(conPort, oldIPs, oldRoutes, nspath)
+    return true, addPortAddrs(conPort, newIPs, newRoutes, nspath)
+}
+
+// releasePort gives back the addresses of a port removed from a running
+// pod, and forgets it.
+func releasePort(conPort string, st *state.State, opts *addOptions) {
+    for _, l := range st.Leases {
+        if l.ContainerPort == conPort {
+            ipam.Release(l.Pool, st.ContainerID)
+        }
+    }
+    for _, del := range st.Delegations {
+        if del.ContainerPort == conPort {
+            if err := opts.delegate.Del(conPort, del.IPAM); err != nil {
+                fmt.Fprintf(os.Stderr, "[UNION CNI] failed to release address of %s: %v\r\n", conPort, err)
+            }
+        }
+    }
+    st.RemovePort(conPort)
+}
+
+func findPort(netInfo *netinfo.NetworkInfo, conPort string) *netinfo.ExternalInfo {
+    for i := range netInfo.ExternalPort {
+        if netInfo.ExternalPort[i].ContainerPort == conPort {
+            return &netInfo.ExternalPort[i]
+        }
+    }
+    return nil
+}
+
+// stateOptions sets up ports of the running pod of st as its ADD did.
+func stateOptions(st *state.State, rec *eventRecorder) (*addOptions, error) {
+    conf := &CNINetConf{}
+    if err := json.Unmarshal(st.NetConf, conf); err != nil {
+        return nil, fmt.Errorf("failed to load netconf of %s: %v", st.ContainerID, err)
+    }
+    span, err := newSpanConfig(conf)
+    if err != nil {
+        return nil, err
+    }
+    args := &skel.CmdArgs{
+        ContainerID: st.ContainerID,
+        Netns: st.Netns,
+        Args: st.CNIArgs,
+        Path: st.CNIPath,
+        StdinData: st.NetConf,
+    }
+    return &addOptions{
+        span: span,
+        ipam: conf.ChannelIPAM,
+        delegate: newDelegate(conf, args),
+        events: rec,
+    }, nil
+}
+
+// reconcile brings the running pod of st from the annotation it was set
+// up with to netInfo, and records every change as an event. It returns
+// the ports it created. Only what was set up is recorded, so that a port
+// that failed is retried by the next reconcile and reported by diff.
+func reconcile(st *state.State, netInfo *netinfo.NetworkInfo, rec *eventRecorder) ([]string, error) {
+    old := st.NetInfo
+    if old == nil {
+        return nil, fmt.Errorf("no network_info recorded for %s", st.ContainerID)
+    }
+    opts, err := stateOptions(st, rec)
+    if err != nil {
+        return nil, err
+    }
+    // hot-plugged ports stay until the annotation lists them itself
+    annotation := netInfo
+    netInfo = withHotPlugged(st, netInfo)
+    // the runtime never sees it, ports only append to it
+    result := &current.Result{}
+    nspath := st.Netns
+
+    // other credential, group or device renames every bridge
+    renamed := old.GetCred() != netInfo.GetCred() || old.GetGroup() != netInfo.GetGroup() || old.GetDeviceID() != netInfo.GetDeviceID()
+    keepChannel := func(chanType string) bool {
+        oldName, inOld := old.GetSystemChannels()[chanType]
+        newName, inNew := netInfo.GetSystemChannels()[chanType]
+        return !renamed && inOld && inNew && oldName == newName &&
+            sameChannel(old.GetChannelInfo(chanType), netInfo.GetChannelInfo(chanType))
+    }
+    keepPort := func(conPort string) bool {
+        o, n := findPort(old, conPort), findPort(netInfo, conPort)
+        return !renamed && o != nil && n != nil && samePort(o, n)
+    }
+
+    // removals first, a port may come back under the same name
+    for chanType, chanName := range old.GetSystemChannels() {
+        if !keepChannel(chanType) {
+            deleteChannel(old, chanType, chanName, nspath, opts.span)
+            releasePort(chanName, st, opts)
+            rec.normal(reasonChannelRemoved, fmt.Sprintf("channel %s removed from %s", chanType, chanName))
+        }
+    }
+    for i := range old.ExternalPort {
+        ext := &old.ExternalPort[i]
+        if !keepPort(ext.ContainerPort) {
+            deleteExternalPort(old, ext, st, nspath)
+            releasePort(ext.ContainerPort, st, opts)
+            rec.normal(reasonPortRemoved, fmt.Sprintf("port %s removed", ext.ContainerPort))
+        }
+    }
+
+    // what the pod ends up with
+    realized := *netInfo
+    realized.SystemChan = make(map[string]string)
+    realized.ChannelConfig = make(map[string]*netinfo.ChannelInfo)
+    realized.ExternalPort = nil
+    keepChannelInfo := func(chanType string, info *netinfo.NetworkInfo) {
+        realized.SystemChan[chanType] = info.GetSystemChannels()[chanType]
+        if chanInfo, ok := info.ChannelConfig[chanType]; ok {
+            realized.ChannelConfig[chanType] = chanInfo
+        }
+    }
+    var created []string
+
+    var firstErr error
+    fail := func(subject string, err error) {
+        rec.warn(subject, err)
+        if firstErr == nil {
+            firstErr = fmt.Errorf("%s: %v", subject, err)
+        }
+    }
+
+    for chanType, chanName := range netInfo.GetSystemChannels() {
+        subject := "channel " + chanName
+        if keepChannel(chanType) {
+            oi, ni := old.GetChannelInfo(chanType), netInfo.GetChannelInfo(chanType)
+            changed, err := changeAddrs(chanName, oi.IPs, oi.Routes, ni.IPs, ni.Routes, nspath)
+            if err != nil {
+                // the old addresses, for the next one to change them again
+                fail(subject, err)
+                keepChannelInfo(chanType, old)
+                continue
+            } else if changed {
+                rec.normal(reasonAddressesChanged, fmt.Sprintf("addresses of %s changed", chanName))
+            }
+            keepChannelInfo(chanType, netInfo)
+            continue
+        }
+        if err := createChannel(netInfo, chanType, chanName, opts, st, nspath, result); err != nil {
+            fail(subject, err)
+            continue
+        }
+        keepChannelInfo(chanType, netInfo)
+        created = append(created, chanName)
+        rec.normal(reasonChannelAdded, fmt.Sprintf("channel %s added as %s", chanType, chanName))
+    }
+    for i := range netInfo.ExternalPort {
+        ext := &netInfo.ExternalPort[i]
+        subject := "port " + ext.ContainerPort
+        if keepPort(ext.ContainerPort) {
+            o := findPort(old, ext.ContainerPort)
+            changed, err := changeAddrs(ext.ContainerPort, portAddrs(o), o.Routes, portAddrs(ext), ext.Routes, nspath)
+            if err != nil {
+                fail(subject, err)
+                realized.ExternalPort = append(realized.ExternalPort, *o)
+                continue
+            } else if changed {
+                rec.normal(reasonAddressesChanged, fmt.Sprintf("addresses of %s changed", ext.ContainerPort))
+            }
+            realized.ExternalPort = append(realized.ExternalPort, *ext)
+            continue
+        }
+        if err := createExternalPort(netInfo, ext, opts, st, nspath, result); err != nil {
+            fail(subject, err)
+            continue
+        }
+        realized.ExternalPort = append(realized.ExternalPort, *ext)
+        created = append(created, ext.ContainerPort)
+        rec.normal(reasonPortAdded, fmt.Sprintf("port %s added", ext.ContainerPort))
+    }
+
+    if !reflect.DeepEqual(old.DefaultRoute, netInfo.DefaultRoute) {
+        if err := applyDefaultRoute(netInfo, nspath); err != nil {
+            fail("default route", err)
+            realized.DefaultRoute = old.DefaultRoute
+        } else if netInfo.DefaultRoute != nil {
+            rec.normal(reasonDefaultRouteChanged, fmt.Sprintf("default route through %s", netInfo.DefaultRoute.Port))
+        }
+    }
+
+    var hotPlugged []string
+    for _, name := range st.HotPlugged {
+        if findPort(annotation, name) == nil {
+            hotPlugged = append(hotPlugged, name)
+        }
+    }
+    st.HotPlugged = hotPlugged
+
+    // recorded even after a failure, so that DEL sees every port
+    st.NetInfo = &realized
+    if err = st.Save(); err != nil {
+        return created, err
+    }
+    return created, firstErr
+}
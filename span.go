@@ -0,0 +1,377 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+    "strings"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/link"
+
+    "github.com/vishvananda/netlink"
+)
+
+const (
+    minVID = 1
+    maxVID = 4094
+    defaultAllocations = "kube-system/unicni-span"
+    minVNI = 1
+    maxVNI = 0xffffff
+    // keys of the allocation ConfigMap, the nodes using each ID are
+    // under <key>.nodes
+    allocVlans = "vlans"
+    allocVNIs = "vnis"
+    allocNodes = ".nodes"
+)
+
+// UplinkConf spans the group bridges over nodes through VLANs of a
+// physical NIC, one VLAN per group channel taken from [VlanMin, VlanMax].
+// Allocations is the <namespace>/<name> of the ConfigMap recording them.
+type UplinkConf struct {
+    Device string           `json:"device"`
+    VlanMin int             `json:"vlan_min"`
+    VlanMax int             `json:"vlan_max"`
+    Allocations string      `json:"allocations"`
+}
+
+// spanConfig tells how the group bridges reach the other nodes,
+// at most one of overlay and uplink is set.
+type spanConfig struct {
+    conf *CNINetConf
+    overlay *link.OverlayConfig
+    uplink *UplinkConf
+    alloc *spanAllocator
+    // IPsec nonces of the overlay peers
+    peerNonces map[string][]byte
+    peersOnce sync.Once
+    encrypted bool
+}
+
+// spanAllocator records the VLAN or VNI of every group channel in a
+// ConfigMap shared by the nodes, so that two channels never get the same
+// one, with the nodes using it so that it is given back with the last.
+type spanAllocator struct {
+    conf *CNINetConf
+    namespace string
+    name string
+    mu sync.Mutex
+    // an allocation never changes once recorded
+    cache map[string]int
+}
+
+func newSpanAllocator(conf *CNINetConf, ref string) (*spanAllocator, error) {
+    if ref == "" {
+        ref = defaultAllocations
+    }
+    parts := strings.SplitN(ref, "/", 2)
+    if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+        return nil, fmt.Errorf("allocations %q is not <namespace>/<name>", ref)
+    }
+    return &spanAllocator{conf: conf, namespace: parts[0], name: parts[1], cache: make(map[string]int)}, nil
+}
+
+// pickID returns the ID of key in ids, or gives it the first free one of
+// [min, max] from preferred on. It fails when an ID is recorded twice.
+func pickID(ids map[string]int, key string, min int, max int, preferred int) (int, bool, error) {
+    owners := make(map[int]string)
+    var keys []string
+    for k := range ids {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        if other, ok := owners[ids[k]]; ok {
+            return 0, false, fmt.Errorf("%d is allocated to both %s and %s", ids[k], other, k)
+        }
+        owners[ids[k]] = k
+    }
+    if id, ok := ids[key]; ok {
+        return id, false, nil
+    }
+
+    size := max - min + 1
+    if preferred < min || preferred > max {
+        preferred = min
+    }
+    for n := 0; n < size; n++ {
+        id := min + (preferred - min + n) % size
+        if _, used := owners[id]; !used {
+            ids[key] = id
+            return id, true, nil
+        }
+    }
+    return 0, false, fmt.Errorf("no free id left in %d-%d", min, max)
+}
+
+// readAllocations decodes the IDs recorded under kind, and their nodes.
+func (a *spanAllocator) readAllocations(data map[string]string, kind string) (map[string]int, map[string][]string, error) {
+    ids := make(map[string]int)
+    nodes := make(map[string][]string)
+    if raw := data[kind]; raw != "" {
+        if err := json.Unmarshal([]byte(raw), &ids); err != nil {
+            return nil, nil, fmt.Errorf("bad %s in %s/%s: %v", kind, a.namespace, a.name, err)
+        }
+    }
+    if raw := data[kind + allocNodes]; raw != "" {
+        if err := json.Unmarshal([]byte(raw), &nodes); err != nil {
+            return nil, nil, fmt.Errorf("bad %s%s in %s/%s: %v", kind, allocNodes, a.namespace, a.name, err)
+        }
+    }
+    return ids, nodes, nil
+}
+
+func writeAllocations(data map[string]string, kind string, ids map[string]int, nodes map[string][]string) error {
+    raw, err := json.Marshal(ids)
+    if err != nil {
+        return err
+    }
+    data[kind] = string(raw)
+    if raw, err = json.Marshal(nodes); err != nil {
+        return err
+    }
+    data[kind + allocNodes] = string(raw)
+    return nil
+}
+
+// useID adds node to those using key, false when it was already.
+func useID(nodes map[string][]string, key string, node string) bool {
+    for _, n := range nodes[key] {
+        if n == node {
+            return false
+        }
+    }
+    nodes[key] = append(nodes[key], node)
+    return true
+}
+
+// dropID removes node from those using key, and the ID of key with the
+// last of them. It tells whether anything changed.
+func dropID(ids map[string]int, nodes map[string][]string, key string, node string) bool {
+    users := nodes[key]
+    for i, n := range users {
+        if n != node {
+            continue
+        }
+        users = append(users[:i], users[i + 1:]...)
+        if len(users) == 0 {
+            delete(nodes, key)
+            delete(ids, key)
+        } else {
+            nodes[key] = users
+        }
+        return true
+    }
+    return false
+}
+
+// allocate returns the ID of key recorded under kind, recording one of
+// [min, max] first when key has none, and this node as using it.
+func (a *spanAllocator) allocate(kind string, key string, min int, max int, preferred int) (int, error) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if id, ok := a.cache[kind + " " + key]; ok {
+        return id, nil
+    }
+
+    cli, err := a.conf.kubeClient()
+    if err != nil {
+        return 0, err
+    }
+    var id int
+    var added bool
+    err = cli.UpdateConfigMap(a.namespace, a.name, func(data map[string]string) (bool, error) {
+        ids, nodes, err := a.readAllocations(data, kind)
+        if err != nil {
+            return false, err
+        }
+        if id, added, err = pickID(ids, key, min, max, preferred); err != nil {
+            return false, err
+        }
+        if !useID(nodes, key, nodeName()) && !added {
+            return false, nil
+        }
+        return true, writeAllocations(data, kind, ids, nodes)
+    })
+    if err != nil {
+        return 0, fmt.Errorf("failed to allocate %s of %s: %v", kind, key, err)
+    }
+    if added {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] %s: %d allocated to %s in %s/%s\r\n", kind, id, key, a.namespace, a.name)
+    }
+    a.cache[kind + " " + key] = id
+    return id, nil
+}
+
+// release drops this node from the users of the ID of key, the ID is
+// free again once no node uses it.
+func (a *spanAllocator) release(kind string, key string) error {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    delete(a.cache, kind + " " + key)
+
+    cli, err := a.conf.kubeClient()
+    if err != nil {
+        return err
+    }
+    var freed bool
+    err = cli.UpdateConfigMap(a.namespace, a.name, func(data map[string]string) (bool, error) {
+        ids, nodes, err := a.readAllocations(data, kind)
+        if err != nil {
+            return false, err
+        }
+        if !dropID(ids, nodes, key, nodeName()) {
+            return false, nil
+        }
+        _, kept := ids[key]
+        freed = !kept
+        return true, writeAllocations(data, kind, ids, nodes)
+    })
+    if err != nil {
+        return fmt.Errorf("failed to release %s of %s: %v", kind, key, err)
+    }
+    if freed {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] %s of %s released in %s/%s\r\n", kind, key, a.namespace, a.name)
+    }
+    return nil
+}
+
+func checkUplink(conf *UplinkConf) error {
+    if conf.Device == "" {
+        return fmt.Errorf("uplink has no device")
+    }
+    if conf.VlanMin == 0 {
+        conf.VlanMin = minVID
+    }
+    if conf.VlanMax == 0 {
+        conf.VlanMax = maxVID
+    }
+    if conf.VlanMin < minVID || conf.VlanMax > maxVID || conf.VlanMin > conf.VlanMax {
+        return fmt.Errorf("invalid uplink vlan range %d-%d", conf.VlanMin, conf.VlanMax)
+    }
+    return nil
+}
+
+func newSpanConfig(conf *CNINetConf) (*spanConfig, error) {
+    if conf.Overlay != nil && conf.Uplink != nil {
+        return nil, fmt.Errorf("overlay and uplink can not be used together")
+    }
+
+    span := &spanConfig{conf: conf}
+    if conf.Uplink != nil {
+        if err := checkUplink(conf.Uplink); err != nil {
+            return nil, err
+        }
+        span.uplink = conf.Uplink
+        alloc, err := newSpanAllocator(conf, conf.Uplink.Allocations)
+        if err != nil {
+            return nil, err
+        }
+        span.alloc = alloc
+    }
+
+    ovl, err := overlayConfig(conf)
+    if err != nil {
+        return nil, err
+    }
+    span.overlay = ovl
+    if ovl != nil {
+        if span.alloc, err = newSpanAllocator(conf, conf.Overlay.Allocations); err != nil {
+            return nil, err
+        }
+    }
+    return span, nil
+}
+
+// loadPeers lists the overlay peers and their IPsec nonces from the
+// Nodes, the first time they are needed.
+func (s *spanConfig) loadPeers() {
+    s.peersOnce.Do(func() {
+        s.overlay.Peers, s.peerNonces, s.overlay.Complete = overlayPeers(s.conf, s.overlay.Local)
+    })
+}
+
+// prepareOverlay readies the overlay for a bridge getting its first member
+// on the node: the peers are looked up, and the traffic to them encrypted
+// before any flows.
+func (s *spanConfig) prepareOverlay() error {
+    s.loadPeers()
+    if s.conf.Encryption == nil || s.encrypted {
+        return nil
+    }
+    if err := applyEncryption(s.conf, s); err != nil {
+        return fmt.Errorf("failed to set up encryption: %v", err)
+    }
+    s.encrypted = true
+    return nil
+}
+
+// spanID returns the ID allocated to the group channel of br. A bridge
+// spanned already keeps its ID, recorded if it was not.
+func spanID(br *link.Bridge, span *spanConfig, kind string, key string, min int, max int, hashed int) (int, error) {
+    current := br.UplinkID()
+    preferred := current
+    if preferred == 0 {
+        preferred = hashed
+    }
+    id, err := span.alloc.allocate(kind, key, min, max, preferred)
+    if err == nil && current != 0 && current != id {
+        err = fmt.Errorf("bridge %s spans on %d but %d is allocated to it", br.Name, current, id)
+    }
+    return id, err
+}
+
+func attachSpan(br *link.Bridge, span *spanConfig, cred string, group string, chanType string) error {
+    var err error
+    switch {
+    case span == nil:
+        return nil
+    case span.overlay != nil:
+        // a bridge spanned already keeps its peers, the node daemon
+        // refreshes them
+        if br.UplinkID() == 0 {
+            if err = span.prepareOverlay(); err != nil {
+                break
+            }
+        }
+        cfg := *span.overlay
+        var vni int
+        vni, err = spanID(br, span, allocVNIs, cred + "/" + group + "/" + chanType, minVNI, maxVNI,
+                          int(link.OverlayVNI(cred, group, chanType)))
+        if err == nil {
+            cfg.VNI = uint32(vni)
+            _, err = br.EnsureOverlay(&cfg)
+        }
+    case span.uplink != nil:
+        var vid int
+        vid, err = spanID(br, span, allocVlans, cred + "/" + group + "/" + chanType, span.uplink.VlanMin, span.uplink.VlanMax,
+                          link.UplinkVID(cred, group, chanType, span.uplink.VlanMin, span.uplink.VlanMax))
+        if err == nil {
+            _, err = br.EnsureVlanUplink(span.uplink.Device, vid)
+        }
+    }
+
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to span %s over nodes: %v\r\n", br.Name, err)
+    }
+    return err
+}
+
+// releaseSpan gives the ID of the group channel back once its bridge is
+// gone from the node with its last member.
+func releaseSpan(span *spanConfig, cred string, group string, chanType string, brName string) {
+    if span == nil || span.alloc == nil {
+        return
+    }
+    if _, err := netlink.LinkByName(brName); err == nil {
+        return
+    }
+    kind := allocVlans
+    if span.overlay != nil {
+        kind = allocVNIs
+    }
+    if err := span.alloc.release(kind, cred + "/" + group + "/" + chanType); err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] %v\r\n", err)
+    }
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestPickID(t *testing.T) {
+    ids := make(map[string]int)
+    pick := func(key string, preferred int, want int, added bool) {
+        got, ok, err := pickID(ids, key, 100, 103, preferred)
+        if err != nil || got != want || ok != added {
+            t.Fatalf("%s: got %d, %v, %v, want %d, %v", key, got, ok, err, want, added)
+        }
+    }
+    pick("a", 102, 102, true)
+    // taken: the next one, around the end of the range
+    pick("b", 102, 103, true)
+    pick("c", 102, 100, true)
+    // known whatever it would hash to now
+    pick("a", 101, 102, false)
+    // a hash out of the range starts from its bottom
+    pick("d", 7, 101, true)
+
+    if got, _, err := pickID(ids, "e", 100, 103, 100); err == nil {
+        t.Fatalf("got %d out of a full range", got)
+    }
+    if len(ids) != 4 {
+        t.Fatalf("failed pick recorded: %v", ids)
+    }
+}
+
+func TestPickIDNarrowedRange(t *testing.T) {
+    ids := map[string]int{"a": 20}
+    if got, added, err := pickID(ids, "a", 100, 199, 150); err != nil || got != 20 || added {
+        t.Fatalf("got %d, %v, %v, want 20 kept", got, added, err)
+    }
+}
+
+func TestPickIDRecordedTwice(t *testing.T) {
+    ids := map[string]int{"a": 110, "b": 150, "c": 150}
+    for _, key := range []string{"a", "d"} {
+        if got, _, err := pickID(ids, key, 100, 199, 160); err == nil {
+            t.Errorf("%s: got %d from a clashing allocation", key, got)
+        }
+    }
+}
+
+func TestSpanUsers(t *testing.T) {
+    ids := map[string]int{"c/g/data": 100}
+    nodes := make(map[string][]string)
+    if !useID(nodes, "c/g/data", "n1") || !useID(nodes, "c/g/data", "n2") || useID(nodes, "c/g/data", "n1") {
+        t.Fatalf("users %v", nodes)
+    }
+
+    if dropID(ids, nodes, "c/g/data", "n3") {
+        t.Fatal("dropped a node that never used it")
+    }
+    // the ID stays while another node spans the channel
+    if !dropID(ids, nodes, "c/g/data", "n1") || ids["c/g/data"] != 100 {
+        t.Fatalf("after n1 left: ids %v, users %v", ids, nodes)
+    }
+    if !dropID(ids, nodes, "c/g/data", "n2") || len(ids) != 0 || len(nodes) != 0 {
+        t.Fatalf("after the last left: ids %v, users %v", ids, nodes)
+    }
+}
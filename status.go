@@ -0,0 +1,151 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/client"
+    "github.com/union-cni/pkg/link"
+    "github.com/union-cni/pkg/netinfo"
+
+    "github.com/containernetworking/cni/pkg/types"
+    "github.com/containernetworking/cni/pkg/types/current"
+    "github.com/vishvananda/netlink"
+)
+
+const networkStatusKey = "network_status"
+
+// KubeAuthConf gives unicni its own credentials, it needs them to patch
+// pods. Without server, the in-cluster environment of the node is used.
+type KubeAuthConf struct {
+    Server string       `json:"server"`
+    TokenFile string    `json:"token_file"`
+    CAFile string       `json:"ca_file"`
+    CertFile string     `json:"cert_file"`
+    KeyFile string      `json:"key_file"`
+}
+
+// portStatus is one entry of the network_status annotation, after
+// k8s.v1.cni.cncf.io/network-status plus the host side of the port.
+type portStatus struct {
+    Name string         `json:"name"`
+    Interface string    `json:"interface"`
+    IPs []string        `json:"ips,omitempty"`
+    Mac string          `json:"mac,omitempty"`
+    Default bool        `json:"default,omitempty"`
+    DNS *types.DNS      `json:"dns,omitempty"`
+    HostPeer string     `json:"host_peer,omitempty"`
+    Bridge string       `json:"bridge,omitempty"`
+}
+
+// kubeClient returns the authenticated client when kubeauth is set, the
+// insecure one of kubemaster otherwise.
+func (conf *CNINetConf) kubeClient() (*client.Client, error) {
+    if conf.KubeAuth == nil {
+        return client.CreateInsecureClient(conf.kubeMaster(), defaultPort), nil
+    }
+    return client.CreateClient(&client.AuthConfig{
+        Server: conf.KubeAuth.Server,
+        TokenFile: conf.KubeAuth.TokenFile,
+        CAFile: conf.KubeAuth.CAFile,
+        CertFile: conf.KubeAuth.CertFile,
+        KeyFile: conf.KubeAuth.KeyFile,
+    })
+}
+
+// bridgePeer returns the host port of a bridge that only serves one pod
+// port, skipping its tunnels and uplinks.
+func bridgePeer(brName string) string {
+    br, err := netlink.LinkByName(brName)
+    if err != nil {
+        return ""
+    }
+    links, err := netlink.LinkList()
+    if err != nil {
+        return ""
+    }
+    for _, l := range links {
+        if l.Attrs().MasterIndex == br.Attrs().Index && !link.IsInfraPort(l) {
+            return l.Attrs().Name
+        }
+    }
+    return ""
+}
+
+// networkStatus describes the ports of the result, which lists the host
+// interfaces of every port right before the port itself.
+func networkStatus(netName string, netInfo *netinfo.NetworkInfo, result *current.Result) []*portStatus {
+    exts := make(map[string]netinfo.ExternalInfo)
+    for _, ext := range netInfo.GetExternalPorts() {
+        exts[ext.ContainerPort] = ext
+    }
+
+    var statuses []*portStatus
+    var hostIfs []*current.Interface
+    for i, iface := range result.Interfaces {
+        if iface.Sandbox == "" {
+            hostIfs = append(hostIfs, iface)
+            continue
+        }
+
+        ps := &portStatus{
+            Name: netName,
+            Interface: iface.Name,
+            Mac: iface.Mac,
+        }
+        if len(hostIfs) > 0 {
+            ps.Bridge = hostIfs[0].Name
+        }
+        if len(hostIfs) > 1 {
+            ps.HostPeer = hostIfs[1].Name
+        } else if ext, ok := exts[iface.Name]; ok && ext.HostPort != "" {
+            ps.HostPeer = ext.HostPort
+        } else if ps.Bridge != "" {
+            ps.HostPeer = bridgePeer(ps.Bridge)
+        }
+        hostIfs = nil
+
+        for _, ipc := range result.IPs {
+            if ipc.Interface != nil && *ipc.Interface == i {
+                ps.IPs = append(ps.IPs, ipc.Address.IP.String())
+            }
+        }
+        if dr := netInfo.DefaultRoute; dr != nil && dr.Port == iface.Name {
+            ps.Default = true
+            if len(result.DNS.Nameservers) != 0 {
+                ps.DNS = &result.DNS
+            }
+        }
+        statuses = append(statuses, ps)
+    }
+    return statuses
+}
+
+// writeNetworkStatus records the ports on the pod, or clears the record
+// when result is nil.
+func writeNetworkStatus(conf *CNINetConf, k8sArgs *K8SArgs, netInfo *netinfo.NetworkInfo, result *current.Result) error {
+    if !conf.NetworkStatus {
+        return nil
+    }
+    cli, err := conf.kubeClient()
+    if err != nil {
+        return err
+    }
+
+    value := ""
+    if result != nil {
+        raw, err := json.Marshal(networkStatus(conf.Name, netInfo, result))
+        if err != nil {
+            return err
+        }
+        value = string(raw)
+    }
+
+    err = cli.SetPodAnnotation(string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME), networkStatusKey, value)
+    if err != nil {
+        return fmt.Errorf("failed to write %s: %v", networkStatusKey, err)
+    }
+    fmt.Fprintf(os.Stderr, "[UNION CNI] %s: %s\r\n", networkStatusKey, value)
+    return nil
+}
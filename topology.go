@@ -0,0 +1,309 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "flag"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "text/tabwriter"
+    "encoding/json"
+
+    "github.com/union-cni/pkg/link"
+    "github.com/union-cni/pkg/netinfo"
+    "github.com/union-cni/pkg/state"
+
+    "github.com/containernetworking/cni/pkg/skel"
+    "github.com/ghodss/yaml"
+)
+
+const defaultCNIPath = "/opt/cni/bin"
+
+// labDevice is one simulated device of a topology, with the network_info
+// a pod of it would carry. Its netns is named after its lab and it.
+type labDevice struct {
+    Name string                 `json:"name"`
+    netinfo.NetworkInfo
+}
+
+// labEnd is one end of a wire, a port of a device.
+type labEnd struct {
+    Device string                `json:"device"`
+    Port string                  `json:"port"`
+    IPs []netinfo.AddrInfo       `json:"ips,omitempty"`
+}
+
+// labLink wires two devices back to back, no bridge in between.
+type labLink struct {
+    A labEnd                     `json:"a"`
+    B labEnd                     `json:"b"`
+}
+
+type topology struct {
+    Name string                  `json:"name"`
+    Devices []labDevice          `json:"devices"`
+    Links []labLink              `json:"links"`
+}
+
+// labItem is a device or a wire of a topology, as it ended up.
+type labItem struct {
+    Kind string                  `json:"kind"`
+    Name string                  `json:"name"`
+    Netns string                 `json:"netns,omitempty"`
+    Ports []*ctlPort             `json:"ports,omitempty"`
+    Error string                 `json:"error,omitempty"`
+    // netns of each port of a wire
+    portNetns []string
+}
+
+// loadTopology reads a topology file, YAML or JSON. The lab is named
+// after the file unless it names itself.
+func loadTopology(path string) (*topology, error) {
+    raw, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    topo := &topology{}
+    if err = yaml.Unmarshal(raw, topo); err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+    }
+    if topo.Name == "" {
+        topo.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+    }
+
+    devices := make(map[string]bool)
+    for i := range topo.Devices {
+        dev := &topo.Devices[i]
+        switch {
+            case dev.Name == "" || strings.Contains(dev.Name, "/"):
+                return nil, fmt.Errorf("device %d: bad name %q", i, dev.Name)
+            case devices[dev.Name]:
+                return nil, fmt.Errorf("device %s listed twice", dev.Name)
+            case dev.GetCred() == "" || dev.GetGroup() == "":
+                return nil, fmt.Errorf("device %s: credential and group are required", dev.Name)
+        }
+        devices[dev.Name] = true
+    }
+    for i, l := range topo.Links {
+        for _, end := range []labEnd{l.A, l.B} {
+            if !devices[end.Device] || end.Port == "" {
+                return nil, fmt.Errorf("link %d: bad end %s/%s", i, end.Device, end.Port)
+            }
+        }
+    }
+    return topo, nil
+}
+
+// labContainerID keys the state of a device, as the container ID keys
+// the state of a pod. It names its netns too, so that the devices of two
+// labs don't share one.
+func labContainerID(lab string, device string) string {
+    return "lab-" + lab + "-" + device
+}
+
+func labNetns(lab string, device string) string {
+    return link.NetnsPath(labContainerID(lab, device))
+}
+
+// labState loads the state of a device, it fails when the state is of
+// another lab whose names add up to the same ID.
+func labState(lab string, device string) (*state.State, error) {
+    st, err := state.Load(labContainerID(lab, device))
+    if err != nil {
+        return nil, err
+    }
+    if st.Lab != lab || st.Pod != lab + "/" + device {
+        return nil, fmt.Errorf("netns %s belongs to %s", labContainerID(lab, device), st.Pod)
+    }
+    return st, nil
+}
+
+func (l *labLink) name() string {
+    return fmt.Sprintf("%s/%s-%s/%s", l.A.Device, l.A.Port, l.B.Device, l.B.Port)
+}
+
+// deviceUp creates the netns of dev and sets its network up as ADD
+// would, recording a state so that down, gc and unictl know about it.
+func deviceUp(lab string, dev *labDevice, conf *CNINetConf, span *spanConfig, cniPath string) *labItem {
+    item := &labItem{Kind: "device", Name: dev.Name}
+    cid := labContainerID(lab, dev.Name)
+    st, err := labState(lab, dev.Name)
+    if err != nil && !os.IsNotExist(err) {
+        item.Error = err.Error()
+        return item
+    }
+    nspath, err := link.CreateNamedNS(cid)
+    if err != nil {
+        item.Error = err.Error()
+        return item
+    }
+    item.Netns = nspath
+
+    if st == nil {
+        // a device already up is left as it is
+        st = state.New(cid, nspath)
+        st.Pod = lab + "/" + dev.Name
+        st.Lab = lab
+        st.NetConf, _ = json.Marshal(conf)
+        st.CNIPath = cniPath
+        st.NetInfo = &dev.NetworkInfo
+        opts := &addOptions{
+            span: span,
+            ipam: conf.ChannelIPAM,
+            delegate: newDelegate(conf, &skel.CmdArgs{ContainerID: cid, Netns: nspath, Path: cniPath}),
+        }
+        if _, err = createNetwork(st.NetInfo, opts, st, nspath); err != nil {
+            item.Error = err.Error()
+        }
+        if err := st.Save(); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to save state: %v\r\n", err)
+        }
+    }
+    item.Ports = expectedPorts(st.NetInfo)
+    inspectPorts(st, item.Ports)
+    return item
+}
+
+// wireUp creates the wire l unless its first end is there already.
+func wireUp(lab string, l *labLink) *labItem {
+    item := &labItem{Kind: "link", Name: l.name()}
+    aNS, bNS := labNetns(lab, l.A.Device), labNetns(lab, l.B.Device)
+    if _, err := link.PodPort(l.A.Port, aNS); err != nil {
+        err = link.CreateWire(l.A.Port, aNS, l.B.Port, bNS)
+        if err == nil {
+            err = addPortAddrs(l.A.Port, l.A.IPs, nil, aNS)
+        }
+        if err == nil {
+            err = addPortAddrs(l.B.Port, l.B.IPs, nil, bNS)
+        }
+        if err != nil {
+            item.Error = err.Error()
+        }
+    }
+    if item.Error == "" {
+        recordWire(lab, l.A, l.B)
+        recordWire(lab, l.B, l.A)
+    }
+    for _, end := range []labEnd{l.A, l.B} {
+        port := &ctlPort{Name: end.Port, Kind: "wire", Addrs: addrStrings(end.IPs)}
+        nspath := labNetns(lab, end.Device)
+        inspectPorts(&state.State{Netns: nspath}, []*ctlPort{port})
+        item.Ports = append(item.Ports, port)
+        item.portNetns = append(item.portNetns, nspath)
+    }
+    return item
+}
+
+// recordWire adds the wire to the state of the device of end, so that
+// its peer can be told.
+func recordWire(lab string, end labEnd, peer labEnd) {
+    st, err := labState(lab, end.Device)
+    if err != nil {
+        return
+    }
+    st.AddWire(state.WireState{ContainerPort: end.Port, PeerNetns: labNetns(lab, peer.Device), PeerPort: peer.Port})
+    if err = st.Save(); err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to save state: %v\r\n", err)
+    }
+}
+
+// deviceDown releases what deviceUp set up, then removes the netns and
+// the wires in it.
+func deviceDown(lab string, dev *labDevice) *labItem {
+    item := &labItem{Kind: "device", Name: dev.Name, Netns: labNetns(lab, dev.Name)}
+    st, err := labState(lab, dev.Name)
+    switch {
+        case err == nil:
+            releaseState(st)
+        case os.IsNotExist(err):
+            // left half up, the bridges of the group may still be there
+            if _, err := os.Stat(item.Netns); err == nil {
+                deleteNetwork(&dev.NetworkInfo, nil, item.Netns, nil)
+            }
+        default:
+            // not ours to remove
+            item.Error = err.Error()
+            return item
+    }
+    if err := link.DeleteNamedNS(labContainerID(lab, dev.Name)); err != nil {
+        item.Error = err.Error()
+    }
+    return item
+}
+
+func (c *ctl) printLab(items []*labItem) error {
+    err := c.print(items, func(w *tabwriter.Writer) {
+        fmt.Fprintln(w, "KIND\tNAME\tNETNS\tPORT\tSTATE")
+        for _, item := range items {
+            switch {
+                case item.Error != "":
+                    fmt.Fprintf(w, "%s\t%s\t%s\t-\tfailed: %s\n", item.Kind, item.Name, dash(item.Netns), item.Error)
+                case len(item.Ports) == 0:
+                    fmt.Fprintf(w, "%s\t%s\t%s\t-\tdown\n", item.Kind, item.Name, dash(item.Netns))
+            }
+            for i, port := range item.Ports {
+                nspath := item.Netns
+                if i < len(item.portNetns) {
+                    nspath = item.portNetns[i]
+                }
+                fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", item.Kind, item.Name, dash(nspath), port.Name, portState(port))
+            }
+        }
+    })
+    if err != nil {
+        return err
+    }
+    for _, item := range items {
+        if item.Error != "" {
+            return fmt.Errorf("%s %s: %s", item.Kind, item.Name, item.Error)
+        }
+    }
+    return nil
+}
+
+// topology sets a lab of simulated devices up or down on this host, no
+// Kubernetes involved.
+func (c *ctl) topology(argv []string) error {
+    if len(argv) == 0 || (argv[0] != "up" && argv[0] != "down") {
+        return fmt.Errorf("topology takes up or down")
+    }
+    fs := flag.NewFlagSet("topology " + argv[0], flag.ContinueOnError)
+    file := fs.String("f", "", "topology file")
+    confPath := fs.String("conf", "", "unicni netconf or conflist")
+    cniPath := fs.String("cni-path", defaultCNIPath, "where IPAM plugins are looked up")
+    if err := fs.Parse(argv[1:]); err != nil {
+        return err
+    }
+    if *file == "" || fs.NArg() != 0 {
+        return fmt.Errorf("topology %s takes -f", argv[0])
+    }
+    topo, err := loadTopology(*file)
+    if err != nil {
+        return err
+    }
+
+    items := []*labItem{}
+    if argv[0] == "down" {
+        for i := range topo.Devices {
+            items = append(items, deviceDown(topo.Name, &topo.Devices[i]))
+        }
+        return c.printLab(items)
+    }
+
+    conf, err := loadNetConf(*confPath)
+    if err != nil {
+        return err
+    }
+    span, err := newSpanConfig(conf)
+    if err != nil {
+        return err
+    }
+    for i := range topo.Devices {
+        items = append(items, deviceUp(topo.Name, &topo.Devices[i], conf, span, *cniPath))
+    }
+    for i := range topo.Links {
+        items = append(items, wireUp(topo.Name, &topo.Links[i]))
+    }
+    return c.printLab(items)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "os"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+)
+
+func writeTopology(t *testing.T, dir string, name string, content string) string {
+    path := filepath.Join(dir, name)
+    if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestLoadTopology(t *testing.T) {
+    dir, err := ioutil.TempDir("", "topology")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    topo, err := loadTopology(writeTopology(t, dir, "lab1.yaml", `
+devices:
+- name: r1
+  credential: c
+  group: g
+- name: r2
+  credential: c
+  group: g
+  deviceid: r2
+links:
+- a: {device: r1, port: eth1, ips: [{address: 10.0.0.1/30}]}
+  b: {device: r2, port: eth1}
+`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if topo.Name != "lab1" {
+        t.Fatalf("lab %q is not named after its file", topo.Name)
+    }
+    if len(topo.Devices) != 2 || topo.Devices[1].Name != "r2" || topo.Devices[1].GetDeviceID() != "r2" {
+        t.Fatalf("got devices %+v", topo.Devices)
+    }
+    if len(topo.Links) != 1 {
+        t.Fatalf("got links %+v", topo.Links)
+    }
+    if a := topo.Links[0].A; a.Device != "r1" || a.Port != "eth1" || len(a.IPs) != 1 || a.IPs[0].Address != "10.0.0.1/30" {
+        t.Fatalf("got end %+v", a)
+    }
+
+    // JSON is YAML too, and a name of its own wins over the file's
+    topo, err = loadTopology(writeTopology(t, dir, "topo.json",
+                             `{"name": "core", "devices": [{"name": "r1", "credential": "c", "group": "g"}]}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if topo.Name != "core" {
+        t.Fatalf("got lab %q, want core", topo.Name)
+    }
+}
+
+func TestLoadTopologyInvalid(t *testing.T) {
+    dir, err := ioutil.TempDir("", "topology")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    two := "devices:\n- {name: r1, credential: c, group: g}\n- {name: r2, credential: c, group: g}\n"
+    invalid := map[string]string{
+        "not yaml": "devices: [",
+        "device without name": "devices:\n- {credential: c, group: g}\n",
+        "name with a slash": "devices:\n- {name: a/b, credential: c, group: g}\n",
+        "device listed twice": "devices:\n- {name: r1, credential: c, group: g}\n- {name: r1, credential: c, group: g}\n",
+        "device without group": "devices:\n- {name: r1, credential: c}\n",
+        "link to an unknown device": two + "links:\n- a: {device: r1, port: eth1}\n  b: {device: r9, port: eth1}\n",
+        "link without port": two + "links:\n- a: {device: r1}\n  b: {device: r2, port: eth1}\n",
+    }
+    for what, content := range invalid {
+        if topo, err := loadTopology(writeTopology(t, dir, "bad.yaml", content)); err == nil {
+            t.Errorf("%s: got %+v, want an error", what, topo)
+        }
+    }
+    if _, err := loadTopology(filepath.Join(dir, "missing.yaml")); err == nil {
+        t.Error("loaded a missing file")
+    }
+}
@@ -5,16 +5,20 @@ import (
     "runtime"
     "net"
     "os"
+    "flag"
+    "io/ioutil"
+    "path/filepath"
     "encoding/json"
 
     "github.com/union-cni/pkg/link"
     "github.com/union-cni/pkg/ip"
+    "github.com/union-cni/pkg/ipam"
     "github.com/union-cni/pkg/netinfo"
+    "github.com/union-cni/pkg/state"
 
     "github.com/containernetworking/cni/pkg/skel"
     "github.com/containernetworking/cni/pkg/types"
     "github.com/containernetworking/cni/pkg/types/current"
-    "github.com/containernetworking/cni/pkg/version"
 
     "github.com/vishvananda/netlink"
 )
@@ -31,6 +35,22 @@ const (
 type CNINetConf struct {
     types.NetConf
     KubeMaster string `json:"kubemaster"`
+    Overlay *OverlayConf `json:"overlay"`
+    Uplink *UplinkConf `json:"uplink"`
+    Encryption *EncryptionConf `json:"encryption"`
+    ChannelIPAM *ChannelIPAMConf `json:"channel_ipam"`
+    KubeAuth *KubeAuthConf `json:"kubeauth"`
+    NetworkStatus bool `json:"network_status"`
+    Events *EventConf `json:"events"`
+    Daemon *DaemonConf `json:"daemon"`
+    RawPrevResult map[string]interface{} `json:"prevResult"`
+}
+
+func (conf *CNINetConf) kubeMaster() string {
+    if conf.KubeMaster != "" {
+        return conf.KubeMaster
+    }
+    return defaultHost
 }
 
 type K8SArgs struct {
@@ -39,6 +59,8 @@ type K8SArgs struct {
     K8S_POD_NAME               types.UnmarshallableString
     K8S_POD_NAMESPACE          types.UnmarshallableString
     K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+    // only logs the plan of the pod, nothing is set up
+    UNICNI_DRYRUN              types.UnmarshallableBool
 }
 
 func init() {
@@ -48,42 +70,111 @@ func init() {
     runtime.LockOSThread()
 }
 
-func deleteExternalPorts(netInfo *netinfo.NetworkInfo, netns string) (err error) {
-    cred := netInfo.GetCred()
-    group := netInfo.GetGroup()
-    devID := netInfo.GetDeviceID()
+func deleteDeviceMode(ext *netinfo.ExternalInfo, st *state.State, nspath string) error {
+    dev := st.GetDevice(ext.ContainerPort)
+    if dev == nil {
+        // no saved state, at least hand the device back under its host name
+        dev = &state.DeviceState{
+            Name: ext.HostPort,
+            ContainerPort: ext.ContainerPort,
+            Up: true,
+        }
+    }
+    err := link.MoveDeviceToHost(dev, nspath)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to restore device %s: %v\r\n", dev.Name, err)
+    }
+    return err
+}
+
+// deleteExternalPort removes one external port, and its host side.
+func deleteExternalPort(netInfo *netinfo.NetworkInfo, ext *netinfo.ExternalInfo, st *state.State, netns string) {
+    delPortAddrs(ext.ContainerPort, ext.IPs, ext.Routes, netns)
+    switch ext.Type {
+        case "device":
+            deleteDeviceMode(ext, st, netns)
+            return
+        case "tap":
+            link.DelTapInNS(ext.ContainerPort, netns)
+        case link.TunnelGretap, link.TunnelGre, link.TunnelVxlan:
+            link.DelLinkInNS(ext.ContainerPort, netns)
+            link.DelHostTunnel(netInfo.PortBridgeName(ext.ContainerPort))
+        default:
+            link.DelLinkInNS(ext.ContainerPort, netns)
+    }
+    link.DeleteBridge(netInfo.PortBridgeName(ext.ContainerPort))
+}
+
+func deleteExternalPorts(netInfo *netinfo.NetworkInfo, st *state.State, netns string) (err error) {
     extPorts := netInfo.GetExternalPorts()
-    for _, ext := range extPorts {
-        link.DelLinkInNS(ext.ContainerPort, netns)
-        extBrName := fmt.Sprintf("%s%s-%s%s", cred, group, devID, ext.ContainerPort)
-        link.DeleteBridge(extBrName)
+    for i := range extPorts {
+        deleteExternalPort(netInfo, &extPorts[i], st, netns)
     }
     return
 }
 
-func createBridgeMode(cred string, group string, devID string, conPortName string, nspath string) error {
-    extBrName := fmt.Sprintf("%s%s-%s%s", cred, group, devID, conPortName)
-    br,err := link.CreateBridge(extBrName)
-    if err == nil {
-        cLink, cHostLink, err := link.CreateVethPairRandom(conPortName)
-        if err == nil {
-            link.SetPromiscOn(cLink)
-            err = link.JoinNetNS(conPortName, nspath)
-            if err != nil {
-                 fmt.Fprintf(os.Stderr, "[UNION CNI]join nspath %s failed: %v\r\n", nspath, err)
-            } else {
-                err = br.AddLink(cHostLink)
-                if err != nil {
-                    link.DelLinkInNS(conPortName, nspath)
-                }
-            }
+func portFlags(bp *netinfo.BridgePort) *link.PortFlags {
+    if bp == nil {
+        return nil
+    }
+    flags := link.PortFlags(*bp)
+    return &flags
+}
+
+func tapConfig(info *netinfo.TapInfo) (*link.TapConfig, string) {
+    cfg := link.DefaultTapConfig()
+    if info == nil {
+        return cfg, link.TapAttachVeth
+    }
+    if info.Owner != nil {
+        cfg.Owner = *info.Owner
+    }
+    if info.Group != nil {
+        cfg.Group = *info.Group
+    }
+    if info.Queues > 0 {
+        cfg.Queues = info.Queues
+    }
+    cfg.VnetHdr = info.VnetHdr
+    return cfg, info.Attach
+}
+
+func tunnelConfig(ext *netinfo.ExternalInfo) (*link.TunnelConfig, error) {
+    info := ext.Tunnel
+    if info == nil {
+        return nil, fmt.Errorf("external port %s has no tunnel", ext.ContainerPort)
+    }
+
+    cfg := &link.TunnelConfig{
+        Type: ext.Type,
+        Key: info.Key,
+        TTL: info.TTL,
+        DstPort: info.DstPort,
+        Underlay: ext.HostPort,
+    }
+    if info.Local != "" {
+        if cfg.Local = net.ParseIP(info.Local); cfg.Local == nil {
+            return nil, fmt.Errorf("invalid tunnel local address %q", info.Local)
         }
     }
+    if cfg.Remote = net.ParseIP(info.Remote); cfg.Remote == nil {
+        return nil, fmt.Errorf("invalid tunnel remote address %q", info.Remote)
+    }
+    return cfg, nil
+}
 
-    return err
+// checkParent tells apart a missing parent, the usual mistake.
+func checkParent(hostPort string) error {
+    if _, err := netlink.LinkByName(hostPort); err != nil {
+        return failure(reasonMacvlanParentMissing, fmt.Errorf("parent device %q not found on the node: %v", hostPort, err))
+    }
+    return nil
 }
 
 func createMacvlanMode(hostPort string, conPort string, mode string, nspath string) error {
+    if err := checkParent(hostPort); err != nil {
+        return err
+    }
     _, err := link.CreateMacvlanInNS(hostPort, conPort, mode, nspath)
     if err != nil {
         fmt.Fprintf(os.Stderr, "[UNION CNI] failed create macvlan port %s: %v\r\n", conPort, err)
@@ -92,139 +183,375 @@ func createMacvlanMode(hostPort string, conPort string, mode string, nspath stri
     return err
 }
 
-func createExternalPorts(netInfo *netinfo.NetworkInfo, nspath string) (err error) {
-    cred := netInfo.GetCred()
-    group := netInfo.GetGroup()
-    devID := netInfo.GetDeviceID()
-    extPorts := netInfo.GetExternalPorts()
-    for _, ext := range extPorts {
-        switch ext.Type { 
-            case "macvlan": 
-                err = createMacvlanMode(ext.HostPort, ext.ContainerPort, ext.Mode, nspath)
-            default:
-                err = createBridgeMode(cred, group, devID, ext.ContainerPort, nspath)
-        }
+func createDeviceMode(hostPort string, conPort string, st *state.State, nspath string) error {
+    dev, err := link.MoveDeviceToNS(hostPort, conPort, nspath)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to move device %s into pod: %v\r\n", hostPort, err)
+        return err
+    }
+
+    st.AddDevice(*dev)
+    // DEL must find the device even if ADD fails later on
+    if err = st.Save(); err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to save state: %v\r\n", err)
+    }
+    return nil
+}
+
+func createMacvtapMode(hostPort string, conPort string, mode string, st *state.State, nspath string) error {
+    if err := checkParent(hostPort); err != nil {
+        return err
+    }
+    _, devPath, err := link.CreateMacvtapInNS(hostPort, conPort, mode, nspath)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed create macvtap port %s: %v\r\n", conPort, err)
+        return err
+    }
+
+    tap := state.MacvtapState{
+        ContainerPort: conPort,
+        Path: devPath,
+    }
+    tap.Major, tap.Minor, err = link.MacvtapDevNum(conPort, nspath)
+    if err != nil {
+        // the path alone is still useful with a devtmpfs in the pod
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to get device number of %s: %v\r\n", devPath, err)
+    }
+    st.AddMacvtap(tap)
+    fmt.Fprintf(os.Stderr, "[UNION CNI] macvtap port %s uses %s\r\n", conPort, devPath)
+    return nil
+}
+
+// planExternalPort lays out one external port with its addresses.
+func planExternalPort(netInfo *netinfo.NetworkInfo, ext *netinfo.ExternalInfo, opts *addOptions, st *state.State, nspath string, result *current.Result) *portPlan {
+    conPort := ext.ContainerPort
+    brName := netInfo.PortBridgeName(conPort)
+    p := &portPlan{Port: conPort, Kind: ext.Type}
+    l := &portLinks{}
+    switch ext.Type { 
+        case "macvlan": 
+            p.add(fmt.Sprintf("create macvlan %s on %s, mode %s, in netns %s", conPort, ext.HostPort, dash(ext.Mode), nspath), func() error {
+                return createMacvlanMode(ext.HostPort, conPort, ext.Mode, nspath)
+            }, func() {
+                link.DelLinkInNS(conPort, nspath)
+            })
+        case "macvtap":
+            p.add(fmt.Sprintf("create macvtap %s on %s, mode %s, in netns %s", conPort, ext.HostPort, dash(ext.Mode), nspath), func() error {
+                return createMacvtapMode(ext.HostPort, conPort, ext.Mode, st, nspath)
+            }, func() {
+                link.DelLinkInNS(conPort, nspath)
+            })
+        case "device":
+            p.add(fmt.Sprintf("move device %s to netns %s as %s", ext.HostPort, nspath, conPort), func() error {
+                return createDeviceMode(ext.HostPort, conPort, st, nspath)
+            }, nil)
+        case "tap":
+            p.addBridge(l, brName)
+            p.addTap(l, conPort, ext.Tap, brName, nspath)
+            p.addPortFlags(l, ext.BridgePort, brName)
+        case link.TunnelGretap, link.TunnelGre, link.TunnelVxlan:
+            cfg, err := tunnelConfig(ext)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "[UNION CNI] %v\r\n", err)
+                p.Err = err
+                return p
+            }
+            // gre carries no ethernet frames, it can only live in the pod
+            if ext.Tunnel.InPod || !cfg.IsL2() {
+                p.add(fmt.Sprintf("create %s tunnel %s to %s in netns %s", ext.Type, conPort, ext.Tunnel.Remote, nspath), func() error {
+                    _, err := link.CreateTunnelInNS(conPort, cfg, nspath)
+                    return err
+                }, func() {
+                    link.DelLinkInNS(conPort, nspath)
+                })
+                break
+            }
+            p.addBridge(l, brName)
+            p.addVeth(l, conPort, brName, nspath)
+            p.addPortFlags(l, ext.BridgePort, brName)
+            p.add(fmt.Sprintf("create %s tunnel to %s and attach it to bridge %s", ext.Type, ext.Tunnel.Remote, brName), func() error {
+                tLink, err := link.CreateHostTunnel(brName, cfg)
+                if err == nil {
+                    if err = l.br.AddLink(tLink); err != nil {
+                        link.DelHostTunnel(brName)
+                    }
+                }
+                return err
+            }, nil)
+        default:
+            if p.Kind == "" {
+                p.Kind = "bridge"
+            }
+            p.addBridge(l, brName)
+            p.addVeth(l, conPort, brName, nspath)
+            p.addPortFlags(l, ext.BridgePort, brName)
+    }
+
+    p.add("", func() error {
+        appendExtIntfs(brName, conPort, nspath, result)
+        return nil
+    }, nil)
 
-        if (err == nil) && (ext.IP != "") {
-            err = ip.AddrAddInNS(ext.ContainerPort, ext.IP, nspath)
+    if ext.IP != "" {
+        p.add(fmt.Sprintf("add address %s to %s", ext.IP, conPort), func() error {
+            err := ip.AddrAddInNS(conPort, ext.IP, nspath)
             fmt.Fprintf(os.Stderr, "[UNION CNI] add ip addr %s: %v\r\n", ext.IP, err)
-        }
+            if err == nil {
+                reportAddrs(netInfo, conPort, []string{ext.IP}, result)
+            }
+            return err
+        }, nil)
     }
 
-    fmt.Fprintf(os.Stderr, "[UNION CNI] get extports %v\r\n", extPorts)
+    if len(ext.IPAM) != 0 {
+        p.add(fmt.Sprintf("allocate addresses of %s from IPAM plugin %s", conPort, ipamType(ext.IPAM)), func() error {
+            return delegateAddr(opts.delegate, ext.IPAM, conPort, st, nspath, result)
+        }, nil)
+    }
 
-    return
+    p.addAddrs(netInfo, conPort, ext.IPs, ext.Routes, nspath, result)
+    return p
+}
+
+// createExternalPort sets up one external port with its addresses.
+func createExternalPort(netInfo *netinfo.NetworkInfo, ext *netinfo.ExternalInfo, opts *addOptions, st *state.State, nspath string, result *current.Result) error {
+    return planExternalPort(netInfo, ext, opts, st, nspath, result).run()
+}
+
+// appendExtIntfs adds the host bridge of an external port, if it has
+// one, then the port itself.
+func appendExtIntfs(brName string, conPort string, nspath string, result *current.Result) {
+    if br, err := netlink.LinkByName(brName); err == nil {
+        result.Interfaces = append(result.Interfaces, link.Interface(br, ""))
+    }
+    iface, err := link.InterfaceInNS(conPort, nspath)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] failed to lookup %s: %v\r\n", conPort, err)
+        iface = &current.Interface{Name: conPort, Sandbox: nspath}
+    }
+    result.Interfaces = append(result.Interfaces, iface)
 }
 
 func appendIntfs(l netlink.Link, nspath string) *current.Interface {
     return link.Interface(l, nspath)
 }
 
-func createNetwork(netInfo *netinfo.NetworkInfo, netns string) (*current.Result, error) {
-    // assemble result
-    result := &current.Result{}
+// addOptions carries what createNetwork needs from the netconf.
+type addOptions struct {
+    span *spanConfig
+    ipam *ChannelIPAMConf
+    delegate *ipam.Delegate
+    events *eventRecorder
+}
 
+func newDelegate(conf *CNINetConf, args *skel.CmdArgs) *ipam.Delegate {
+    return &ipam.Delegate{
+        CNIVersion: conf.CNIVersion,
+        NetName: conf.Name,
+        ContainerID: args.ContainerID,
+        Netns: args.Netns,
+        Args: args.Args,
+        Path: args.Path,
+    }
+}
+
+// planChannel lays out the system channel of type chanType, named
+// chanName in the pod.
+func planChannel(netInfo *netinfo.NetworkInfo, chanType string, chanName string, opts *addOptions, st *state.State, netns string, result *current.Result) *portPlan {
     cred := netInfo.GetCred()
     group := netInfo.GetGroup()
-    for chanType, chanName := range netInfo.GetSystemChannels() {
-        newBrName := fmt.Sprintf("%s-%s-%s", cred, group, chanType)
-        // the length of bridge name must be less than 15 characters.
-        if len(newBrName) <= 15 {
-            br, err := link.CreateBridge(newBrName)
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "[UNION CNI] failed to create bridge %s: %v\r\n", newBrName, err)
-                return nil, err
-            }
-            // create veth pairs for channel port
-            conLink, hostLink, err := link.CreateVethPairRandom(chanName)
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "[UNION CNI] failed to create veth pairs %s: %v\r\n", chanName, err)
-                return nil, err
-            }
-            // don't care the promisc mode failed or not
-            link.SetPromiscOn(conLink)
-            err = link.JoinNetNS(chanName, netns)
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "[UNION CNI] failed to join namespace %s: %v\r\n", netns, err)
-                return nil, err
-            }
-            err = br.AddLink(hostLink)
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "[UNION CNI] failed to join bridge %s: %v\r\n", newBrName, err)
-                return nil, err
-            }
+    newBrName := netInfo.BridgeName(chanType)
+    p := &portPlan{Port: chanName, Kind: "channel:" + chanType}
+    // the length of bridge name must be less than 15 characters.
+    if len(newBrName) > 15 {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] bridge name %s is too long\r\n", newBrName)
+        p.Skip = fmt.Sprintf("bridge name %s is too long", newBrName)
+        return p
+    }
 
-            // append interface results
-            result.Interfaces = append(result.Interfaces, link.Interface(br.Data, ""))
-            result.Interfaces = append(result.Interfaces, link.Interface(hostLink, ""))
-            result.Interfaces = append(result.Interfaces, link.Interface(conLink, netns))
-        } else {
-            fmt.Fprintf(os.Stderr, "[UNION CNI] bridge name %s is too long\r\n", newBrName)
+    chanInfo := netInfo.GetChannelInfo(chanType)
+    var pool *ipam.Pool
+    if len(chanInfo.IPAM) == 0 {
+        var err error
+        if pool, err = channelPool(opts.ipam, netInfo, chanType); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to address channel %s: %v\r\n", chanName, err)
+            p.Err = err
+            return p
         }
     }
 
-    // create external ports 
-    createExternalPorts(netInfo, netns)
+    l := &portLinks{}
+    action := spanAction(opts.span, cred, group, chanType, newBrName)
+    if action != "" {
+        // undone last, once the bridge is gone if this was its first pod
+        p.add("", func() error {
+            return nil
+        }, func() {
+            releaseSpan(opts.span, cred, group, chanType, newBrName)
+        })
+    }
+    p.addBridge(l, newBrName)
+    if chanInfo.Type == "tap" {
+        p.addTap(l, chanName, chanInfo.Tap, newBrName, netns)
+    } else {
+        p.addVeth(l, chanName, newBrName, netns)
+    }
+    p.addPortFlags(l, chanInfo.BridgePort, newBrName)
+    if action != "" {
+        p.add(action, func() error {
+            return attachSpan(l.br, opts.span, cred, group, chanType)
+        }, nil)
+    }
+
+    // append interface results, the pod end is looked up in the pod for
+    // its final MAC
+    p.add("", func() error {
+        result.Interfaces = append(result.Interfaces, link.Interface(l.br.Data, ""))
+        result.Interfaces = append(result.Interfaces, link.Interface(l.host, ""))
+        iface, err := link.InterfaceInNS(chanName, netns)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to lookup %s: %v\r\n", chanName, err)
+            iface = &current.Interface{Name: chanName, Sandbox: netns}
+        }
+        result.Interfaces = append(result.Interfaces, iface)
+        return nil
+    }, nil)
+
+    switch {
+        case len(chanInfo.IPAM) != 0:
+            p.add(fmt.Sprintf("allocate addresses of %s from IPAM plugin %s", chanName, ipamType(chanInfo.IPAM)), func() error {
+                return delegateAddr(opts.delegate, chanInfo.IPAM, chanName, st, netns, result)
+            }, nil)
+        case pool != nil:
+            p.add(fmt.Sprintf("allocate an address of %s from pool %s (%s)", chanName, pool.Name, pool.Subnet), func() error {
+                return addChannelAddr(pool, netInfo.GetDeviceID(), chanName, st, netns, result)
+            }, nil)
+    }
+    p.addAddrs(netInfo, chanName, chanInfo.IPs, chanInfo.Routes, netns, result)
+    return p
+}
+
+// createChannel sets up the system channel of type chanType, named
+// chanName in the pod.
+func createChannel(netInfo *netinfo.NetworkInfo, chanType string, chanName string, opts *addOptions, st *state.State, netns string, result *current.Result) error {
+    return planChannel(netInfo, chanType, chanName, opts, st, netns, result).run()
+}
 
+func createNetwork(netInfo *netinfo.NetworkInfo, opts *addOptions, st *state.State, netns string) (*current.Result, error) {
+    // assemble result
+    result := &current.Result{}
+    if err := planNetwork(netInfo, opts, st, netns, result).run(opts); err != nil {
+        return nil, err
+    }
     return result, nil
 }
 
-func deleteNetwork(netInfo *netinfo.NetworkInfo, nspath string) error {
-    cred := netInfo.GetCred()
-    group := netInfo.GetGroup()
+// deleteChannel removes the channel port, and its bridge with the
+// last port of the group, giving back the ID it spanned nodes on.
+func deleteChannel(netInfo *netinfo.NetworkInfo, chanType string, chanName string, nspath string, span *spanConfig) {
+    var err error
+    chanInfo := netInfo.GetChannelInfo(chanType)
+    delPortAddrs(chanName, chanInfo.IPs, chanInfo.Routes, nspath)
+    if chanInfo.Type == "tap" {
+        err = link.DelTapInNS(chanName, nspath)
+    } else {
+        err = link.DelLinkInNS(chanName, nspath)
+    }
+    fmt.Fprintf(os.Stderr, "[UNION CNI]deleteNetwork %s: %v\r\n", chanName, err)
+    sysBr := netInfo.BridgeName(chanType)
+    link.DeleteBridgeIfEmpty(sysBr)
+    releaseSpan(span, netInfo.GetCred(), netInfo.GetGroup(), chanType, sysBr)
+}
+
+func deleteNetwork(netInfo *netinfo.NetworkInfo, st *state.State, nspath string, span *spanConfig) error {
     for chanType, chanName := range netInfo.GetSystemChannels() {
-        err := link.DelLinkInNS(chanName, nspath)
-        fmt.Fprintf(os.Stderr, "[UNION CNI]deleteNetwork %s: %v\r\n", chanName, err)
-        sysBr := fmt.Sprintf("%s-%s-%s", cred, group, chanType)
-        link.DeleteBridgeIfEmpty(sysBr)
+        deleteChannel(netInfo, chanType, chanName, nspath, span)
     }
 
-    deleteExternalPorts(netInfo, nspath)
+    deleteExternalPorts(netInfo, st, nspath)
 
     return nil
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+func doAdd(args *skel.CmdArgs) ([]byte, error) {
     conf := CNINetConf{}
     err := json.Unmarshal(args.StdinData, &conf)
     if err != nil {
         fmt.Fprintf(os.Stderr, "[UNION CNI] failed to load netconf: %v", err)
-        return err
+        return nil, err
     }
 
     k8sArgs := K8SArgs{}
     err = types.LoadArgs(args.Args, &k8sArgs)
     if err != nil {
         fmt.Fprintf(os.Stderr, "[UNION CNI]: Failed to load args %q: %v\r\n", args.Args, err)
-        return err
+        return nil, err
+    }
+
+    prev, err := prevResult(&conf)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[UNION CNI] %v\r\n", err)
+        return nil, err
     }
    
     // Get annotaions, parse data and control bridge name
     result := &current.Result{}
     fmt.Fprintf(os.Stderr, "[UNION CNI] k8s namespace: %s, pod name: %s\r\n", k8sArgs.K8S_POD_NAMESPACE, k8sArgs.K8S_POD_NAME)
     if len(k8sArgs.K8S_POD_NAME) != 0 || len(k8sArgs.K8S_POD_NAMESPACE) != 0 {
-        var kubeMaster string
-        if conf.KubeMaster != "" {
-             kubeMaster = conf.KubeMaster
-        } else {
-	     kubeMaster = defaultHost
-        }
+        kubeMaster := conf.kubeMaster()
         fmt.Fprintf(os.Stderr, "[UNION CNI] kubemaster %v\r\n", kubeMaster)
-        netInfo, _ := netinfo.GetNetInfo(kubeMaster, defaultPort, 
-                            string(k8sArgs.K8S_POD_NAMESPACE), 
-                            string(k8sArgs.K8S_POD_NAME))
+        events := newEventRecorder(&conf, &k8sArgs)
+        netInfo, err := lookupNetInfo(&conf, &k8sArgs)
+        if netinfo.IsInvalid(err) {
+            events.warn("annotation network_info", failure(reasonInvalidNetworkInfo, err))
+        }
         // If no annotaion, just ignore it.
         if netInfo != nil {
-            result,_ = createNetwork(netInfo, args.Netns) 
+            // the peers of an overlay are only looked up for a bridge
+            // spanned for the first time
+            span, err := newSpanConfig(&conf)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "[UNION CNI] invalid netconf: %v\r\n", err)
+                return nil, err
+            }
+            st := state.New(args.ContainerID, args.Netns)
+            st.Pod = podKey(&k8sArgs)
+            st.NetConf = args.StdinData
+            st.CNIArgs = args.Args
+            st.CNIPath = args.Path
+            st.NetInfo = netInfo
+            opts := &addOptions{
+                span: span,
+                ipam: conf.ChannelIPAM,
+                delegate: newDelegate(&conf, args),
+                events: events,
+            }
+            if k8sArgs.UNICNI_DRYRUN {
+                logPlan(planNetwork(netInfo, opts, st, args.Netns, result))
+                return formatResult(mergeResult(prev, result), conf.CNIVersion)
+            }
+            // best effort: the pod starts with what could be set up, the
+            // Event tells what could not
+            r, err := createNetwork(netInfo, opts, st, args.Netns)
+            if r != nil {
+                result = r
+            }
+            events.warn("network", err)
+            if err = st.Save(); err != nil {
+                fmt.Fprintf(os.Stderr, "[UNION CNI] failed to save state: %v\r\n", err)
+            }
+            if err = writeNetworkStatus(&conf, &k8sArgs, netInfo, result); err != nil {
+                fmt.Fprintf(os.Stderr, "[UNION CNI] %v\r\n", err)
+            }
         }
     }
-    return types.PrintResult(result, conf.CNIVersion)
+    return formatResult(mergeResult(prev, result), conf.CNIVersion)
 }
 
-func cmdDel(args *skel.CmdArgs) error {
+func doDel(args *skel.CmdArgs) error {
     // Delete all port related current user's pod
     fmt.Fprintf(os.Stderr, "[UNION CNI] action delete.\r\n")
-    conf := types.NetConf{}
+    conf := CNINetConf{}
     err := json.Unmarshal(args.StdinData, &conf)
     if err != nil {
         fmt.Fprintf(os.Stderr, "[UNION CNI] failed to load netconf: %v", err)
@@ -240,15 +567,122 @@ func cmdDel(args *skel.CmdArgs) error {
 
     // Get annotaions, parse data and control bridge name, and delete all
     fmt.Fprintf(os.Stderr, "[UNION CNI] k8s namespace: %s, pod name: %s\r\n", k8sArgs.K8S_POD_NAMESPACE, k8sArgs.K8S_POD_NAME)
+    if k8sArgs.UNICNI_DRYRUN {
+        // ADD set nothing up
+        return nil
+    }
     if len(k8sArgs.K8S_POD_NAME) != 0 || len(k8sArgs.K8S_POD_NAMESPACE) != 0 {
-        netInfo, err := netinfo.GetNetInfo(defaultHost, defaultPort, string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME))
+        st, err := state.Load(args.ContainerID)
+        if err != nil && !os.IsNotExist(err) {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] failed to load state: %v\r\n", err)
+        }
+        var netInfo *netinfo.NetworkInfo
+        if st != nil && st.NetInfo != nil {
+            // what was set up, live changes and hot-plugged ports included
+            netInfo = st.NetInfo
+        } else {
+            netInfo, err = lookupNetInfo(&conf, &k8sArgs)
+        }
         if err == nil {
-             deleteNetwork(netInfo, args.Netns)
+             // the last pod of a bridge gives back its VLAN or VNI
+             span, _ := newSpanConfig(&conf)
+             deleteNetwork(netInfo, st, args.Netns, span)
+        }
+        releaseChannelAddrs(netInfo, st, args.ContainerID)
+        releaseDelegated(newDelegate(&conf, args), netInfo, st)
+        state.Remove(args.ContainerID)
+        if conf.Events != nil {
+            cleanEvents(string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME))
+        }
+        if err = writeNetworkStatus(&conf, &k8sArgs, netInfo, nil); err != nil {
+            // the pod is often gone already
+            fmt.Fprintf(os.Stderr, "[UNION CNI] %v\r\n", err)
         }
     }
     return nil
 }
 
+func cmdAdd(args *skel.CmdArgs) error {
+    if socket := daemonSocket(args.StdinData); socket != "" {
+        out, err := forward(socket, "ADD", args)
+        if err != errDaemonDown {
+            if err == nil {
+                _, err = os.Stdout.Write(out)
+            }
+            return err
+        }
+    }
+
+    out, err := doAdd(args)
+    if err != nil {
+        return err
+    }
+    _, err = os.Stdout.Write(out)
+    return err
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+    if socket := daemonSocket(args.StdinData); socket != "" {
+        if _, err := forward(socket, "DEL", args); err != errDaemonDown {
+            return err
+        }
+    }
+    return doDel(args)
+}
+
+// cmdGC is not known to skel, it only needs the netconf.
+func cmdGC() error {
+    stdinData, err := ioutil.ReadAll(os.Stdin)
+    if err != nil {
+        return err
+    }
+    if socket := daemonSocket(stdinData); socket != "" {
+        _, err := forward(socket, "GC", &skel.CmdArgs{StdinData: stdinData})
+        if err != errDaemonDown {
+            return err
+        }
+    }
+    return doGC(stdinData, nil)
+}
+
 func main() {
-    skel.PluginMain(cmdAdd, cmdDel, version.All)
+    if filepath.Base(os.Args[0]) == "unictl" || (len(os.Args) > 1 && os.Args[1] == "ctl") {
+        argv := os.Args[1:]
+        if filepath.Base(os.Args[0]) != "unictl" {
+            argv = os.Args[2:]
+        }
+        switch err := runCtl(argv); err {
+            case nil:
+            case flag.ErrHelp, errDrift, errPlan:
+                os.Exit(1)
+            default:
+                fmt.Fprintf(os.Stderr, "unictl: %v\n", err)
+                os.Exit(1)
+        }
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == "daemon" {
+        if err := runDaemon(os.Args[2:]); err != nil {
+            fmt.Fprintf(os.Stderr, "[UNION CNI] daemon: %v\r\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+    command := os.Getenv("CNI_COMMAND")
+    if command == "GC" || command == "CHECK" {
+        run := cmdGC
+        if command == "CHECK" {
+            run = cmdCheck
+        }
+        if err := run(); err != nil {
+            e, ok := err.(*types.Error)
+            if !ok {
+                e = &types.Error{Code: errCodeGeneric, Msg: err.Error()}
+            }
+            e.Print()
+            os.Exit(1)
+        }
+        return
+    }
+    skel.PluginMain(cmdAdd, cmdDel, supportedVersions)
 }